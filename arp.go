@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"net"
 	"time"
 
@@ -11,34 +10,22 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func ownupNetworkAddresses(netInterface string, srcMACAddress net.HardwareAddr, vlanIPMap map[uint16]net.IP, stop chan struct{}) {
-	IPv6Address = generateIPv6FromMac(srcMACAddress)
+// ownupNetworkAddresses announces and answers for the ip_source and link-local addresses
+// of the reflector on the VLANs of one trunk.
+//
+// ownupNetworkAddresses loops until 'stop' is closed.
+func ownupNetworkAddresses(t *trunk, policies *policyStore, stop chan struct{}) {
+	reloaded := policies.subscribe()
 	// Get a handle on the network interface
-	rawTraffic, err := pcap.OpenLive(netInterface, 65536, true, time.Second)
+	rawTraffic, err := pcap.OpenLive(t.name, 65536, true, time.Second)
 	if err != nil {
-		logrus.Fatalf("Could not find network interface: %v", netInterface)
+		logrus.Fatalf("Could not find network interface: %v", t.name)
 	}
 
-	// Gratuitous ARP just once after startup
-	for vlan, ip := range vlanIPMap {
-		err := sendARP(rawTraffic, srcMACAddress, net.HardwareAddr{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, ip, ip, vlan)
-		if err != nil {
-			logrus.Error(err)
-			continue
-		}
-	}
-	// Announce link-local just once after startup
-	for vlan := range vlanIPMap {
+	// Gratuitous ARP and link-local announcement just once after startup
+	announced := announceNetworkAddresses(rawTraffic, t, policies.Load(), nil)
 
-		err := sendNA(rawTraffic, srcMACAddress, net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}, IPv6Address, net.IPv6linklocalallnodes, vlan)
-		if err != nil {
-			logrus.Error(err)
-			continue
-		}
-	}
-
-	filterTemplate := "not (ether src %s) and vlan and (arp or icmp6)"
-	err = rawTraffic.SetBPFFilter(fmt.Sprintf(filterTemplate, srcMACAddress))
+	err = rawTraffic.SetBPFFilter(vlanFilter(t, "(arp or icmp6)"))
 	if err != nil {
 		logrus.Fatalf("Could not apply filter on network interface: %v", err)
 	}
@@ -50,27 +37,70 @@ func ownupNetworkAddresses(netInterface string, srcMACAddress net.HardwareAddr,
 		select {
 		case <-stop:
 			return
+		case <-reloaded:
+			// Only announce the addresses which are new since the last announcement
+			announced = announceNetworkAddresses(rawTraffic, t, policies.Load(), announced)
 		case packet = <-in:
+			active := policies.Load()
+			vlan, ok := active.vlanOf(t.name, parseVLANTag(packet))
+			if !ok || active.vlanIPMap[vlan] == nil {
+				continue
+			}
 			if packet.Layer(layers.LayerTypeARP) != nil {
-				respondToArpRequests(rawTraffic, packet, srcMACAddress, vlanIPMap)
+				respondToArpRequests(rawTraffic, packet, t.hardwareAddr, active.vlanIPMap[vlan], active.wireTag(vlan))
 			}
 			if packet.Layer(layers.LayerTypeICMPv6NeighborSolicitation) != nil {
-				respondToNeighborSolicitation(rawTraffic, packet, srcMACAddress, vlanIPMap)
+				owned := []net.IP{t.ipv6Address}
+				if ip6 := active.vlanIP6Map[vlan]; ip6 != nil {
+					owned = append(owned, ip6)
+				}
+				respondToNeighborSolicitation(rawTraffic, packet, t.hardwareAddr, owned, active.wireTag(vlan))
 			}
 		}
 	}
 }
 
-// respondToArpRequests watches a handle for incoming ARP requests we might care about, and replies to them
-//
-// respondToArpRequests loops until 'stop' is closed.
-func respondToArpRequests(rawTraffic *pcap.Handle, packet gopacket.Packet, srcMACAddress net.HardwareAddr, vlanIPMap map[uint16]net.IP) {
-	tag := parseVLANTag(packet)
-	ip := vlanIPMap[*tag]
-	if ip == nil {
-		return
+// announceNetworkAddresses sends a gratuitous ARP for the ip_source, and unsolicited neighbor advertisements
+// for the link-local address and the ip6_source, of every VLAN of the trunk whose addresses are not already
+// in 'announced'. It returns the announced addresses.
+func announceNetworkAddresses(rawTraffic *pcap.Handle, t *trunk, active *policy, announced map[uint16]vlanIpSource) map[uint16]vlanIpSource {
+	allNodesMAC := net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+	result := make(map[uint16]vlanIpSource)
+	for vlan, ip := range active.vlanIPsOn(t.name) {
+		source := vlanIpSource{IpSource: ip, Ip6Source: active.vlanIP6Map[vlan]}
+		previous, known := announced[vlan]
+		if !previous.IpSource.Equal(ip) {
+			err := sendARP(rawTraffic, t.hardwareAddr, net.HardwareAddr{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, ip, ip, active.wireTag(vlan))
+			if err != nil {
+				logrus.Error(err)
+				continue
+			}
+			logrus.Debugf("Announced %s on VLAN %d of %s", ip, vlan, t.name)
+		}
+		// Announce link-local only once per VLAN
+		if !known {
+			err := sendNA(rawTraffic, t.hardwareAddr, allNodesMAC, t.ipv6Address, net.IPv6linklocalallnodes, active.wireTag(vlan))
+			if err != nil {
+				logrus.Error(err)
+				continue
+			}
+		}
+		if source.Ip6Source != nil && !previous.Ip6Source.Equal(source.Ip6Source) {
+			err := sendNA(rawTraffic, t.hardwareAddr, allNodesMAC, source.Ip6Source, net.IPv6linklocalallnodes, active.wireTag(vlan))
+			if err != nil {
+				logrus.Error(err)
+				source.Ip6Source = nil
+			} else {
+				logrus.Debugf("Announced %s on VLAN %d of %s", source.Ip6Source, vlan, t.name)
+			}
+		}
+		result[vlan] = source
 	}
+	return result
+}
 
+// respondToArpRequests replies to an ARP request for the ip_source of the VLAN the packet was received on.
+func respondToArpRequests(rawTraffic *pcap.Handle, packet gopacket.Packet, srcMACAddress net.HardwareAddr, ip net.IP, tag uint16) {
 	arpLayer := packet.Layer(layers.LayerTypeARP)
 	if arpLayer == nil {
 		return
@@ -85,7 +115,7 @@ func respondToArpRequests(rawTraffic *pcap.Handle, packet gopacket.Packet, srcMA
 		return
 	}
 
-	err := sendARP(rawTraffic, srcMACAddress, net.HardwareAddr(arp.SourceHwAddress), ip, arp.SourceProtAddress, *tag)
+	err := sendARP(rawTraffic, srcMACAddress, net.HardwareAddr(arp.SourceHwAddress), ip, arp.SourceProtAddress, tag)
 	if err != nil {
 		logrus.Error(err)
 		return
@@ -105,13 +135,7 @@ func sendARP(rawTraffic *pcap.Handle, srcMACAddress net.HardwareAddr, dstMACAddr
 	sendEth := layers.Ethernet{
 		SrcMAC:       srcMACAddress,
 		DstMAC:       dstMACAddress,
-		EthernetType: layers.EthernetTypeDot1Q,
-	}
-	sendTag := layers.Dot1Q{
-		Priority:       0,
-		DropEligible:   false,
-		VLANIdentifier: vlanTag,
-		Type:           layers.EthernetTypeARP,
+		EthernetType: layers.EthernetTypeARP,
 	}
 	sendArp := layers.ARP{
 		AddrType:          layers.LinkTypeEthernet,
@@ -131,7 +155,7 @@ func sendARP(rawTraffic *pcap.Handle, srcMACAddress net.HardwareAddr, dstMACAddr
 		ComputeChecksums: true,
 	}
 
-	err := gopacket.SerializeLayers(buf, opts, &sendEth, &sendTag, &sendArp)
+	err := gopacket.SerializeLayers(buf, opts, tagFrame([]gopacket.SerializableLayer{&sendEth, &sendArp}, vlanTag)...)
 	if err != nil {
 		return err
 	}
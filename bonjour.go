@@ -3,51 +3,94 @@ package main
 import (
 	"fmt"
 	"net"
+	"slices"
 	"time"
 
-	"github.com/gopacket/gopacket"
-	"github.com/gopacket/gopacket/pcap"
 	"github.com/sirupsen/logrus"
 	"github.com/zekroTJA/timedmap"
 )
 
-type bonjourRequest struct {
-	ip           net.IP
-	tag          uint16
-	macAddress   net.HardwareAddr
-	allowedVlans []uint16
-}
-
 var bonjourDuration = 2 * time.Second
 
-func processBonjourPackets(netInterface string, srcMACAddress net.HardwareAddr, poolsMap map[uint16][]uint16, vlanIPMap map[uint16]net.IP, allowedMacsMap map[macAddress]multicastDevice) {
+// The responses of the shared devices are stored in the cache when mdns_cache or dns_gateway is enabled.
+// Questions of the DNS gateway arrive on gatewayQueries, and are forwarded like a query from their VLAN.
+// The instances renamed by instance_name are remembered in renames, to restore their names in queries.
+// When shutdown is closed, goodbyes are sent for the static services and it returns.
+func processBonjourPackets(trunks []*trunk, policies *policyStore, cache *mdnsCache, renames *instanceRenames, gatewayQueries <-chan gatewayQuery, shutdown <-chan struct{}) {
 	var dstMacAddress net.HardwareAddr
 
-	// Get a handle on the network interface
-	rawTraffic, err := pcap.OpenLive(netInterface, 65536, true, time.Second)
-	if err != nil {
-		logrus.Fatalf("Could not find network interface: %v", netInterface)
-	}
+	// Get a channel of Bonjour packets to process from a handle on every trunk
+	filterTemplate := "((dst net (224.0.0.251 or ff02::fb) and udp dst port 5353) or (ether dst %s and src port 5353))"
+	handles, bonjourPackets := captureTrunks(trunks, func(t *trunk) string {
+		return vlanFilter(t, fmt.Sprintf(filterTemplate, t.hardwareAddr))
+	})
 
-	filterTemplate := "not (ether src %s) and vlan and ((dst net (224.0.0.251 or ff02::fb) and udp dst port 5353) or (ether dst %s and src port 5353))"
-	err = rawTraffic.SetBPFFilter(fmt.Sprintf(filterTemplate, srcMACAddress, srcMACAddress))
-	if err != nil {
-		logrus.Fatalf("Could not apply filter on network interface: %v", err)
-	}
+	// Legacy unicast queriers, which get the replies of the devices to their own port
+	bonjourSessions := newSessionTable("mdns", maxSessions, mdnsSessionPorts)
+	// Queriers of QU questions, per question name
+	tmquSession := timedmap.New(time.Second)
+
+	// Hosts of the shared services per device, to forward the address records of later host lookups
+	knownHosts := make(map[macAddress]map[string]bool)
+
+	guard := newLoopGuard("mDNS")
+
+	// Addresses and host names of the devices, for validate_answers
+	validator := newAnswerValidator()
 
-	// Get a channel of Bonjour packets to process
-	decoder := gopacket.DecodersByLayerName["Ethernet"]
-	source := gopacket.NewPacketSource(rawTraffic, decoder)
-	bonjourPackets := parsePacketsLazily(source)
+	// Queries which wait to be merged when coalesce_window is set, and the timer of the first batch which is due
+	coalescer := newQueryCoalescer()
+	var coalesceTimer <-chan time.Time
 
-	tmbonjourSession := timedmap.New(time.Second)
+	// The static services are announced when they change, and again every staticAnnounceInterval
+	announcer := newStaticAnnouncer()
+	announceTicker := time.NewTicker(time.Second)
+	defer announceTicker.Stop()
+
+	for {
+		var bonjourPacket multicastPacket
+		select {
+		case packet, ok := <-bonjourPackets:
+			if !ok {
+				return
+			}
+			bonjourPacket = packet
+		case query := <-gatewayQueries:
+			msg := &dnsMessage{questions: []dnsQuestion{query.question}}
+			forwardCoalesced(handles, policies.Load(), guard, []coalescedQuery{{batchKey: batchKey{vlan: query.vlan}, msg: msg, queries: 1}})
+			continue
+		case now := <-announceTicker.C:
+			active := policies.Load()
+			announceStatic(handles, active, guard, announcer.due(active.staticRecords, now))
+			continue
+		case <-shutdown:
+			announceStatic(handles, policies.Load(), guard, announcer.goodbyes())
+			return
+		case now := <-coalesceTimer:
+			forwardCoalesced(handles, policies.Load(), guard, coalescer.due(now))
+			coalesceTimer = nil
+			if next, ok := coalescer.next(); ok {
+				coalesceTimer = time.After(time.Until(next))
+			}
+			continue
+		}
 
-	for bonjourPacket := range bonjourPackets {
 		logrus.Debugf("Bonjour packet received:\n%s", bonjourPacket.packet.String())
+		active := policies.Load()
+		poolsMap := active.poolsMap
 		if !bonjourPacket.isDNSQuery && !bonjourPacket.isDNSResponse {
 			logrus.Warningf("Received unexpected Bonjour packet: %s", bonjourPacket.packet.String())
 			continue
 		}
+		vlan, ok := active.vlanOf(bonjourPacket.netInterface, bonjourPacket.vlanTag)
+		if !ok {
+			logrus.Debugf("Ignored Bonjour packet on %s from a VLAN which is not configured on it", bonjourPacket.netInterface)
+			continue
+		}
+		bonjourPacket.vlanTag = &vlan
+		if !guard.allow(vlan, bonjourPacket.payload, active.rateLimit(vlan), time.Now()) {
+			continue
+		}
 
 		var srcIP net.IP
 
@@ -55,85 +98,385 @@ func processBonjourPackets(netInterface string, srcMACAddress net.HardwareAddr,
 		// Rewrite dstMAC to ensure that it is set to the appropriate multicast MAC address
 		if bonjourPacket.isIPv6 {
 			dstMacAddress = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0xFB}
-			srcIP = IPv6Address
 		} else {
 			dstMacAddress = net.HardwareAddr{0x01, 0x00, 0x5E, 0x00, 0x00, 0xFB}
 		}
 
 		// Forward the mDNS query or response to appropriate VLANs
 		if bonjourPacket.isDNSQuery {
+			restoreInstanceNames(renames, &bonjourPacket)
+			if len(active.staticRecords[vlan]) != 0 {
+				answerStatic(handles, active, guard, &bonjourPacket)
+			}
 			tags, ok := poolsMap[*bonjourPacket.vlanTag]
 			if !ok {
 				continue
 			}
+			if active.cfg.MDNSCache && answerFromCache(handles, active, cache, guard, knownHosts, &bonjourPacket) {
+				continue
+			}
+			if active.coalesceWindow > 0 {
+				if query, err := parseDNSMessage(bonjourPacket.payload); err == nil && coalescable(&bonjourPacket, query) {
+					key := batchKey{vlan: vlan, isIPv6: bonjourPacket.isIPv6}
+					forwardCoalesced(handles, active, guard, coalescer.add(key, query, active.coalesceWindow, time.Now()))
+					if coalesceTimer == nil {
+						coalesceTimer = time.After(active.coalesceWindow)
+					}
+					continue
+				}
+			}
 
-			bonjourSession := bonjourRequest{
-				ip:         *bonjourPacket.srcIP,
-				tag:        *bonjourPacket.vlanTag,
-				macAddress: *bonjourPacket.srcMAC,
+			bonjourSession := querier{
+				ip:           *bonjourPacket.srcIP,
+				tag:          *bonjourPacket.vlanTag,
+				macAddress:   *bonjourPacket.srcMAC,
+				port:         *bonjourPacket.srcPort,
+				allowedVlans: tags,
+			}
+			if *bonjourPacket.srcPort != 5353 {
+				bonjourPacket.setSrcPort(bonjourSessions.add(bonjourSession, dnsTransactionID(bonjourPacket.payload), bonjourDuration, time.Now()))
+			} else {
+				trackUnicastQuestions(tmquSession, &bonjourPacket, bonjourSession)
 			}
 
 			for _, tag := range tags {
-				if !bonjourPacket.isIPv6 {
-					srcIP, ok = vlanIPMap[tag]
-					if !ok {
-						srcIP = nil
-					}
-				}
-				if *bonjourPacket.srcPort != 5353 {
-					tmbonjourSession.Set(*bonjourPacket.srcPort, bonjourSession, bonjourDuration)
+				out, ok := handles.forVlan(active, tag)
+				if !ok {
+					continue
 				}
-				sendPacket(rawTraffic, &bonjourPacket, tag, srcMACAddress, dstMacAddress, srcIP, nil)
+				srcIP = out.sourceIP(active, tag, bonjourPacket.isIPv6)
+				sendPacket(out.handle, &bonjourPacket, active.wireTag(tag), out.hardwareAddr, dstMacAddress, srcIP, nil)
+				guard.sentTo(tag, bonjourPacket.udpPayload(), time.Now())
 			}
-		} else if bonjourPacket.isDNSResponse && *bonjourPacket.dstPort == 5353 {
-			device, ok := allowedMacsMap[macAddress(bonjourPacket.srcMAC.String())]
+		} else if bonjourPacket.isDNSResponse && *bonjourPacket.dstPort == 5353 && !bonjourPacket.dstIP.IsMulticast() {
+			// The unicast reply to a QU question, which was sent to the ip_source of the reflector
+			deviceKey, device, ok := matchResponder(active, validator, &bonjourPacket)
 			if !ok {
 				continue
 			}
-			if device.OriginPool != *bonjourPacket.vlanTag {
-				logrus.Warningf("spoofing/vlan leak detected from %s. Config expected traffic from VLAN %d, got a packet from VLAN %d.", bonjourPacket.srcMAC.String(), device.OriginPool, *bonjourPacket.vlanTag)
+			if active.cachesResponses() {
+				cacheResponse(cache, deviceKey, &bonjourPacket)
+			}
+			sessions := unicastQuestionSessions(tmquSession, &bonjourPacket)
+			if len(sessions) == 0 {
+				logrus.Infof("No matching QU question found for Bonjour response packet: %s", bonjourPacket.packet.String())
 				continue
 			}
+			for _, bonjourSession := range sessions {
+				relayUnicastResponse(handles, active, knownHosts, renames, deviceKey, device, &bonjourPacket, bonjourSession)
+			}
+		} else if bonjourPacket.isDNSResponse && *bonjourPacket.dstPort == 5353 {
+			deviceKey, device, ok := matchResponder(active, validator, &bonjourPacket)
+			if !ok {
+				continue
+			}
+			if active.cachesResponses() {
+				cacheResponse(cache, deviceKey, &bonjourPacket)
+			}
+			hosts := deviceHosts(knownHosts, deviceKey)
 
 			for _, tag := range device.SharedPools {
-				if !bonjourPacket.isIPv6 {
-					srcIP, ok = vlanIPMap[tag]
-					if !ok {
-						srcIP = nil
-					}
+				if !device.sharedAt(tag, time.Now()) {
+					continue
 				}
+				if !rewriteResponse(&bonjourPacket, device.servicesFor(tag), hosts, active.stripNetworks, active.privacyFor(device, tag), renames.recorder(tag)) {
+					continue
+				}
+				out, ok := handles.forVlan(active, tag)
+				if !ok {
+					continue
+				}
+				srcIP = out.sourceIP(active, tag, bonjourPacket.isIPv6)
 
-				sendPacket(rawTraffic, &bonjourPacket, tag, srcMACAddress, dstMacAddress, srcIP, nil)
+				sendPacket(out.handle, &bonjourPacket, active.wireTag(tag), out.hardwareAddr, dstMacAddress, srcIP, nil)
+				guard.sentTo(tag, bonjourPacket.udpPayload(), time.Now())
 			}
 		} else if bonjourPacket.isDNSResponse && *bonjourPacket.dstPort != 5353 {
-			device, ok := allowedMacsMap[macAddress(bonjourPacket.srcMAC.String())]
+			deviceKey, device, ok := matchResponder(active, validator, &bonjourPacket)
 			if !ok {
 				continue
 			}
-			if device.OriginPool != *bonjourPacket.vlanTag {
-				logrus.Warningf("spoofing/vlan leak detected from %s. Config expected traffic from VLAN %d, got a packet from VLAN %d.", bonjourPacket.srcMAC.String(), device.OriginPool, *bonjourPacket.vlanTag)
-				continue
+			if active.cachesResponses() {
+				cacheResponse(cache, deviceKey, &bonjourPacket)
 			}
-			if !tmbonjourSession.Contains(*bonjourPacket.dstPort) {
+			bonjourSession, ok := bonjourSessions.lookup(*bonjourPacket.dstPort, dnsTransactionID(bonjourPacket.payload), *bonjourPacket.vlanTag, bonjourDuration, time.Now())
+			if !ok {
 				logrus.Infof("No matching Bonjour query found for Bonjour response packet: %s", bonjourPacket.packet.String())
 				continue
 			}
+			relayUnicastResponse(handles, active, knownHosts, renames, deviceKey, device, &bonjourPacket, bonjourSession)
+		}
+	}
+}
+
+// matchResponder returns the device entry of the sender of an mDNS response, it returns false for unknown
+// devices, for devices which send from another VLAN than their origin_pool and for responses which fail
+// validate_answers.
+func matchResponder(active *policy, validator *answerValidator, packet *multicastPacket) (macAddress, multicastDevice, bool) {
+	deviceKey, device, ok := active.allowedDevices.match(packet)
+	if !ok {
+		return "", multicastDevice{}, false
+	}
+	if device.OriginPool != *packet.vlanTag {
+		logrus.Warningf("spoofing/vlan leak detected from %s. Config expected traffic from VLAN %d, got a packet from VLAN %d.", packet.srcMAC.String(), device.OriginPool, *packet.vlanTag)
+		return "", multicastDevice{}, false
+	}
+	if !validateResponse(active, validator, deviceKey, packet) {
+		return "", multicastDevice{}, false
+	}
+	return deviceKey, device, true
+}
 
-			tmbonjourSession.Refresh(*bonjourPacket.dstPort, bonjourDuration)
-			bonjourSession := tmbonjourSession.GetValue(*bonjourPacket.dstPort)
+// relayUnicastResponse sends the response of a device to the querier of the session, as a unicast packet.
+func relayUnicastResponse(handles trunkHandles, active *policy, knownHosts map[macAddress]map[string]bool, renames *instanceRenames, deviceKey macAddress, device multicastDevice, packet *multicastPacket, session querier) {
+	if !device.sharedAt(session.tag, time.Now()) {
+		logrus.Debugf("Dropped Bonjour response from %s, sharing with VLAN %d is not active", packet.srcMAC.String(), session.tag)
+		return
+	}
+	if !rewriteResponse(packet, device.servicesFor(session.tag), deviceHosts(knownHosts, deviceKey), active.stripNetworks, active.privacyFor(device, session.tag), renames.recorder(session.tag)) {
+		return
+	}
+	out, ok := handles.forVlan(active, session.tag)
+	if !ok {
+		return
+	}
+	srcIP := out.sourceIP(active, session.tag, packet.isIPv6)
 
-			tag := bonjourSession.(bonjourRequest).tag
-			dstIP := bonjourSession.(bonjourRequest).ip
-			dstMacAddress := bonjourSession.(bonjourRequest).macAddress
+	packet.setDstPort(session.port)
+	sendPacket(out.handle, packet, active.wireTag(session.tag), out.hardwareAddr, session.macAddress, srcIP, session.ip)
+}
 
-			if !bonjourPacket.isIPv6 {
-				srcIP, ok = vlanIPMap[tag]
-				if !ok {
-					srcIP = nil
-				}
+// trackUnicastQuestions stores the querier of the QU questions of a query (RFC 6762 section 5.4) per question name.
+// The device answers those to the ip_source of the reflector, which relays the answer to every querier of the name.
+func trackUnicastQuestions(tmquSession *timedmap.TimedMap, packet *multicastPacket, session querier) {
+	query, err := parseDNSMessage(packet.payload)
+	if err != nil {
+		return
+	}
+	for _, question := range query.questions {
+		if !question.unicastResponse() {
+			continue
+		}
+		name := cacheName(question.name)
+		var sessions []querier
+		if tmquSession.Contains(name) {
+			sessions = tmquSession.GetValue(name).([]querier)
+		}
+		if !slices.ContainsFunc(sessions, session.sameQuerier) {
+			sessions = append(slices.Clone(sessions), session)
+		}
+		tmquSession.Set(name, sessions, bonjourDuration)
+	}
+}
+
+// unicastQuestionSessions returns the queriers of the QU questions answered by a response.
+func unicastQuestionSessions(tmquSession *timedmap.TimedMap, packet *multicastPacket) []querier {
+	msg, err := parseDNSMessage(packet.payload)
+	if err != nil {
+		return nil
+	}
+	var found []querier
+	for _, rr := range msg.answers {
+		name := cacheName(rr.name)
+		if !tmquSession.Contains(name) {
+			continue
+		}
+		for _, session := range tmquSession.GetValue(name).([]querier) {
+			if !slices.ContainsFunc(found, session.sameQuerier) {
+				found = append(found, session)
+			}
+		}
+	}
+	return found
+}
+
+// forwardCoalesced forwards the merged queries to the VLANs the devices of their origin VLAN are shared from.
+func forwardCoalesced(handles trunkHandles, active *policy, guard *loopGuard, queries []coalescedQuery) {
+	for _, query := range queries {
+		dstMacAddress, dstIP := net.HardwareAddr{0x01, 0x00, 0x5E, 0x00, 0x00, 0xFB}, net.IPv4(224, 0, 0, 251)
+		if query.isIPv6 {
+			dstMacAddress, dstIP = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0xFB}, net.ParseIP("ff02::fb")
+		}
+		payload := query.msg.pack()
+		logrus.Debugf("Forwarding %d coalesced queries from VLAN %d", query.queries, query.vlan)
+
+		for _, tag := range active.poolsMap[query.vlan] {
+			out, ok := handles.forVlan(active, tag)
+			if !ok {
+				continue
+			}
+			srcIP := out.sourceIP(active, tag, query.isIPv6)
+			if srcIP == nil {
+				continue
+			}
+			err := sendUDP(out.handle, active.wireTag(tag), out.hardwareAddr, dstMacAddress, srcIP, dstIP, 5353, 5353, payload)
+			if err != nil {
+				logrus.Warningf("Could not send mDNS query to VLAN %d: %v", tag, err)
+				continue
+			}
+			guard.sentTo(tag, payload, time.Now())
+		}
+	}
+}
+
+// cacheResponse stores the records of an mDNS response of a device in the cache.
+func cacheResponse(cache *mdnsCache, device macAddress, packet *multicastPacket) {
+	msg, err := parseDNSMessage(packet.responsePayload())
+	if err != nil {
+		logrus.Debugf("Could not parse mDNS response from %s: %v", packet.srcMAC.String(), err)
+		return
+	}
+	cache.add(device, msg, time.Now())
+}
+
+// answerFromCache answers an mDNS query from the cached records of the devices shared with the VLAN of the querier.
+// It returns false when the query cannot be answered from the cache, so it should be forwarded.
+func answerFromCache(handles trunkHandles, active *policy, cache *mdnsCache, guard *loopGuard, knownHosts map[macAddress]map[string]bool, packet *multicastPacket) bool {
+	query, err := parseDNSMessage(packet.payload)
+	if err != nil || len(query.questions) == 0 {
+		return false
+	}
+	vlan := *packet.vlanTag
+	now := time.Now()
+	response, ok := cache.answer(query, now, sharedWith(active, knownHosts, vlan, now))
+	if !ok {
+		return false
+	}
+	if len(active.stripNetworks) != 0 {
+		response = stripAddresses(response, active.stripNetworks)
+	}
+	if len(response.answers) == 0 {
+		// The querier knows all answers already, or only stripped addresses are left
+		return true
+	}
+
+	logrus.Debugf("Answered mDNS query from %s on VLAN %d from the cache", packet.srcMAC.String(), vlan)
+	return sendAnswer(handles, active, guard, packet, query, response)
+}
+
+// answerStatic answers an mDNS query with the records of the static services shared with the VLAN of the querier.
+// The query is forwarded as well, devices on other VLANs may offer the same service.
+func answerStatic(handles trunkHandles, active *policy, guard *loopGuard, packet *multicastPacket) {
+	query, err := parseDNSMessage(packet.payload)
+	if err != nil {
+		return
+	}
+	response := staticAnswer(active.staticRecords[*packet.vlanTag], query)
+	if response == nil {
+		return
+	}
+	logrus.Debugf("Answered mDNS query from %s on VLAN %d with static services", packet.srcMAC.String(), *packet.vlanTag)
+	sendAnswer(handles, active, guard, packet, query, response)
+}
+
+// sendAnswer sends the response to an mDNS query on the VLAN of the querier: to the port of a legacy unicast
+// querier, to the querier when all questions ask for a unicast response, and else as multicast.
+// It returns false when the VLAN has no source address to send from.
+func sendAnswer(handles trunkHandles, active *policy, guard *loopGuard, packet *multicastPacket, query *dnsMessage, response *dnsMessage) bool {
+	vlan := *packet.vlanTag
+	out, ok := handles.forVlan(active, vlan)
+	if !ok {
+		return false
+	}
+	srcIP := out.sourceIP(active, vlan, packet.isIPv6)
+	if srcIP == nil {
+		return false
+	}
+
+	dstMacAddress, dstIP, dstPort := *packet.srcMAC, *packet.srcIP, *packet.srcPort
+	if dstPort != 5353 {
+		// A legacy unicast query, answered like a unicast DNS server would (RFC 6762 section 6.7)
+		response.id = query.id
+		response.questions = query.questions
+		for _, section := range [][]dnsRecord{response.answers, response.additionals} {
+			for i := range section {
+				section[i].ttl = min(section[i].ttl, 10)
+				section[i].class &^= dnsClassCacheFlush
 			}
+		}
+	} else if !unicastResponse(query) {
+		if packet.isIPv6 {
+			dstMacAddress, dstIP = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0xFB}, net.ParseIP("ff02::fb")
+		} else {
+			dstMacAddress, dstIP = net.HardwareAddr{0x01, 0x00, 0x5E, 0x00, 0x00, 0xFB}, net.IPv4(224, 0, 0, 251)
+		}
+	}
+
+	payload := response.pack()
+	err := sendUDP(out.handle, active.wireTag(vlan), out.hardwareAddr, dstMacAddress, srcIP, dstIP, 5353, dstPort, payload)
+	if err != nil {
+		logrus.Warningf("Could not send mDNS response to VLAN %d: %v", vlan, err)
+	}
+	if dstIP.IsMulticast() {
+		guard.sentTo(vlan, payload, time.Now())
+	}
+	return true
+}
+
+// restoreInstanceNames replaces the instance names renamed by instance_name in a query by the names the devices
+// know. The restored query is the payload for the rest of the processing, and is sent instead of the original.
+func restoreInstanceNames(renames *instanceRenames, packet *multicastPacket) {
+	query, err := parseDNSMessage(packet.payload)
+	if err != nil {
+		return
+	}
+	if restored, ok := renames.restore(*packet.vlanTag, query); ok {
+		packet.payload = restored.pack()
+		packet.rewrittenPayload = packet.payload
+	}
+}
 
-			sendPacket(rawTraffic, &bonjourPacket, tag, srcMACAddress, dstMacAddress, srcIP, dstIP)
+// unicastResponse reports whether all questions of the query ask for a unicast response (the QU bit).
+func unicastResponse(query *dnsMessage) bool {
+	for _, question := range query.questions {
+		if !question.unicastResponse() {
+			return false
 		}
 	}
+	return true
+}
+
+// rewriteResponse rewrites the payload of an mDNS response to the records of the shared DNS-SD service types,
+// without the address records in 'strip' and with the privacy rules applied. 'renamed' is called with the
+// instances renamed by the rules. It returns false when none of the answers are left, so the packet should be dropped.
+func rewriteResponse(packet *multicastPacket, services []string, knownHosts map[string]bool, strip []*net.IPNet, privacy privacyRules, renamed func(original, name string)) bool {
+	packet.rewrittenPayload = packet.validPayload
+	if len(services) == 0 && len(strip) == 0 && privacy.isEmpty() {
+		return true
+	}
+
+	msg, err := parseDNSMessage(packet.responsePayload())
+	if err != nil {
+		logrus.Debugf("Could not parse mDNS response from %s: %v", packet.srcMAC.String(), err)
+		return len(services) == 0
+	}
+	filtered := msg
+	if len(services) != 0 {
+		filtered = filterServices(filtered, services, knownHosts)
+		if len(filtered.answers) == 0 {
+			logrus.Debugf("Dropped mDNS response from %s, no answers for the shared services %v", packet.srcMAC.String(), services)
+			return false
+		}
+	}
+	if len(strip) != 0 {
+		filtered = stripAddresses(filtered, strip)
+		if len(filtered.answers) == 0 {
+			logrus.Debugf("Dropped mDNS response from %s, only stripped addresses in the answers", packet.srcMAC.String())
+			return false
+		}
+	}
+	filtered = applyPrivacy(filtered, privacy, renamed)
+	if len(filtered.answers) != len(msg.answers) || len(filtered.authorities) != len(msg.authorities) || len(filtered.additionals) != len(msg.additionals) || !privacy.isEmpty() {
+		packet.rewrittenPayload = filtered.pack()
+	}
+	return true
+}
+
+func deviceHosts(knownHosts map[macAddress]map[string]bool, mac macAddress) map[string]bool {
+	hosts, ok := knownHosts[mac]
+	if !ok {
+		hosts = make(map[string]bool)
+		knownHosts[mac] = hosts
+	}
+	return hosts
 }
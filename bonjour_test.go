@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zekroTJA/timedmap"
+)
+
+func TestUnicastQuestionSessions(t *testing.T) {
+	tmquSession := timedmap.New(time.Second)
+	query := func(qclass uint16) *multicastPacket {
+		msg := &dnsMessage{questions: []dnsQuestion{{name: "_googlecast._tcp.local", qtype: dnsTypePTR, qclass: qclass}}}
+		return &multicastPacket{payload: msg.pack()}
+	}
+	laptop := querier{ip: net.IP{192, 168, 101, 10}, tag: 101}
+	phone := querier{ip: net.IP{192, 168, 103, 10}, tag: 103}
+
+	trackUnicastQuestions(tmquSession, query(dnsClassIN|dnsClassUnicastResp), laptop)
+	trackUnicastQuestions(tmquSession, query(dnsClassIN|dnsClassUnicastResp), laptop)
+	trackUnicastQuestions(tmquSession, query(dnsClassIN|dnsClassUnicastResp), phone)
+	// QM questions are answered by multicast, they do not need a session
+	trackUnicastQuestions(tmquSession, query(dnsClassIN), querier{ip: net.IP{192, 168, 104, 10}, tag: 104})
+
+	response := &multicastPacket{payload: createMockServiceResponse().pack()}
+	sessions := unicastQuestionSessions(tmquSession, response)
+	if len(sessions) != 2 || !sessions[0].sameQuerier(laptop) || !sessions[1].sameQuerier(phone) {
+		t.Errorf("Error in unicastQuestionSessions(): expected the laptop and the phone, got %+v", sessions)
+	}
+
+	other := &dnsMessage{flags: dnsFlagResponse, answers: []dnsRecord{{name: "_airplay._tcp.local", rtype: dnsTypePTR, class: dnsClassIN, ttl: 4500, rdata: appendDNSName(nil, "TV._airplay._tcp.local", nil, 0)}}}
+	if sessions := unicastQuestionSessions(tmquSession, &multicastPacket{payload: other.pack()}); len(sessions) != 0 {
+		t.Errorf("Error in unicastQuestionSessions(): expected no queriers for a name which was not asked, got %+v", sessions)
+	}
+}
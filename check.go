@@ -0,0 +1,567 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// configProblem is a semantic error found in a config file.
+type configProblem struct {
+	file     string
+	position toml.Position
+	message  string
+}
+
+func (problem configProblem) String() string {
+	if problem.position.Invalid() {
+		return fmt.Sprintf("%s: %s", problem.file, problem.message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", problem.file, problem.position.Line, problem.position.Col, problem.message)
+}
+
+// runCheck validates the config file and the files it includes, and prints every problem found.
+// It returns the exit code for the check command.
+func runCheck(path string) int {
+	files, err := loadConfigFiles(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	problems := checkConfigFiles(files)
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, problem)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d problem(s) found\n", path, len(problems))
+		return 1
+	}
+
+	cfg, err := readConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+	fmt.Printf("%s: OK, %d file(s), %d device(s) and %d vlan(s) configured\n", path, len(files), len(cfg.Devices), len(cfg.VlanIPSource))
+	printExpandedConfig(cfg)
+	return 0
+}
+
+// printExpandedConfig prints the devices and VLANs after aliases and groups are expanded.
+func printExpandedConfig(cfg config) {
+	vlanIPMap := mapIpSourceByVlan(cfg.VlanIPSource)
+	vlanIP6Map := mapIp6SourceByVlan(cfg.VlanIPSource)
+	interfaceMap := mapInterfaceByVlan(cfg)
+	for _, vlan := range sortedVlans(vlanIPMap, nil) {
+		fmt.Printf("vlan %d: ip_source %s, interface %s\n", vlan, vlanIPMap[vlan], interfaceMap[vlan])
+		if ip6 := vlanIP6Map[vlan]; ip6 != nil {
+			fmt.Printf("vlan %d: ip6_source %s\n", vlan, ip6)
+		}
+	}
+	for _, mac := range sortedMacs(cfg.Devices, nil) {
+		device := cfg.Devices[mac]
+		fmt.Printf("device %s (%s): origin_pool %d, shared_pools %v\n", mac, device.Description, device.OriginPool, device.SharedPools)
+	}
+}
+
+// checkConfig reports every semantic problem in the content of a single config file, ordered by their position.
+func checkConfig(file string, content []byte) []configProblem {
+	tree, err := toml.LoadBytes(content)
+	if err != nil {
+		return []configProblem{{file: file, message: err.Error()}}
+	}
+	return checkConfigFiles(configFiles{{path: file, tree: tree}})
+}
+
+// checkConfigFiles reports every semantic problem in the config files, ordered by file and position.
+func checkConfigFiles(files configFiles) []configProblem {
+	var problems []configProblem
+	for _, file := range files {
+		problems = append(problems, checkUnknownKeys(file.path, file.tree, reflect.TypeOf(config{}), nil)...)
+		problems = append(problems, checkAliases(file.path, file.tree)...)
+	}
+
+	cfg, mergeProblems, ok := mergeConfigFiles(files)
+	problems = append(problems, mergeProblems...)
+	if ok {
+		if cfg.NetInterface == "" && len(cfg.Interfaces) == 0 {
+			problems = append(problems, configProblem{file: files[0].path, message: "net_interface is not set"})
+		} else if cfg.NetInterface != "" && len(cfg.Interfaces) != 0 {
+			problems = append(problems, files.problemAt([]string{"net_interface"}, fmt.Sprintf("net_interface %s cannot be combined with interfaces, list its VLANs in interfaces", cfg.NetInterface)))
+		}
+		if cfg.NativeVlan != 0 && !isValidVlan(int(cfg.NativeVlan)) {
+			problems = append(problems, files.problemAt([]string{"native_vlan"}, fmt.Sprintf("native_vlan %d is not a VLAN ID between 1 and 4094", cfg.NativeVlan)))
+		}
+		if cfg.MaxPacketsPerSecond < 0 {
+			problems = append(problems, files.problemAt([]string{"max_packets_per_second"}, fmt.Sprintf("max_packets_per_second %d is negative", cfg.MaxPacketsPerSecond)))
+		}
+		if _, err := parseCoalesceWindow(cfg.CoalesceWindow); err != nil {
+			problems = append(problems, files.problemAt([]string{"coalesce_window"}, fmt.Sprintf("coalesce_window %s is invalid: %v", cfg.CoalesceWindow, err)))
+		}
+		if cfg.ValidateAnswers != "" && cfg.ValidateAnswers != "strip" && cfg.ValidateAnswers != "reject" {
+			problems = append(problems, files.problemAt([]string{"validate_answers"}, fmt.Sprintf("validate_answers %s is not strip or reject", cfg.ValidateAnswers)))
+		}
+		for _, address := range cfg.StripAddresses {
+			if _, _, err := net.ParseCIDR(address); err != nil {
+				problems = append(problems, files.problemAt([]string{"strip_addresses"}, fmt.Sprintf("strip_addresses entry %s is not a network like fe80::/10", address)))
+			}
+		}
+		problems = append(problems, checkDNSGateway(files, cfg)...)
+		problems = append(problems, checkInterfaces(files, cfg)...)
+		problems = append(problems, checkVlans(files, cfg)...)
+		problems = append(problems, checkDevices(files, cfg)...)
+		problems = append(problems, checkStaticServices(files, cfg)...)
+	}
+
+	order := make(map[string]int)
+	for i, file := range files {
+		order[file.path] = i
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].file != problems[j].file {
+			return order[problems[i].file] < order[problems[j].file]
+		}
+		if problems[i].position.Line != problems[j].position.Line {
+			return problems[i].position.Line < problems[j].position.Line
+		}
+		return problems[i].position.Col < problems[j].position.Col
+	})
+	return problems
+}
+
+func checkAliases(file string, tree *toml.Tree) (problems []configProblem) {
+	aliasTree, ok := tree.Get("aliases").(*toml.Tree)
+	if !ok {
+		return nil
+	}
+	for _, alias := range sortedKeys(aliasTree) {
+		position := aliasTree.GetPosition(alias)
+		if _, err := strconv.Atoi(alias); err == nil {
+			problems = append(problems, configProblem{file: file, position: position, message: fmt.Sprintf("VLAN alias %s is a number", alias)})
+		}
+		if id, ok := aliasTree.Get(alias).(int64); !ok || !isValidVlan(int(id)) {
+			problems = append(problems, configProblem{file: file, position: position, message: fmt.Sprintf("VLAN alias %s is not a VLAN ID between 1 and 4094", alias)})
+		}
+	}
+	return problems
+}
+
+// checkUnknownKeys compares the keys in the tree with the toml tags of the config structs.
+func checkUnknownKeys(file string, tree *toml.Tree, typ reflect.Type, path []string) (problems []configProblem) {
+	for _, key := range sortedKeys(tree) {
+		keyPath := append(append([]string{}, path...), key)
+
+		var valueType reflect.Type
+		switch typ.Kind() {
+		case reflect.Map:
+			valueType = typ.Elem()
+		case reflect.Struct:
+			valueType = tomlFieldType(typ, key)
+		}
+		if valueType == nil {
+			problems = append(problems, configProblem{file: file, position: tree.GetPositionPath([]string{key}), message: fmt.Sprintf("unknown key %s", strings.Join(keyPath, "."))})
+			continue
+		}
+
+		switch value := tree.Get(key).(type) {
+		case *toml.Tree:
+			problems = append(problems, checkUnknownKeys(file, value, valueType, keyPath)...)
+		case []*toml.Tree:
+			for _, subtree := range value {
+				problems = append(problems, checkUnknownKeys(file, subtree, valueType.Elem(), keyPath)...)
+			}
+		}
+	}
+	return problems
+}
+
+func tomlFieldType(typ reflect.Type, key string) reflect.Type {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+		if name == key {
+			return field.Type
+		}
+	}
+	return nil
+}
+
+func sortedKeys(tree *toml.Tree) []string {
+	keys := tree.Keys()
+	sort.Strings(keys)
+	return keys
+}
+
+func checkDNSGateway(files configFiles, cfg config) (problems []configProblem) {
+	gateway := cfg.DNSGateway
+	if gateway.Listen == "" && len(gateway.Pools) == 0 {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(gateway.Listen); err != nil {
+		problems = append(problems, files.problemAt([]string{"dns_gateway", "listen"}, fmt.Sprintf("listen %q of dns_gateway is not an address like 0.0.0.0:53", gateway.Listen)))
+	}
+	if domain := gateway.gatewayDomain(); len(splitDNSName(domain)) == 0 || domain == "local" || strings.HasSuffix(domain, ".local") {
+		problems = append(problems, files.problemAt([]string{"dns_gateway", "domain"}, fmt.Sprintf("domain %s of dns_gateway is not a unicast DNS domain like home.arpa", gateway.Domain)))
+	}
+	for _, vlan := range sortedVlanIDs(gateway.Pools) {
+		path := []string{"dns_gateway", "pools", string(vlan)}
+		if id, err := strconv.Atoi(string(vlan)); err != nil || !isValidVlan(id) {
+			problems = append(problems, files.problemAt(path, fmt.Sprintf("dns_gateway pool %s is not a VLAN ID between 1 and 4094", vlan)))
+		}
+		for _, subnet := range gateway.Pools[vlan] {
+			if _, _, err := net.ParseCIDR(subnet); err != nil {
+				problems = append(problems, files.problemAt(path, fmt.Sprintf("subnet %s of dns_gateway pool %s is not a network like 10.8.0.0/24", subnet, vlan)))
+			}
+		}
+	}
+	return problems
+}
+
+// checkInterfaces reports the invalid entries of interfaces, and the VLANs which are not on any of them.
+func checkInterfaces(files configFiles, cfg config) (problems []configProblem) {
+	if len(cfg.Interfaces) == 0 {
+		return nil
+	}
+	// Files which repeat interfaces have the same entries, the problems are reported in the first one
+	var file configFile
+	var tables []*toml.Tree
+	for _, file = range files {
+		if tables, _ = file.tree.Get("interfaces").([]*toml.Tree); tables != nil {
+			break
+		}
+	}
+	at := func(i int, key string, message string) configProblem {
+		if i >= len(tables) {
+			return files.problemAt([]string{"interfaces"}, message)
+		}
+		if tables[i].Has(key) {
+			return configProblem{file: file.path, position: tables[i].GetPosition(key), message: message}
+		}
+		return configProblem{file: file.path, position: tables[i].Position(), message: message}
+	}
+
+	interfaceOf := make(map[uint16]string)
+	var names []string
+	for i, trunk := range cfg.Interfaces {
+		switch {
+		case trunk.Name == "":
+			problems = append(problems, at(i, "name", "an entry of interfaces has no name"))
+		case len(trunk.Name) > 15:
+			problems = append(problems, at(i, "name", fmt.Sprintf("interface %s is longer than 15 characters", trunk.Name)))
+		case slices.Contains(names, trunk.Name):
+			problems = append(problems, at(i, "name", fmt.Sprintf("interface %s is listed more than once", trunk.Name)))
+		}
+		names = append(names, trunk.Name)
+		for _, vlan := range trunk.Vlans {
+			if !isValidVlan(int(vlan)) {
+				problems = append(problems, at(i, "vlans", fmt.Sprintf("vlan %d of interface %s is not a VLAN ID between 1 and 4094", vlan, trunk.Name)))
+			} else if other, ok := interfaceOf[vlan]; ok {
+				problems = append(problems, at(i, "vlans", fmt.Sprintf("vlan %d is on interface %s and on %s", vlan, other, trunk.Name)))
+			} else {
+				interfaceOf[vlan] = trunk.Name
+			}
+		}
+	}
+
+	// Packets of a VLAN which is not on one of the interfaces are dropped
+	unassigned := func(vlanPath []string, vlan uint16, what string) {
+		if _, ok := interfaceOf[vlan]; !ok && isValidVlan(int(vlan)) {
+			problems = append(problems, files.problemAt(vlanPath, fmt.Sprintf("%s is not on any of the interfaces", what)))
+		}
+	}
+	if cfg.NativeVlan != 0 {
+		unassigned([]string{"native_vlan"}, cfg.NativeVlan, fmt.Sprintf("native_vlan %d", cfg.NativeVlan))
+	}
+	for _, vlan := range sortedVlanIDs(cfg.VlanIPSource) {
+		if id, err := strconv.Atoi(string(vlan)); err == nil {
+			unassigned([]string{"vlan", string(vlan)}, uint16(id), "vlan "+string(vlan))
+		}
+	}
+	for _, mac := range sortedMacs(cfg.Devices, nil) {
+		device := cfg.Devices[mac]
+		unassigned([]string{"devices", string(mac), "origin_pool"}, device.OriginPool, fmt.Sprintf("origin_pool %d of device %s", device.OriginPool, mac))
+		// Shared pools of a group are reported at the device
+		sharedPoolsPath := []string{"devices", string(mac), "shared_pools"}
+		if !files.hasPath(sharedPoolsPath) {
+			sharedPoolsPath = sharedPoolsPath[:2]
+		}
+		for _, pool := range device.SharedPools {
+			unassigned(sharedPoolsPath, pool, fmt.Sprintf("shared pool %d of device %s", pool, mac))
+		}
+	}
+	return problems
+}
+
+func checkVlans(files configFiles, cfg config) (problems []configProblem) {
+	for _, vlan := range sortedVlanIDs(cfg.VlanIPSource) {
+		vlanPath := []string{"vlan", string(vlan)}
+		id, err := strconv.Atoi(string(vlan))
+		if err != nil || !isValidVlan(id) {
+			problems = append(problems, files.problemAt(vlanPath, fmt.Sprintf("vlan %s is not a VLAN ID between 1 and 4094", vlan)))
+			continue
+		}
+		ip := cfg.VlanIPSource[vlan].IpSource
+		if ip == nil {
+			problems = append(problems, files.problemAt(vlanPath, fmt.Sprintf("vlan %s has no ip_source", vlan)))
+		} else if ip.To4() == nil {
+			problems = append(problems, files.problemAt([]string{"vlan", string(vlan), "ip_source"}, fmt.Sprintf("ip_source %s of vlan %s is not an IPv4 address", ip, vlan)))
+		}
+		if ip6 := cfg.VlanIPSource[vlan].Ip6Source; ip6 != nil && (ip6.To4() != nil || ip6.IsLinkLocalUnicast() || !ip6.IsGlobalUnicast()) {
+			problems = append(problems, files.problemAt([]string{"vlan", string(vlan), "ip6_source"}, fmt.Sprintf("ip6_source %s of vlan %s is not a global or unique local IPv6 address", ip6, vlan)))
+		}
+		if limit := cfg.VlanIPSource[vlan].MaxPacketsPerSecond; limit < 0 {
+			problems = append(problems, files.problemAt([]string{"vlan", string(vlan), "max_packets_per_second"}, fmt.Sprintf("max_packets_per_second %d of vlan %s is negative", limit, vlan)))
+		}
+		if target := cfg.VlanIPSource[vlan].SSDPUnicastTarget; target != "" {
+			targetPath := []string{"vlan", string(vlan), "ssdp_unicast_target"}
+			if device, ok := mapLowerCaseMac(cfg.Devices)[macAddress(strings.ToLower(string(target)))]; !ok {
+				problems = append(problems, files.problemAt(targetPath, fmt.Sprintf("ssdp_unicast_target %s of vlan %s is not a device", target, vlan)))
+			} else if !slices.Contains(device.SharedPools, uint16(id)) {
+				problems = append(problems, files.problemAt(targetPath, fmt.Sprintf("ssdp_unicast_target %s of vlan %s is not shared with vlan %s", target, vlan, vlan)))
+			}
+		}
+		problems = append(problems, checkPrivacy(files, []string{"vlan", string(vlan), "privacy"}, cfg.VlanIPSource[vlan].Privacy, "vlan "+string(vlan))...)
+	}
+	return problems
+}
+
+func checkDevices(files configFiles, cfg config) (problems []configProblem) {
+	vlanIPMap := mapIpSourceByVlan(cfg.VlanIPSource)
+	// The exact MAC addresses of the device keys, and of the macs lists
+	keyOwners := make(map[string]macAddress)
+	for _, mac := range sortedMacs(cfg.Devices, nil) {
+		if pattern, err := parseMacPattern(string(mac)); err == nil && pattern.isExact() {
+			if _, ok := keyOwners[pattern.value.String()]; !ok {
+				keyOwners[pattern.value.String()] = mac
+			}
+		}
+	}
+	macOwners := make(map[string]macAddress)
+	hostnameOwners := make(map[string]macAddress)
+
+	for _, mac := range sortedMacs(cfg.Devices, nil) {
+		device := cfg.Devices[mac]
+		devicePath := []string{"devices", string(mac)}
+
+		keyPattern, err := parseMacPattern(string(mac))
+		if err != nil && len(device.Macs) == 0 && len(device.Addresses) == 0 && len(device.Hostnames) == 0 {
+			problems = append(problems, files.problemAt(devicePath, fmt.Sprintf("device %s is not a MAC address in the form aa:bb:cc:dd:ee:ff, and has no macs, addresses or hostnames to match on", mac)))
+		}
+		if err == nil && keyPattern.isExact() {
+			if other := keyOwners[keyPattern.value.String()]; other != mac {
+				problems = append(problems, files.problemAt(devicePath, fmt.Sprintf("device %s is a duplicate of device %s", mac, other)))
+			}
+		}
+		for _, deviceMac := range device.Macs {
+			macsPath := append(devicePath, "macs")
+			pattern, err := parseMacPattern(deviceMac)
+			if err != nil {
+				problems = append(problems, files.problemAt(macsPath, fmt.Sprintf("mac %s of device %s is invalid: %v", deviceMac, mac, err)))
+				continue
+			}
+			if !pattern.isExact() {
+				continue
+			}
+			other, ok := keyOwners[pattern.value.String()]
+			if !ok {
+				other, ok = macOwners[pattern.value.String()]
+			}
+			if ok && other != mac {
+				problems = append(problems, files.problemAt(macsPath, fmt.Sprintf("mac %s of device %s is also used by device %s", deviceMac, mac, other)))
+			}
+			macOwners[pattern.value.String()] = mac
+		}
+		for _, address := range device.Addresses {
+			if _, err := parseAddress(address); err != nil {
+				problems = append(problems, files.problemAt(append(devicePath, "addresses"), fmt.Sprintf("address %s of device %s is invalid: %v", address, mac, err)))
+			}
+		}
+		for _, hostname := range device.Hostnames {
+			name := normalizeHostname(hostname)
+			if other, ok := hostnameOwners[name]; ok && other != mac {
+				problems = append(problems, files.problemAt(append(devicePath, "hostnames"), fmt.Sprintf("hostname %s of device %s is also used by device %s", hostname, mac, other)))
+				continue
+			}
+			hostnameOwners[name] = mac
+		}
+
+		if !files.hasPath(append(devicePath, "origin_pool")) {
+			problems = append(problems, files.problemAt(devicePath, fmt.Sprintf("device %s has no origin_pool", mac)))
+		} else if !isValidVlan(int(device.OriginPool)) {
+			problems = append(problems, files.problemAt(append(devicePath, "origin_pool"), fmt.Sprintf("origin_pool %d of device %s is not a VLAN ID between 1 and 4094", device.OriginPool, mac)))
+		}
+
+		for _, service := range device.Services {
+			if !isServiceType(service) {
+				problems = append(problems, files.problemAt(append(devicePath, "services"), fmt.Sprintf("service %s of device %s is not a DNS-SD service type like _airplay._tcp", service, mac)))
+			}
+		}
+		for _, ssdpType := range device.SSDPTypes {
+			if !isSSDPType(ssdpType) {
+				problems = append(problems, files.problemAt(append(devicePath, "ssdp_types"), fmt.Sprintf("ssdp type %s of device %s is not a notification type like urn:dial-multiscreen-org:service:dial:1", ssdpType, mac)))
+			}
+		}
+		problems = append(problems, checkSharingRule(files, devicePath, device.Schedule, device.Expires, mac)...)
+		problems = append(problems, checkPrivacy(files, append(append([]string{}, devicePath...), "privacy"), device.Privacy, "device "+string(mac))...)
+		for _, pool := range sortedVlanIDs(device.Pools) {
+			poolPath := append(append([]string{}, devicePath...), "pool", string(pool))
+			id, err := strconv.Atoi(string(pool))
+			if err != nil || !slices.Contains(device.SharedPools, uint16(id)) {
+				problems = append(problems, files.problemAt(poolPath, fmt.Sprintf("pool %s of device %s is not one of its shared_pools", pool, mac)))
+			}
+			for _, service := range device.Pools[pool].Services {
+				if !isServiceType(service) {
+					problems = append(problems, files.problemAt(append(poolPath, "services"), fmt.Sprintf("service %s of device %s is not a DNS-SD service type like _airplay._tcp", service, mac)))
+				}
+			}
+			for _, ssdpType := range device.Pools[pool].SSDPTypes {
+				if !isSSDPType(ssdpType) {
+					problems = append(problems, files.problemAt(append(poolPath, "ssdp_types"), fmt.Sprintf("ssdp type %s of device %s is not a notification type like urn:dial-multiscreen-org:service:dial:1", ssdpType, mac)))
+				}
+			}
+			problems = append(problems, checkSharingRule(files, poolPath, device.Pools[pool].Schedule, device.Pools[pool].Expires, mac)...)
+			problems = append(problems, checkPrivacy(files, append(poolPath, "privacy"), device.Pools[pool].Privacy, "device "+string(mac))...)
+		}
+
+		sharedPoolsPath := append(devicePath, "shared_pools")
+		if len(device.SharedPools) == 0 {
+			problems = append(problems, files.problemAt(devicePath, fmt.Sprintf("device %s has no shared_pools", mac)))
+		}
+		for _, pool := range device.SharedPools {
+			switch {
+			case !isValidVlan(int(pool)):
+				problems = append(problems, files.problemAt(sharedPoolsPath, fmt.Sprintf("shared pool %d of device %s is not a VLAN ID between 1 and 4094", pool, mac)))
+			case pool == device.OriginPool:
+				problems = append(problems, files.problemAt(sharedPoolsPath, fmt.Sprintf("device %s lists its origin_pool %d in its shared_pools", mac, pool)))
+			case vlanIPMap[pool] == nil:
+				problems = append(problems, files.problemAt(sharedPoolsPath, fmt.Sprintf("shared pool %d of device %s has no [vlan.%d] ip_source, packets would keep the source IP of the other VLAN", pool, mac, pool)))
+			}
+		}
+	}
+	return problems
+}
+
+// checkStaticServices checks the [[static_services]] tables of every file, their VLAN aliases are resolved already.
+func checkStaticServices(files configFiles, cfg config) (problems []configProblem) {
+	vlanIPMap := mapIpSourceByVlan(cfg.VlanIPSource)
+	for _, file := range files {
+		tables, _ := file.tree.Get("static_services").([]*toml.Tree)
+		for _, table := range tables {
+			at := func(key string, message string) configProblem {
+				if table.Has(key) {
+					return configProblem{file: file.path, position: table.GetPosition(key), message: message}
+				}
+				return configProblem{file: file.path, position: table.Position(), message: message}
+			}
+			var service staticService
+			if err := table.Unmarshal(&service); err != nil {
+				problems = append(problems, configProblem{file: file.path, position: table.Position(), message: err.Error()})
+				continue
+			}
+
+			if service.Name == "" || len(service.Name) > 63 {
+				problems = append(problems, at("name", fmt.Sprintf("name %q of static service is not an instance name of 1 to 63 bytes", service.Name)))
+			}
+			if !isServiceType(service.Type) {
+				problems = append(problems, at("type", fmt.Sprintf("type %s of static service %s is not a DNS-SD service type like _ipp._tcp", service.Type, service.Name)))
+			}
+			if service.Host == "" {
+				problems = append(problems, at("host", fmt.Sprintf("static service %s has no host", service.Name)))
+			}
+			if service.Port == 0 {
+				problems = append(problems, at("port", fmt.Sprintf("static service %s has no port", service.Name)))
+			}
+			for _, entry := range service.TXT {
+				if len(entry) > 255 {
+					problems = append(problems, at("txt", fmt.Sprintf("txt entry of static service %s is longer than 255 bytes", service.Name)))
+				}
+			}
+			if len(service.Addresses) == 0 {
+				problems = append(problems, at("addresses", fmt.Sprintf("static service %s has no addresses", service.Name)))
+			}
+			for _, address := range service.Addresses {
+				if net.ParseIP(address) == nil {
+					problems = append(problems, at("addresses", fmt.Sprintf("address %s of static service %s is not an IP address", address, service.Name)))
+				}
+			}
+			if len(service.SharedPools) == 0 {
+				problems = append(problems, at("shared_pools", fmt.Sprintf("static service %s has no shared_pools", service.Name)))
+			}
+			for _, pool := range service.SharedPools {
+				switch {
+				case !isValidVlan(int(pool)):
+					problems = append(problems, at("shared_pools", fmt.Sprintf("shared pool %d of static service %s is not a VLAN ID between 1 and 4094", pool, service.Name)))
+				case vlanIPMap[pool] == nil:
+					problems = append(problems, at("shared_pools", fmt.Sprintf("shared pool %d of static service %s has no [vlan.%d] ip_source to announce it from", pool, service.Name, pool)))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// checkPrivacy checks the privacy rules of a device, a pool of a device or a vlan, named by 'owner'.
+func checkPrivacy(files configFiles, path []string, rules privacyRules, owner string) (problems []configProblem) {
+	if name := rules.InstanceName; name != "" && (len(name) > 63 || strings.HasPrefix(name, "_")) {
+		problems = append(problems, files.problemAt(append(path, "instance_name"), fmt.Sprintf("instance_name %s of %s is not a DNS label of at most 63 bytes without a leading _", name, owner)))
+	}
+	txtKeys := []struct {
+		key   string
+		names []string
+	}{{"txt_drop", rules.TXTDrop}, {"txt_replace", slices.Sorted(maps.Keys(rules.TXTReplace))}}
+	for _, keys := range txtKeys {
+		for _, name := range keys.names {
+			if name == "" || strings.Contains(name, "=") {
+				problems = append(problems, files.problemAt(append(path, keys.key), fmt.Sprintf("TXT key %q of %s is empty or contains =", name, owner)))
+			}
+		}
+	}
+	headers := []struct {
+		key   string
+		names []string
+	}{{"ssdp_drop", rules.SSDPDrop}, {"ssdp_replace", slices.Sorted(maps.Keys(rules.SSDPReplace))}}
+	for _, keys := range headers {
+		for _, name := range keys.names {
+			if name == "" || strings.ContainsAny(name, ": \t") {
+				problems = append(problems, files.problemAt(append(path, keys.key), fmt.Sprintf("SSDP header %q of %s is empty or contains a colon or space", name, owner)))
+			}
+		}
+	}
+	return problems
+}
+
+func checkSharingRule(files configFiles, path []string, schedule string, expires string, mac macAddress) (problems []configProblem) {
+	if schedule != "" {
+		if _, err := parseSchedule(schedule); err != nil {
+			problems = append(problems, files.problemAt(append(path, "schedule"), fmt.Sprintf("schedule %s of device %s is invalid: %v", schedule, mac, err)))
+		}
+	}
+	if expires != "" {
+		if _, err := parseExpires(expires); err != nil {
+			problems = append(problems, files.problemAt(append(path, "expires"), fmt.Sprintf("expires %s of device %s is invalid: %v", expires, mac, err)))
+		}
+	}
+	return problems
+}
+
+func isValidVlan(id int) bool {
+	return id >= 1 && id <= 4094
+}
+
+func sortedVlanIDs[V any](vlans map[vlanID]V) []vlanID {
+	ids := make([]vlanID, 0, len(vlans))
+	for id := range vlans {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var invalidTestConfig = []byte(`net_interface = "test0"
+strip_addresses = ["fe80::/10", "169.254.0.0"]
+colour = "blue"
+
+[devices]
+
+    [devices."00:14:22:01:23:45"]
+    origin_pool = 45
+    shared_pools = [42, 45]
+    sharedpools = [46]
+
+    [devices."00:14:22:01:23:zz"]
+    origin_pool = 4095
+    shared_pools = [42]
+    services = ["_googlecast._tcp", "googlecast"]
+
+    [devices."00:14:22:01:23:zz".pool.43]
+    services = ["_airplay._tcp"]
+
+    [devices."AA:14:22:01:23:47"]
+    origin_pool = 47
+    shared_pools = [42]
+
+    [devices."aa:14:22:01:23:47"]
+    origin_pool = 47
+    shared_pools = [0]
+
+[vlan]
+
+    [vlan.42]
+    ip_source = "192.168.42.2"
+
+    [vlan.5000]
+    ip_source = "192.168.50.2"
+
+[aliases]
+iot = 103
+"104" = 104
+
+[groups.media]
+shared_pools = ["iot", "guests"]
+
+[devices."00:14:22:01:23:48"]
+origin_pool = "media"
+shared_pools = [42]
+group = "music"
+macs = ["aa:14:22:01:23:47", "00:14:22:*", "00:14"]
+addresses = ["192.168.1.0/24", "192.168.1.300"]
+
+[dns_gateway]
+listen = "53"
+domain = "home.local"
+
+[dns_gateway.pools]
+4095 = ["10.8.0.0/24", "10.9.0.0"]
+
+[[static_services]]
+name = "Office Printer"
+type = "ipp"
+host = "printer"
+addresses = ["10.20.0.300"]
+shared_pools = [42, 43]
+
+[devices."00:14:22:01:23:48".privacy]
+instance_name = "_printer"
+txt_drop = ["serial=1"]
+ssdp_drop = ["X-Serial: 1"]
+
+[devices."AA:14:22:01:23:47".pool.42]
+ssdp_types = ["dial", "urn:dial-multiscreen-org:service:dial:1"]
+
+[vlan.44]
+ip_source = "192.168.44.2"
+ssdp_unicast_target = "00:14:22:01:23:45"
+
+[devices.tv]
+origin_pool = 44
+shared_pools = [42]
+hostnames = ["Living Room TV"]
+
+[devices.tv2]
+origin_pool = 44
+shared_pools = [42]
+hostnames = ["living room tv.local"]
+`)
+
+func TestCheckConfig(t *testing.T) {
+	expectedResult := []string{
+		"test.toml:2:1: strip_addresses entry 169.254.0.0 is not a network like fe80::/10",
+		"test.toml:3:1: unknown key colour",
+		"test.toml:9:5: device 00:14:22:01:23:45 lists its origin_pool 45 in its shared_pools",
+		"test.toml:10:5: unknown key devices.00:14:22:01:23:45.sharedpools",
+		"test.toml:12:5: device 00:14:22:01:23:zz is not a MAC address in the form aa:bb:cc:dd:ee:ff, and has no macs, addresses or hostnames to match on",
+		"test.toml:13:5: origin_pool 4095 of device 00:14:22:01:23:zz is not a VLAN ID between 1 and 4094",
+		"test.toml:15:5: service googlecast of device 00:14:22:01:23:zz is not a DNS-SD service type like _airplay._tcp",
+		"test.toml:17:5: pool 43 of device 00:14:22:01:23:zz is not one of its shared_pools",
+		"test.toml:24:5: device aa:14:22:01:23:47 is a duplicate of device AA:14:22:01:23:47",
+		"test.toml:26:5: shared pool 0 of device aa:14:22:01:23:47 is not a VLAN ID between 1 and 4094",
+		"test.toml:33:5: vlan 5000 is not a VLAN ID between 1 and 4094",
+		"test.toml:38:1: VLAN alias 104 is a number",
+		"test.toml:41:1: unknown VLAN alias guests",
+		"test.toml:43:1: device 00:14:22:01:23:48 has no origin_pool",
+		"test.toml:44:1: unknown VLAN alias media",
+		"test.toml:46:1: device 00:14:22:01:23:48 refers to unknown group music",
+		"test.toml:47:1: mac aa:14:22:01:23:47 of device 00:14:22:01:23:48 is also used by device AA:14:22:01:23:47",
+		"test.toml:47:1: mac 00:14 of device 00:14:22:01:23:48 is invalid: expected a MAC address, an OUI prefix or a MAC address with * wildcards",
+		"test.toml:48:1: address 192.168.1.300 of device 00:14:22:01:23:48 is invalid: expected an IP address or a CIDR network",
+		"test.toml:51:1: listen \"53\" of dns_gateway is not an address like 0.0.0.0:53",
+		"test.toml:52:1: domain home.local of dns_gateway is not a unicast DNS domain like home.arpa",
+		"test.toml:55:1: dns_gateway pool 4095 is not a VLAN ID between 1 and 4094",
+		"test.toml:55:1: subnet 10.9.0.0 of dns_gateway pool 4095 is not a network like 10.8.0.0/24",
+		"test.toml:57:1: static service Office Printer has no port",
+		"test.toml:59:1: type ipp of static service Office Printer is not a DNS-SD service type like _ipp._tcp",
+		"test.toml:61:1: address 10.20.0.300 of static service Office Printer is not an IP address",
+		"test.toml:62:1: shared pool 43 of static service Office Printer has no [vlan.43] ip_source to announce it from",
+		"test.toml:65:1: instance_name _printer of device 00:14:22:01:23:48 is not a DNS label of at most 63 bytes without a leading _",
+		"test.toml:66:1: TXT key \"serial=1\" of device 00:14:22:01:23:48 is empty or contains =",
+		"test.toml:67:1: SSDP header \"X-Serial: 1\" of device 00:14:22:01:23:48 is empty or contains a colon or space",
+		"test.toml:70:1: ssdp type dial of device AA:14:22:01:23:47 is not a notification type like urn:dial-multiscreen-org:service:dial:1",
+		"test.toml:74:1: ssdp_unicast_target 00:14:22:01:23:45 of vlan 44 is not shared with vlan 44",
+		"test.toml:84:1: hostname living room tv.local of device tv2 is also used by device tv",
+	}
+
+	var computedResult []string
+	for _, problem := range checkConfig("test.toml", invalidTestConfig) {
+		computedResult = append(computedResult, problem.String())
+	}
+	if !reflect.DeepEqual(expectedResult, computedResult) {
+		t.Errorf("Error in checkConfig(): got\n%q", computedResult)
+	}
+
+	interfacesConfig := []byte(`net_interface = "test0"
+[aliases]
+clients = 42
+[[interfaces]]
+name = "bond0"
+vlans = ["clients", 45]
+[[interfaces]]
+name = "bond1"
+vlans = [45, 4095]
+[devices."00:14:22:01:23:45"]
+origin_pool = 45
+shared_pools = [42, 46]
+[vlan.clients]
+ip_source = "192.168.42.2"
+[vlan.46]
+ip_source = "192.168.46.2"
+`)
+	expectedResult = []string{
+		"test.toml:1:1: net_interface test0 cannot be combined with interfaces, list its VLANs in interfaces",
+		"test.toml:9:1: vlan 45 is on interface bond0 and on bond1",
+		"test.toml:9:1: vlan 4095 of interface bond1 is not a VLAN ID between 1 and 4094",
+		"test.toml:12:1: shared pool 46 of device 00:14:22:01:23:45 is not on any of the interfaces",
+		"test.toml:15:1: vlan 46 is not on any of the interfaces",
+	}
+	computedResult = nil
+	for _, problem := range checkConfig("test.toml", interfacesConfig) {
+		computedResult = append(computedResult, problem.String())
+	}
+	if !reflect.DeepEqual(expectedResult, computedResult) {
+		t.Errorf("Error in checkConfig(): got\n%q", computedResult)
+	}
+
+	if problems := checkConfig("test.toml", []byte(`net_interface = "test0"
+native_vlan = "clients"
+mdns_cache = true
+ssdp_cache = true
+max_packets_per_second = 200
+coalesce_window = "100ms"
+validate_answers = "strip"
+ssdp_proxy_port = 8200
+strip_addresses = ["fe80::/10", "169.254.0.0/16"]
+[aliases]
+clients = 42
+[groups.media]
+shared_pools = ["clients"]
+[devices."00:14:22:01:23:45"]
+origin_pool = 45
+group = "media"
+[vlan.clients]
+ip_source = "192.168.42.2"
+ip6_source = "fd00:42::2"
+max_packets_per_second = 500
+ssdp_unicast_target = "00:14:22:01:23:45"
+[vlan.clients.privacy]
+txt_drop = ["serial", "deviceid"]
+ssdp_replace = { SERVER = "UPnP/1.0" }
+[devices."00:14:22:01:23:45".pool.clients]
+ssdp_types = ["upnp:rootdevice", "urn:dial-multiscreen-org:service:dial:1"]
+[devices."00:14:22:01:23:45".pool.clients.privacy]
+instance_name = "Living Room"
+[dns_gateway]
+listen = "0.0.0.0:53"
+[dns_gateway.pools]
+clients = ["10.8.0.0/24"]
+[[static_services]]
+name = "Office Printer"
+type = "_ipp._tcp"
+host = "printer.local"
+port = 631
+txt = ["rp=ipp/print"]
+addresses = ["10.20.0.5", "fd00:20::5"]
+shared_pools = ["clients"]
+`)); len(problems) != 0 {
+		t.Errorf("Error in checkConfig(): unexpected problems for a valid config: %v", problems)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"time"
+)
+
+// queryCoalescer merges the mDNS queries from one VLAN which arrive within coalesce_window into one query,
+// which is forwarded once to every destination VLAN. When 30 phones browse for the same service at once,
+// the devices get a single query.
+type queryCoalescer struct {
+	batches map[batchKey]*queryBatch
+}
+
+type batchKey struct {
+	vlan   uint16
+	isIPv6 bool
+}
+
+type questionKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type queryBatch struct {
+	questions []dnsQuestion
+	// knownAnswers holds per question the known answers which every querier of the question listed (RFC 6762
+	// section 7.1). A device which sees a known answer does not send it, so a record which is missing from
+	// the list of one of the queriers has to be left out.
+	knownAnswers map[questionKey][]dnsRecord
+	queries      int
+	deadline     time.Time
+}
+
+// coalescedQuery is a merged query which is ready to be forwarded from the VLAN.
+type coalescedQuery struct {
+	batchKey
+	msg     *dnsMessage
+	queries int
+}
+
+// maxCoalescedQuerySize keeps a merged query in one packet, a batch which grows larger is forwarded early.
+var maxCoalescedQuerySize = 1400
+
+func newQueryCoalescer() *queryCoalescer {
+	return &queryCoalescer{batches: make(map[batchKey]*queryBatch)}
+}
+
+// coalescable reports whether the query can wait to be merged: a multicast query without QU questions
+// and without more known answers in a following packet. Legacy unicast queries need their own session.
+func coalescable(packet *multicastPacket, query *dnsMessage) bool {
+	if *packet.srcPort != 5353 || !packet.dstIP.IsMulticast() || query.flags&dnsFlagTruncated != 0 || len(query.questions) == 0 {
+		return false
+	}
+	for _, question := range query.questions {
+		if question.unicastResponse() {
+			return false
+		}
+	}
+	return true
+}
+
+func keyOfQuestion(question dnsQuestion) questionKey {
+	return questionKey{cacheName(question.name), question.qtype, question.qclass}
+}
+
+// add merges the query into the batch of its VLAN, which is forwarded after 'window'. When the merged
+// query would not fit in a packet, the batch is returned to be forwarded now, and a new batch is started.
+func (coalescer *queryCoalescer) add(key batchKey, query *dnsMessage, window time.Duration, now time.Time) (flushed []coalescedQuery) {
+	batch, ok := coalescer.batches[key]
+	if ok {
+		merged := batch.merge(query)
+		if len(merged.message().pack()) <= maxCoalescedQuerySize {
+			coalescer.batches[key] = merged
+			return nil
+		}
+		flushed = append(flushed, coalescedQuery{key, batch.message(), batch.queries})
+	}
+	batch = (&queryBatch{knownAnswers: make(map[questionKey][]dnsRecord), deadline: now.Add(window)}).merge(query)
+	coalescer.batches[key] = batch
+	return flushed
+}
+
+// merge returns a new batch with the questions of the query and the known answers both have.
+func (batch *queryBatch) merge(query *dnsMessage) *queryBatch {
+	merged := &queryBatch{
+		questions:    append([]dnsQuestion{}, batch.questions...),
+		knownAnswers: make(map[questionKey][]dnsRecord),
+		queries:      batch.queries + 1,
+		deadline:     batch.deadline,
+	}
+	for key, records := range batch.knownAnswers {
+		merged.knownAnswers[key] = records
+	}
+
+	for _, question := range query.questions {
+		key := keyOfQuestion(question)
+		var known []dnsRecord
+		for _, rr := range query.answers {
+			if equalDNSNames(rr.name, question.name) && (question.qtype == dnsTypeANY || rr.rtype == question.qtype) {
+				known = append(known, rr)
+			}
+		}
+
+		previous, asked := merged.knownAnswers[key]
+		if !asked {
+			merged.questions = append(merged.questions, question)
+			merged.knownAnswers[key] = known
+			continue
+		}
+		// Only the records which both queriers know, with the lowest TTL
+		var both []dnsRecord
+		for _, rr := range previous {
+			for _, other := range known {
+				if rr.rtype == other.rtype && equalDNSNames(rr.name, other.name) && string(rr.rdata) == string(other.rdata) {
+					rr.ttl = min(rr.ttl, other.ttl)
+					both = append(both, rr)
+					break
+				}
+			}
+		}
+		merged.knownAnswers[key] = both
+	}
+	return merged
+}
+
+func (batch *queryBatch) message() *dnsMessage {
+	msg := &dnsMessage{questions: batch.questions}
+	for _, question := range batch.questions {
+		msg.answers = append(msg.answers, batch.knownAnswers[keyOfQuestion(question)]...)
+	}
+	return msg
+}
+
+// due removes and returns the batches whose window has passed.
+func (coalescer *queryCoalescer) due(now time.Time) (flushed []coalescedQuery) {
+	for key, batch := range coalescer.batches {
+		if !now.Before(batch.deadline) {
+			flushed = append(flushed, coalescedQuery{key, batch.message(), batch.queries})
+			delete(coalescer.batches, key)
+		}
+	}
+	return flushed
+}
+
+// next returns the deadline of the batch which is due first.
+func (coalescer *queryCoalescer) next() (next time.Time, ok bool) {
+	for _, batch := range coalescer.batches {
+		if !ok || batch.deadline.Before(next) {
+			next, ok = batch.deadline, true
+		}
+	}
+	return next, ok
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+func TestQueryCoalescer(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	window := 100 * time.Millisecond
+	coalescer := newQueryCoalescer()
+	key := batchKey{vlan: 101}
+
+	ptr := func(target string, ttl uint32) dnsRecord {
+		return dnsRecord{name: "_googlecast._tcp.local", rtype: dnsTypePTR, class: dnsClassIN, ttl: ttl, rdata: appendDNSName(nil, target, nil, 0)}
+	}
+	browse := dnsQuestion{name: "_googlecast._tcp.local", qtype: dnsTypePTR, qclass: dnsClassIN}
+	phone := &dnsMessage{questions: []dnsQuestion{browse}, answers: []dnsRecord{ptr("TV._googlecast._tcp.local", 4500), ptr("Shield._googlecast._tcp.local", 4500)}}
+	laptop := &dnsMessage{questions: []dnsQuestion{browse, {name: "_airplay._tcp.local", qtype: dnsTypePTR, qclass: dnsClassIN}}, answers: []dnsRecord{ptr("TV._googlecast._tcp.local", 3000)}}
+
+	if flushed := coalescer.add(key, phone, window, now); len(flushed) != 0 {
+		t.Errorf("Error in add(): expected the query to wait, got %d flushed", len(flushed))
+	}
+	coalescer.add(key, laptop, window, now.Add(10*time.Millisecond))
+	coalescer.add(batchKey{vlan: 103}, phone, window, now.Add(50*time.Millisecond))
+
+	if flushed := coalescer.due(now.Add(50 * time.Millisecond)); len(flushed) != 0 {
+		t.Errorf("Error in due(): expected no batch before the window, got %d", len(flushed))
+	}
+	flushed := coalescer.due(now.Add(window))
+	if len(flushed) != 1 || flushed[0].vlan != 101 || flushed[0].queries != 2 {
+		t.Fatalf("Error in due(): expected the batch of VLAN 101 with 2 queries, got %+v", flushed)
+	}
+	// The questions of both queries, and only the known answer both queriers have, with the lowest TTL
+	msg := flushed[0].msg
+	if len(msg.questions) != 2 {
+		t.Errorf("Error in add(): expected 2 questions, got %+v", msg.questions)
+	}
+	if len(msg.answers) != 1 || msg.answers[0].target() != "TV._googlecast._tcp.local" || msg.answers[0].ttl != 3000 {
+		t.Errorf("Error in add(): expected the known answer of the TV with TTL 3000, got %+v", msg.answers)
+	}
+	if next, ok := coalescer.next(); !ok || !next.Equal(now.Add(150*time.Millisecond)) {
+		t.Errorf("Error in next(): expected the batch of VLAN 103 at 150ms, got %v", next)
+	}
+
+	// A batch which would not fit in a packet is flushed early
+	maxCoalescedQuerySize = 60
+	defer func() { maxCoalescedQuerySize = 1400 }()
+	if flushed := coalescer.add(batchKey{vlan: 103}, laptop, window, now.Add(60*time.Millisecond)); len(flushed) != 1 || flushed[0].queries != 1 {
+		t.Errorf("Error in add(): expected the full batch to be flushed, got %+v", flushed)
+	}
+
+	srcPort, qu := layers.UDPPort(5353), layers.UDPPort(5353)
+	multicast := net.IPv4(224, 0, 0, 251)
+	if !coalescable(&multicastPacket{srcPort: &srcPort, dstIP: &multicast}, phone) {
+		t.Error("Error in coalescable(): expected a multicast query to be coalescable")
+	}
+	unicastQuestion := &dnsMessage{questions: []dnsQuestion{{name: browse.name, qtype: dnsTypePTR, qclass: dnsClassIN | dnsClassUnicastResp}}}
+	if coalescable(&multicastPacket{srcPort: &qu, dstIP: &multicast}, unicastQuestion) {
+		t.Error("Error in coalescable(): a query with a QU question has to be forwarded now")
+	}
+	legacyPort := layers.UDPPort(50000)
+	if coalescable(&multicastPacket{srcPort: &legacyPort, dstIP: &multicast}, phone) {
+		t.Error("Error in coalescable(): a legacy unicast query has to be forwarded now")
+	}
+}
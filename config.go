@@ -2,10 +2,16 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pelletier/go-toml"
 	"github.com/sirupsen/logrus"
@@ -14,20 +20,136 @@ import (
 type macAddress string
 
 type config struct {
-	NetInterface string                         `toml:"net_interface"`
-	Devices      map[macAddress]multicastDevice `toml:"devices"`
-	VlanIPSource map[vlanID]vlanIpSource        `toml:"vlan"`
+	NetInterface        string                         `toml:"net_interface"`
+	Interfaces          []trunkInterface               `toml:"interfaces,omitempty"`
+	NativeVlan          uint16                         `toml:"native_vlan,omitempty"`
+	MDNSCache           bool                           `toml:"mdns_cache,omitempty"`
+	SSDPCache           bool                           `toml:"ssdp_cache,omitempty"`
+	StripAddresses      []string                       `toml:"strip_addresses,omitempty"`
+	MaxPacketsPerSecond int                            `toml:"max_packets_per_second,omitempty"`
+	CoalesceWindow      string                         `toml:"coalesce_window,omitempty"`
+	ValidateAnswers     string                         `toml:"validate_answers,omitempty"`
+	SSDPProxyPort       uint16                         `toml:"ssdp_proxy_port,omitempty"`
+	DNSGateway          dnsGateway                     `toml:"dns_gateway,omitempty"`
+	StaticServices      []staticService                `toml:"static_services,omitempty"`
+	Include             []string                       `toml:"include,omitempty"`
+	Devices             map[macAddress]multicastDevice `toml:"devices"`
+	VlanIPSource        map[vlanID]vlanIpSource        `toml:"vlan"`
+	Aliases             map[string]uint16              `toml:"aliases,omitempty"`
+	Groups              map[string]sharingGroup        `toml:"groups,omitempty"`
 }
 
 type multicastDevice struct {
-	Description string   `toml:"description,omitempty"`
-	OriginPool  uint16   `toml:"origin_pool"`
+	Description string                `toml:"description,omitempty"`
+	OriginPool  uint16                `toml:"origin_pool"`
+	SharedPools []uint16              `toml:"shared_pools"`
+	Services    []string              `toml:"services,omitempty"`
+	SSDPTypes   []string              `toml:"ssdp_types,omitempty"`
+	Pools       map[vlanID]sharedPool `toml:"pool,omitempty"`
+	Group       string                `toml:"group,omitempty"`
+	Macs        []string              `toml:"macs,omitempty"`
+	Addresses   []string              `toml:"addresses,omitempty"`
+	Hostnames   []string              `toml:"hostnames,omitempty"`
+	Schedule    string                `toml:"schedule,omitempty"`
+	Expires     string                `toml:"expires,omitempty"`
+	Privacy     privacyRules          `toml:"privacy,omitempty"`
+	// sharing holds the compiled sharing rules of the shared pools, set by newPolicy
+	sharing map[uint16]compiledRule
+}
+
+// trunkInterface is one of the trunks of the reflector with the VLANs it carries, instead of net_interface
+// when the VLANs are carried by more than one bridge or bond.
+type trunkInterface struct {
+	Name  string   `toml:"name"`
+	Vlans []uint16 `toml:"vlans"`
+}
+
+// sharingGroup is a reusable list of shared pools, devices refer to it with 'group'
+type sharingGroup struct {
 	SharedPools []uint16 `toml:"shared_pools"`
 }
 
+// dnsGateway is a unicast DNS server for the clients of routed networks, which cannot receive mDNS.
+// It is enabled when Listen is set.
+type dnsGateway struct {
+	Listen string `toml:"listen"`
+	// Domain replaces .local in the names it serves, home.arpa when empty
+	Domain string `toml:"domain,omitempty"`
+	// Pools lists per VLAN the client subnets which get the devices shared with that VLAN
+	Pools map[vlanID][]string `toml:"pools"`
+}
+
+// staticService is a DNS-SD service which the reflector announces on behalf of a device without mDNS,
+// or a device behind a routed link.
+type staticService struct {
+	// Name is the instance name, like "Office Printer"
+	Name string   `toml:"name"`
+	Type string   `toml:"type"`
+	Host string   `toml:"host"`
+	Port uint16   `toml:"port"`
+	TXT  []string `toml:"txt,omitempty"`
+	// Addresses are the IPv4 and IPv6 addresses of the host
+	Addresses   []string `toml:"addresses"`
+	SharedPools []uint16 `toml:"shared_pools"`
+}
+
+// sharedPool overrides the device settings for one of its shared pools
+type sharedPool struct {
+	Services  []string     `toml:"services,omitempty"`
+	SSDPTypes []string     `toml:"ssdp_types,omitempty"`
+	Schedule  string       `toml:"schedule,omitempty"`
+	Expires   string       `toml:"expires,omitempty"`
+	Privacy   privacyRules `toml:"privacy,omitempty"`
+}
+
+// privacyRules rewrite what a device tells about itself before it is reflected to a pool.
+// Key and header names are compared without case.
+type privacyRules struct {
+	// TXTDrop removes the keys from the TXT records
+	TXTDrop []string `toml:"txt_drop,omitempty"`
+	// TXTReplace replaces the values of the keys in the TXT records
+	TXTReplace map[string]string `toml:"txt_replace,omitempty"`
+	// InstanceName replaces the instance name of the DNS-SD services
+	InstanceName string `toml:"instance_name,omitempty"`
+	// SSDPDrop removes the headers from the SSDP advertisements and responses
+	SSDPDrop []string `toml:"ssdp_drop,omitempty"`
+	// SSDPReplace replaces the values of the headers in the SSDP advertisements and responses
+	SSDPReplace map[string]string `toml:"ssdp_replace,omitempty"`
+}
+
+// poolSettings returns the overrides of the device for one of its shared pools.
+func (device multicastDevice) poolSettings(pool uint16) (sharedPool, bool) {
+	override, ok := device.Pools[vlanID(strconv.Itoa(int(pool)))]
+	return override, ok
+}
+
+// servicesFor returns the DNS-SD service types the device shares with the pool, nil means all.
+func (device multicastDevice) servicesFor(pool uint16) []string {
+	if override, ok := device.poolSettings(pool); ok && override.Services != nil {
+		return override.Services
+	}
+	return device.Services
+}
+
+// ssdpTypesFor returns the SSDP notification types and search targets the device shares with the pool, nil means all.
+func (device multicastDevice) ssdpTypesFor(pool uint16) []string {
+	if override, ok := device.poolSettings(pool); ok && override.SSDPTypes != nil {
+		return override.SSDPTypes
+	}
+	return device.SSDPTypes
+}
+
 type vlanID string
 type vlanIpSource struct {
 	IpSource net.IP `toml:"ip_source"`
+	// Ip6Source is a global or unique local IPv6 address, the link-local address is used when empty
+	Ip6Source net.IP `toml:"ip6_source,omitempty"`
+	// MaxPacketsPerSecond overrides the max_packets_per_second of the config for the VLAN
+	MaxPacketsPerSecond int `toml:"max_packets_per_second,omitempty"`
+	// SSDPUnicastTarget is the device entry which gets the unicast M-SEARCH requests sent to ip_source
+	SSDPUnicastTarget macAddress `toml:"ssdp_unicast_target,omitempty"`
+	// Privacy is applied to every device reflected to the VLAN
+	Privacy privacyRules `toml:"privacy,omitempty"`
 }
 
 func findConfigFile() (*string, error) {
@@ -49,16 +171,383 @@ func findConfigFile() (*string, error) {
 		return &checkFile, nil
 	}
 
+	// Check if the config directory has config files, like a mounted Kubernetes configmap with several keys
+	checkFile = "config"
+	if matches, _ := filepath.Glob(filepath.Join(checkFile, "*.toml")); len(matches) > 0 {
+		return &checkFile, nil
+	}
+
 	return nil, errors.New("no config file found")
 }
 
 func readConfig(path string) (cfg config, err error) {
-	content, err := os.ReadFile(path)
+	files, err := loadConfigFiles(path)
 	if err != nil {
 		return config{}, err
 	}
-	err = toml.Unmarshal(content, &cfg)
-	return cfg, err
+	cfg, problems, _ := mergeConfigFiles(files)
+	if len(problems) > 0 {
+		return config{}, errors.New(problems[0].String())
+	}
+	return cfg, nil
+}
+
+// configFile is the parsed content of the config file or of one of the files it includes.
+type configFile struct {
+	path string
+	tree *toml.Tree
+}
+
+// configFiles are the config files in the order they are merged.
+type configFiles []configFile
+
+// problemAt returns a problem at the key path in the first file which has it.
+func (files configFiles) problemAt(path []string, message string) configProblem {
+	for _, file := range files {
+		if file.tree.HasPath(path) {
+			return configProblem{file: file.path, position: file.tree.GetPositionPath(path), message: message}
+		}
+	}
+	return configProblem{file: files[0].path, message: message}
+}
+
+func (files configFiles) hasPath(path []string) bool {
+	for _, file := range files {
+		if file.tree.HasPath(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadConfigFiles parses the config file, followed by the files matched by the 'include' globs in it.
+// Globs are relative to the directory of the file they are in. When path is a directory, all *.toml
+// files in it are loaded in alphabetical order.
+func loadConfigFiles(path string) (configFiles, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	queue := []string{path}
+	if stat.IsDir() {
+		if queue, err = filepath.Glob(filepath.Join(path, "*.toml")); err != nil {
+			return nil, err
+		}
+		if len(queue) == 0 {
+			return nil, fmt.Errorf("%s: no *.toml files in config directory", path)
+		}
+	}
+
+	var files configFiles
+	loaded := make(map[string]bool)
+	for len(queue) > 0 {
+		file := queue[0]
+		queue = queue[1:]
+		if absolute, err := filepath.Abs(file); err == nil {
+			if loaded[absolute] {
+				continue
+			}
+			loaded[absolute] = true
+		}
+
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		tree, err := toml.LoadBytes(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		files = append(files, configFile{path: file, tree: tree})
+
+		includes, _ := tree.Get("include").([]interface{})
+		for _, include := range includes {
+			pattern, ok := include.(string)
+			if !ok {
+				continue
+			}
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(file), pattern)
+			}
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%s: include %s: %w", file, include, err)
+			}
+			queue = append(queue, matches...)
+		}
+	}
+	return files, nil
+}
+
+// mergeConfigFiles resolves the VLAN aliases in every file and merges the files into one config.
+// A device or static service may only be defined in one file. net_interface, interfaces, native_vlan, strip_addresses, max_packets_per_second,
+// coalesce_window, validate_answers, ssdp_proxy_port, dns_gateway, aliases, groups and VLANs may be repeated in several files, but only with the same value. mdns_cache and ssdp_cache
+// are enabled when one of the files enables them.
+// It returns false when a file could not be decoded.
+func mergeConfigFiles(files configFiles) (cfg config, problems []configProblem, ok bool) {
+	aliases := make(map[string]int64)
+	aliasFiles := make(map[string]string)
+	for _, file := range files {
+		for alias, id := range treeAliases(file.tree) {
+			if other, ok := aliases[alias]; ok && other != id {
+				problems = append(problems, configProblem{file: file.path, position: file.tree.GetPositionPath([]string{"aliases", alias}), message: fmt.Sprintf("VLAN alias %s is %d, but %d in %s", alias, id, other, aliasFiles[alias])})
+				continue
+			}
+			aliases[alias] = id
+			aliasFiles[alias] = file.path
+		}
+	}
+
+	deviceFiles := make(map[string]string)
+	vlanFiles := make(map[vlanID]string)
+	groupFiles := make(map[string]string)
+	var gatewayFile, interfacesFile string
+	staticFiles := make(map[string]string)
+	for _, file := range files {
+		problems = append(problems, resolveAliases(file.path, file.tree, aliases)...)
+
+		var fileCfg config
+		if err := file.tree.Unmarshal(&fileCfg); err != nil {
+			return config{}, append(problems, configProblem{file: file.path, message: err.Error()}), false
+		}
+		if fileCfg.NetInterface != "" && cfg.NetInterface != "" && fileCfg.NetInterface != cfg.NetInterface {
+			problems = append(problems, configProblem{file: file.path, position: file.tree.GetPosition("net_interface"), message: fmt.Sprintf("net_interface %s conflicts with %s", fileCfg.NetInterface, cfg.NetInterface)})
+		} else if fileCfg.NetInterface != "" {
+			cfg.NetInterface = fileCfg.NetInterface
+		}
+		if len(fileCfg.Interfaces) != 0 && len(cfg.Interfaces) != 0 && !reflect.DeepEqual(fileCfg.Interfaces, cfg.Interfaces) {
+			problems = append(problems, configProblem{file: file.path, position: file.tree.GetPosition("interfaces"), message: fmt.Sprintf("interfaces are configured differently in %s", interfacesFile)})
+		} else if len(fileCfg.Interfaces) != 0 && len(cfg.Interfaces) == 0 {
+			cfg.Interfaces, interfacesFile = fileCfg.Interfaces, file.path
+		}
+		if fileCfg.NativeVlan != 0 && cfg.NativeVlan != 0 && fileCfg.NativeVlan != cfg.NativeVlan {
+			problems = append(problems, configProblem{file: file.path, position: file.tree.GetPosition("native_vlan"), message: fmt.Sprintf("native_vlan %d conflicts with %d", fileCfg.NativeVlan, cfg.NativeVlan)})
+		} else if fileCfg.NativeVlan != 0 {
+			cfg.NativeVlan = fileCfg.NativeVlan
+		}
+		cfg.MDNSCache = cfg.MDNSCache || fileCfg.MDNSCache
+		cfg.SSDPCache = cfg.SSDPCache || fileCfg.SSDPCache
+		if fileCfg.MaxPacketsPerSecond != 0 && cfg.MaxPacketsPerSecond != 0 && fileCfg.MaxPacketsPerSecond != cfg.MaxPacketsPerSecond {
+			problems = append(problems, configProblem{file: file.path, position: file.tree.GetPosition("max_packets_per_second"), message: fmt.Sprintf("max_packets_per_second %d conflicts with %d", fileCfg.MaxPacketsPerSecond, cfg.MaxPacketsPerSecond)})
+		} else if fileCfg.MaxPacketsPerSecond != 0 {
+			cfg.MaxPacketsPerSecond = fileCfg.MaxPacketsPerSecond
+		}
+		if fileCfg.CoalesceWindow != "" && cfg.CoalesceWindow != "" && fileCfg.CoalesceWindow != cfg.CoalesceWindow {
+			problems = append(problems, configProblem{file: file.path, position: file.tree.GetPosition("coalesce_window"), message: fmt.Sprintf("coalesce_window %s conflicts with %s", fileCfg.CoalesceWindow, cfg.CoalesceWindow)})
+		} else if fileCfg.CoalesceWindow != "" {
+			cfg.CoalesceWindow = fileCfg.CoalesceWindow
+		}
+		if fileCfg.ValidateAnswers != "" && cfg.ValidateAnswers != "" && fileCfg.ValidateAnswers != cfg.ValidateAnswers {
+			problems = append(problems, configProblem{file: file.path, position: file.tree.GetPosition("validate_answers"), message: fmt.Sprintf("validate_answers %s conflicts with %s", fileCfg.ValidateAnswers, cfg.ValidateAnswers)})
+		} else if fileCfg.ValidateAnswers != "" {
+			cfg.ValidateAnswers = fileCfg.ValidateAnswers
+		}
+		if fileCfg.SSDPProxyPort != 0 && cfg.SSDPProxyPort != 0 && fileCfg.SSDPProxyPort != cfg.SSDPProxyPort {
+			problems = append(problems, configProblem{file: file.path, position: file.tree.GetPosition("ssdp_proxy_port"), message: fmt.Sprintf("ssdp_proxy_port %d conflicts with %d", fileCfg.SSDPProxyPort, cfg.SSDPProxyPort)})
+		} else if fileCfg.SSDPProxyPort != 0 {
+			cfg.SSDPProxyPort = fileCfg.SSDPProxyPort
+		}
+		if len(fileCfg.StripAddresses) != 0 && len(cfg.StripAddresses) != 0 && !slices.Equal(fileCfg.StripAddresses, cfg.StripAddresses) {
+			problems = append(problems, configProblem{file: file.path, position: file.tree.GetPosition("strip_addresses"), message: fmt.Sprintf("strip_addresses %v conflicts with %v", fileCfg.StripAddresses, cfg.StripAddresses)})
+		} else if len(fileCfg.StripAddresses) != 0 {
+			cfg.StripAddresses = fileCfg.StripAddresses
+		}
+
+		for _, mac := range sortedMacs(fileCfg.Devices, nil) {
+			key := strings.ToLower(string(mac))
+			if other, ok := deviceFiles[key]; ok && other != file.path {
+				problems = append(problems, configProblem{file: file.path, position: file.tree.GetPositionPath([]string{"devices", string(mac)}), message: fmt.Sprintf("device %s is also defined in %s", mac, other)})
+				continue
+			}
+			deviceFiles[key] = file.path
+			if cfg.Devices == nil {
+				cfg.Devices = make(map[macAddress]multicastDevice)
+			}
+			cfg.Devices[mac] = fileCfg.Devices[mac]
+		}
+		for _, vlan := range sortedVlanIDs(fileCfg.VlanIPSource) {
+			value := fileCfg.VlanIPSource[vlan]
+			if other, ok := cfg.VlanIPSource[vlan]; ok {
+				if !other.IpSource.Equal(value.IpSource) || !other.Ip6Source.Equal(value.Ip6Source) || other.MaxPacketsPerSecond != value.MaxPacketsPerSecond || other.SSDPUnicastTarget != value.SSDPUnicastTarget || !reflect.DeepEqual(other.Privacy, value.Privacy) {
+					problems = append(problems, configProblem{file: file.path, position: file.tree.GetPositionPath([]string{"vlan", string(vlan)}), message: fmt.Sprintf("vlan %s is configured differently in %s", vlan, vlanFiles[vlan])})
+				}
+				continue
+			}
+			vlanFiles[vlan] = file.path
+			if cfg.VlanIPSource == nil {
+				cfg.VlanIPSource = make(map[vlanID]vlanIpSource)
+			}
+			cfg.VlanIPSource[vlan] = value
+		}
+		for name, group := range fileCfg.Groups {
+			if other, ok := cfg.Groups[name]; ok {
+				if !slices.Equal(other.SharedPools, group.SharedPools) {
+					problems = append(problems, configProblem{file: file.path, position: file.tree.GetPositionPath([]string{"groups", name}), message: fmt.Sprintf("group %s is configured differently in %s", name, groupFiles[name])})
+				}
+				continue
+			}
+			groupFiles[name] = file.path
+			if cfg.Groups == nil {
+				cfg.Groups = make(map[string]sharingGroup)
+			}
+			cfg.Groups[name] = group
+		}
+		if fileCfg.DNSGateway.Listen != "" || len(fileCfg.DNSGateway.Pools) != 0 {
+			if cfg.DNSGateway.Listen != "" || len(cfg.DNSGateway.Pools) != 0 {
+				if !reflect.DeepEqual(fileCfg.DNSGateway, cfg.DNSGateway) {
+					problems = append(problems, configProblem{file: file.path, position: file.tree.GetPosition("dns_gateway"), message: fmt.Sprintf("dns_gateway is configured differently in %s", gatewayFile)})
+				}
+			} else {
+				cfg.DNSGateway, gatewayFile = fileCfg.DNSGateway, file.path
+			}
+		}
+		staticTables, _ := file.tree.Get("static_services").([]*toml.Tree)
+		for i, service := range fileCfg.StaticServices {
+			instance := service.instanceName()
+			if other, ok := staticFiles[instance]; ok {
+				problems = append(problems, configProblem{file: file.path, position: staticTables[i].Position(), message: fmt.Sprintf("static service %s is also defined in %s", service.Name, other)})
+				continue
+			}
+			staticFiles[instance] = file.path
+			cfg.StaticServices = append(cfg.StaticServices, service)
+		}
+		for alias, id := range fileCfg.Aliases {
+			if cfg.Aliases == nil {
+				cfg.Aliases = make(map[string]uint16)
+			}
+			cfg.Aliases[alias] = id
+		}
+	}
+
+	problems = append(problems, expandGroups(files, &cfg)...)
+	return cfg, problems, true
+}
+
+// treeAliases returns the VLAN aliases in the [aliases] table of a config file.
+func treeAliases(tree *toml.Tree) map[string]int64 {
+	aliases := make(map[string]int64)
+	if aliasTree, ok := tree.Get("aliases").(*toml.Tree); ok {
+		for _, alias := range aliasTree.Keys() {
+			if id, ok := aliasTree.Get(alias).(int64); ok {
+				aliases[alias] = id
+			}
+		}
+	}
+	return aliases
+}
+
+// resolveAliases replaces the VLAN aliases by their VLAN ID in the native_vlan, the vlans of interfaces, the origin_pool and shared_pools of devices and groups, the shared_pools of static services, and in the keys of the [vlan] and pool tables.
+func resolveAliases(file string, tree *toml.Tree, aliases map[string]int64) (problems []configProblem) {
+
+	// resolve returns nil for unknown aliases, which are removed from the tree
+	resolve := func(value interface{}, position toml.Position) interface{} {
+		name, ok := value.(string)
+		if !ok {
+			return value
+		}
+		id, ok := aliases[name]
+		if !ok {
+			problems = append(problems, configProblem{file: file, position: position, message: fmt.Sprintf("unknown VLAN alias %s", name)})
+			return nil
+		}
+		return id
+	}
+	resolvePoolsIn := func(table *toml.Tree, path []string) {
+		position := table.GetPositionPath(path)
+		switch value := table.GetPath(path).(type) {
+		case string:
+			if id := resolve(value, position); id != nil {
+				table.SetPath(path, id)
+			} else {
+				table.DeletePath(path)
+				return
+			}
+		case []interface{}:
+			var pools []interface{}
+			for _, pool := range value {
+				if id := resolve(pool, position); id != nil {
+					pools = append(pools, id)
+				}
+			}
+			table.SetPath(path, pools)
+		default:
+			return
+		}
+		table.SetPositionPath(path, position)
+	}
+	resolvePools := func(path []string) {
+		resolvePoolsIn(tree, path)
+	}
+	resolveKeys := func(path []string) {
+		table, ok := tree.GetPath(path).(*toml.Tree)
+		if !ok {
+			return
+		}
+		for _, key := range table.Keys() {
+			if _, err := strconv.Atoi(key); err == nil {
+				continue
+			}
+			id, ok := resolve(key, table.GetPosition(key)).(int64)
+			if !ok {
+				continue
+			}
+			if table.Has(strconv.FormatInt(id, 10)) {
+				problems = append(problems, configProblem{file: file, position: table.GetPosition(key), message: fmt.Sprintf("VLAN alias %s refers to %d which is also configured", key, id)})
+				continue
+			}
+			value := table.Get(key)
+			table.Delete(key)
+			table.Set(strconv.FormatInt(id, 10), value)
+		}
+	}
+
+	resolvePools([]string{"native_vlan"})
+	resolveKeys([]string{"vlan"})
+	resolveKeys([]string{"dns_gateway", "pools"})
+	for _, section := range []string{"devices", "groups"} {
+		table, ok := tree.Get(section).(*toml.Tree)
+		if !ok {
+			continue
+		}
+		for _, key := range table.Keys() {
+			resolvePools([]string{section, key, "origin_pool"})
+			resolvePools([]string{section, key, "shared_pools"})
+			resolveKeys([]string{section, key, "pool"})
+		}
+	}
+	staticTables, _ := tree.Get("static_services").([]*toml.Tree)
+	for _, table := range staticTables {
+		resolvePoolsIn(table, []string{"shared_pools"})
+	}
+	interfaceTables, _ := tree.Get("interfaces").([]*toml.Tree)
+	for _, table := range interfaceTables {
+		resolvePoolsIn(table, []string{"vlans"})
+	}
+	return problems
+}
+
+// expandGroups adds the shared pools of the group of each device to its own shared pools.
+func expandGroups(files configFiles, cfg *config) (problems []configProblem) {
+	for _, mac := range sortedMacs(cfg.Devices, nil) {
+		device := cfg.Devices[mac]
+		if device.Group == "" {
+			continue
+		}
+		group, ok := cfg.Groups[device.Group]
+		if !ok {
+			problems = append(problems, files.problemAt([]string{"devices", string(mac), "group"}, fmt.Sprintf("device %s refers to unknown group %s", mac, device.Group)))
+			continue
+		}
+		sharedPools := append([]uint16{}, device.SharedPools...)
+		for _, pool := range group.SharedPools {
+			if !slices.Contains(sharedPools, pool) {
+				sharedPools = append(sharedPools, pool)
+			}
+		}
+		device.SharedPools = sharedPools
+		cfg.Devices[mac] = device
+	}
+	return problems
 }
 
 func mapByPool(devices map[macAddress]multicastDevice) map[uint16]([]uint16) {
@@ -91,6 +580,167 @@ func mapIpSourceByVlan(vlanipsource map[vlanID]vlanIpSource) map[uint16](net.IP)
 	return vlanMap
 }
 
+// stripNetworks returns the networks of strip_addresses, entries which are not a CIDR are skipped,
+// the check command reports them.
+func stripNetworks(cfg config) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, address := range cfg.StripAddresses {
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			logrus.Errorf("cannot decode %s in strip_addresses to a network", address)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// mapIp6SourceByVlan returns the ip6_source of the VLANs which have one.
+func mapIp6SourceByVlan(vlanipsource map[vlanID]vlanIpSource) map[uint16]net.IP {
+	vlanMap := make(map[uint16]net.IP)
+	for vlan, value := range vlanipsource {
+		vlanID, err := strconv.Atoi(string(vlan))
+		if err != nil || value.Ip6Source == nil {
+			continue
+		}
+		vlanMap[uint16(vlanID)] = value.Ip6Source
+	}
+	return vlanMap
+}
+
+// mapInterfaceByVlan returns the trunk interface of every VLAN in interfaces. Without interfaces, the VLANs
+// in the [vlan] table are on net_interface.
+func mapInterfaceByVlan(cfg config) map[uint16]string {
+	interfaceMap := make(map[uint16]string)
+	if len(cfg.Interfaces) != 0 {
+		for _, trunk := range cfg.Interfaces {
+			for _, vlan := range trunk.Vlans {
+				if _, ok := interfaceMap[vlan]; !ok {
+					interfaceMap[vlan] = trunk.Name
+				}
+			}
+		}
+		return interfaceMap
+	}
+	for vlan := range cfg.VlanIPSource {
+		vlanID, err := strconv.Atoi(string(vlan))
+		if err != nil {
+			continue
+		}
+		interfaceMap[uint16(vlanID)] = cfg.NetInterface
+	}
+	return interfaceMap
+}
+
+// maxCoalesceWindow is the longest coalesce_window, queriers repeat a query after one second.
+var maxCoalesceWindow = time.Second
+
+// parseCoalesceWindow parses coalesce_window, an empty value disables the coalescing of queries.
+func parseCoalesceWindow(window string) (time.Duration, error) {
+	if window == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 || d > maxCoalesceWindow {
+		return 0, fmt.Errorf("expected a duration between 1ms and %s, like 100ms", maxCoalesceWindow)
+	}
+	return d, nil
+}
+
+// gatewayDomain returns the domain of the DNS gateway without a trailing dot.
+func (gateway dnsGateway) gatewayDomain() string {
+	if gateway.Domain == "" {
+		return "home.arpa"
+	}
+	return strings.ToLower(strings.Trim(gateway.Domain, "."))
+}
+
+// gatewaySubnet is a client subnet of the DNS gateway, its clients get the devices shared with the VLAN.
+type gatewaySubnet struct {
+	network *net.IPNet
+	vlan    uint16
+}
+
+// gatewaySubnets returns the client subnets of the DNS gateway, the longest prefixes first.
+// Entries which cannot be parsed are skipped, the check command reports them.
+func gatewaySubnets(cfg config) []gatewaySubnet {
+	var subnets []gatewaySubnet
+	for vlan, networks := range cfg.DNSGateway.Pools {
+		vlanID, err := strconv.Atoi(string(vlan))
+		if err != nil {
+			continue
+		}
+		for _, subnet := range networks {
+			_, network, err := net.ParseCIDR(subnet)
+			if err != nil {
+				logrus.Errorf("cannot decode %s in dns_gateway pool %s to a network", subnet, vlan)
+				continue
+			}
+			subnets = append(subnets, gatewaySubnet{network, uint16(vlanID)})
+		}
+	}
+	sort.SliceStable(subnets, func(i, j int) bool {
+		iOnes, _ := subnets[i].network.Mask.Size()
+		jOnes, _ := subnets[j].network.Mask.Size()
+		if iOnes != jOnes {
+			return iOnes > jOnes
+		}
+		return subnets[i].vlan < subnets[j].vlan
+	})
+	return subnets
+}
+
+// mapRateLimitByVlan returns the max_packets_per_second of the VLANs which override it.
+func mapRateLimitByVlan(cfg config) map[uint16]int {
+	limitMap := make(map[uint16]int)
+	for vlan, value := range cfg.VlanIPSource {
+		vlanID, err := strconv.Atoi(string(vlan))
+		if err != nil || value.MaxPacketsPerSecond == 0 {
+			continue
+		}
+		limitMap[uint16(vlanID)] = value.MaxPacketsPerSecond
+	}
+	return limitMap
+}
+
+func mapPrivacyByVlan(cfg config) map[uint16]privacyRules {
+	privacyMap := make(map[uint16]privacyRules)
+	for vlan, value := range cfg.VlanIPSource {
+		vlanID, err := strconv.Atoi(string(vlan))
+		if err != nil || value.Privacy.isEmpty() {
+			continue
+		}
+		privacyMap[uint16(vlanID)] = value.Privacy
+	}
+	return privacyMap
+}
+
+func mapSSDPUnicastTargetByVlan(cfg config) map[uint16]macAddress {
+	targetMap := make(map[uint16]macAddress)
+	for vlan, value := range cfg.VlanIPSource {
+		vlanID, err := strconv.Atoi(string(vlan))
+		if err != nil || value.SSDPUnicastTarget == "" {
+			continue
+		}
+		targetMap[uint16(vlanID)] = value.SSDPUnicastTarget
+	}
+	return targetMap
+}
+
+// interfaces returns the trunk interfaces to open: the names in interfaces, or else net_interface.
+func (cfg config) interfaces() []string {
+	if len(cfg.Interfaces) == 0 {
+		return []string{cfg.NetInterface}
+	}
+	var names []string
+	for _, trunk := range cfg.Interfaces {
+		if !slices.Contains(names, trunk.Name) {
+			names = append(names, trunk.Name)
+		}
+	}
+	return names
+}
+
 func mapLowerCaseMac(devices map[macAddress]multicastDevice) map[macAddress]multicastDevice {
 	newDevices := make(map[macAddress]multicastDevice)
 	for mac, device := range devices {
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"testing"
@@ -60,3 +62,187 @@ func TestMapByPool(t *testing.T) {
 		t.Error("Error in mapByPool()")
 	}
 }
+
+func TestReadConfigAliasesAndGroups(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(configFile, []byte(`net_interface = "test0"
+
+[aliases]
+media = 100
+clients = 101
+iot = 103
+
+[groups.media]
+shared_pools = ["clients", "iot"]
+
+[devices."00:14:22:01:23:45"]
+origin_pool = "media"
+group = "media"
+
+[devices."00:14:22:01:23:46"]
+origin_pool = "iot"
+shared_pools = ["clients", 104]
+group = "media"
+
+[vlan.media]
+ip_source = "192.168.100.2"
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	computedCfg, err := readConfig(configFile)
+	if err != nil {
+		t.Fatalf("Error in readConfig(): %v", err)
+	}
+	expectedDevices := map[macAddress]multicastDevice{
+		"00:14:22:01:23:45": {OriginPool: 100, SharedPools: []uint16{101, 103}, Group: "media"},
+		"00:14:22:01:23:46": {OriginPool: 103, SharedPools: []uint16{101, 104, 103}, Group: "media"},
+	}
+	if !reflect.DeepEqual(expectedDevices, computedCfg.Devices) {
+		t.Errorf("Error in readConfig(): aliases and groups were not expanded: %v", computedCfg.Devices)
+	}
+	if _, ok := computedCfg.VlanIPSource["100"]; !ok {
+		t.Error("Error in readConfig(): alias in [vlan] table was not resolved")
+	}
+}
+
+func TestInterfaces(t *testing.T) {
+	cfg := config{
+		Interfaces: []trunkInterface{
+			{Name: "bond0", Vlans: []uint16{100, 300, 400}},
+			{Name: "bond1", Vlans: []uint16{200, 201}},
+		},
+		VlanIPSource: map[vlanID]vlanIpSource{
+			"100": {IpSource: net.ParseIP("192.168.100.2")},
+			"200": {IpSource: net.ParseIP("192.168.200.2"), Ip6Source: net.ParseIP("fd00:200::2")},
+			"201": {IpSource: net.ParseIP("192.168.201.2")},
+			"300": {IpSource: net.ParseIP("192.168.30.2")},
+		},
+	}
+
+	if interfaces := cfg.interfaces(); !reflect.DeepEqual(interfaces, []string{"bond0", "bond1"}) {
+		t.Errorf("Error in interfaces(): got %v", interfaces)
+	}
+	expectedInterfaces := map[uint16]string{100: "bond0", 200: "bond1", 201: "bond1", 300: "bond0", 400: "bond0"}
+	if interfaceMap := mapInterfaceByVlan(cfg); !reflect.DeepEqual(interfaceMap, expectedInterfaces) {
+		t.Errorf("Error in mapInterfaceByVlan(): got %v", interfaceMap)
+	}
+
+	p := newPolicy(cfg)
+	if name := p.interfaceOf(400); name != "bond0" {
+		t.Errorf("Error in interfaceOf(): VLAN without [vlan] table should be on its interface, got %s", name)
+	}
+	if name := p.interfaceOf(500); name != "" {
+		t.Errorf("Error in interfaceOf(): VLAN which is not in interfaces should be on no interface, got %s", name)
+	}
+	if _, ok := p.vlanOf("bond1", &[]uint16{400}[0]); ok {
+		t.Error("Error in vlanOf(): accepted VLAN 400 on bond1")
+	}
+	single := newPolicy(config{NetInterface: "eth0"})
+	if name := single.interfaceOf(500); name != "eth0" || !reflect.DeepEqual(single.cfg.interfaces(), []string{"eth0"}) {
+		t.Errorf("Error in interfaceOf(): without interfaces every VLAN should be on net_interface, got %s", name)
+	}
+	if vlanIPMap := p.vlanIPsOn("bond1"); len(vlanIPMap) != 2 || vlanIPMap[200] == nil || vlanIPMap[201] == nil {
+		t.Errorf("Error in vlanIPsOn(): got %v", vlanIPMap)
+	}
+
+	bond1 := &trunk{name: "bond1", ipv6Address: net.ParseIP("fe80::1")}
+	if ip := bond1.sourceIP(p, 200, true); !ip.Equal(net.ParseIP("fd00:200::2")) {
+		t.Errorf("Error in sourceIP(): expected the ip6_source of VLAN 200, got %s", ip)
+	}
+	if ip := bond1.sourceIP(p, 201, true); !ip.Equal(bond1.ipv6Address) {
+		t.Errorf("Error in sourceIP(): expected the link-local address for VLAN 201, got %s", ip)
+	}
+	if ip := bond1.sourceIP(p, 201, false); !ip.Equal(net.ParseIP("192.168.201.2")) {
+		t.Errorf("Error in sourceIP(): expected the ip_source of VLAN 201, got %s", ip)
+	}
+
+	moved := cfg
+	moved.Interfaces = []trunkInterface{
+		{Name: "bond0", Vlans: []uint16{100, 201, 300, 400}},
+		{Name: "bond1", Vlans: []uint16{200}},
+	}
+	expectedChanges := []string{"interfaces changed from [bond0 bond1] to [bond0 bond1]", "vlan 201 moved from interface bond1 to bond0"}
+	if changes := diffConfig(cfg, moved); !reflect.DeepEqual(changes, expectedChanges) {
+		t.Errorf("Error in diffConfig(): got %q", changes)
+	}
+}
+
+func TestReadConfigIncludes(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, content string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("config.toml", `net_interface = "test0"
+include = ["devices.d/*.toml"]
+
+[aliases]
+media = 100
+
+[vlan.101]
+ip_source = "192.168.101.2"
+`)
+	writeFile("devices.d/tv.toml", `[devices."00:14:22:01:23:45"]
+origin_pool = "media"
+shared_pools = [101]
+`)
+	writeFile("devices.d/speakers.toml", `[devices."00:14:22:01:23:46"]
+origin_pool = "media"
+shared_pools = [101]
+
+[vlan.101]
+ip_source = "192.168.101.2"
+`)
+
+	cfg, err := readConfig(filepath.Join(dir, "config.toml"))
+	if err != nil {
+		t.Fatalf("Error in readConfig(): %v", err)
+	}
+	if len(cfg.Devices) != 2 || cfg.Devices["00:14:22:01:23:46"].OriginPool != 100 || len(cfg.VlanIPSource) != 1 {
+		t.Errorf("Error in readConfig(): included files were not merged: %+v", cfg)
+	}
+
+	// The same MAC address and a different ip_source for the same VLAN are conflicts
+	writeFile("devices.d/tv2.toml", `[devices."00:14:22:01:23:45"]
+origin_pool = "media"
+shared_pools = [101]
+
+[vlan.101]
+ip_source = "192.168.101.3"
+`)
+	files, err := loadConfigFiles(filepath.Join(dir, "config.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var computedResult []string
+	for _, problem := range checkConfigFiles(files) {
+		computedResult = append(computedResult, problem.String())
+	}
+	copyFile := filepath.Join(dir, "devices.d", "tv2.toml")
+	expectedResult := []string{
+		copyFile + ":1:1: device 00:14:22:01:23:45 is also defined in " + filepath.Join(dir, "devices.d", "tv.toml"),
+		copyFile + ":5:1: vlan 101 is configured differently in " + filepath.Join(dir, "config.toml"),
+	}
+	if !reflect.DeepEqual(expectedResult, computedResult) {
+		t.Errorf("Error in checkConfigFiles(): got\n%q", computedResult)
+	}
+
+	// In directory mode every file in the directory is merged, with the files they include
+	cfg, err = readConfig(dir)
+	if err == nil {
+		t.Errorf("Error in readConfig(): expected the conflict in the directory to be reported, got %+v", cfg)
+	}
+	if err := os.Remove(copyFile); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = readConfig(dir); err != nil || len(cfg.Devices) != 2 {
+		t.Errorf("Error in readConfig(): directory mode got %+v, %v", cfg, err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+)
+
+// macPattern is a MAC address in which some octets may be a wildcard.
+// "aa:bb:cc" is an OUI prefix, and the same as "aa:bb:cc:*:*:*".
+type macPattern struct {
+	value    net.HardwareAddr
+	wildcard [6]bool
+}
+
+func parseMacPattern(pattern string) (macPattern, error) {
+	octets := strings.FieldsFunc(strings.ToLower(pattern), func(r rune) bool { return r == ':' || r == '-' })
+	if len(octets) < 3 || len(octets) > 6 {
+		return macPattern{}, errors.New("expected a MAC address, an OUI prefix or a MAC address with * wildcards")
+	}
+	parsed := macPattern{value: make(net.HardwareAddr, 6)}
+	for i := range parsed.wildcard {
+		if i >= len(octets) || octets[i] == "*" {
+			parsed.wildcard[i] = true
+			continue
+		}
+		octet, err := hex.DecodeString(octets[i])
+		if err != nil || len(octet) != 1 {
+			return macPattern{}, errors.New("invalid octet " + octets[i])
+		}
+		parsed.value[i] = octet[0]
+	}
+	return parsed, nil
+}
+
+func (pattern macPattern) isExact() bool {
+	return pattern.wildcard == [6]bool{}
+}
+
+func (pattern macPattern) matches(mac net.HardwareAddr) bool {
+	if len(mac) != 6 {
+		return false
+	}
+	for i := range pattern.wildcard {
+		if !pattern.wildcard[i] && mac[i] != pattern.value[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseAddress parses an IP address or a CIDR network.
+func parseAddress(address string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(address); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, errors.New("expected an IP address or a CIDR network")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// deviceMatcher finds the device entry a packet belongs to. A device matches on
+// its key or one of its 'macs' when they are MAC addresses, OUI prefixes or wildcards,
+// on one of its 'addresses', or on one of its 'hostnames' advertised in mDNS responses.
+// Any host can advertise a name, so a device only matches on its hostnames when it
+// has no MAC address or network to match on, and then trusts the claim of the name.
+type deviceMatcher struct {
+	devices   map[macAddress]multicastDevice
+	byMAC     map[string]macAddress
+	patterns  []matchRule[macPattern]
+	networks  []matchRule[*net.IPNet]
+	hostnames map[string]macAddress
+	// claims are the hostnames of the devices without a MAC address or network
+	claims map[string]macAddress
+}
+
+type matchRule[T any] struct {
+	match  T
+	device macAddress
+}
+
+// newDeviceMatcher builds the matcher from the devices returned by mapLowerCaseMac.
+// Invalid patterns are skipped, they are reported by the check command.
+func newDeviceMatcher(devices map[macAddress]multicastDevice) *deviceMatcher {
+	matcher := &deviceMatcher{
+		devices:   devices,
+		byMAC:     make(map[string]macAddress),
+		hostnames: make(map[string]macAddress),
+		claims:    make(map[string]macAddress),
+	}
+	for _, key := range sortedMacs(devices, nil) {
+		device := devices[key]
+		// A device with a MAC address or a network only matches on those
+		identified := false
+		for _, mac := range append([]string{string(key)}, device.Macs...) {
+			pattern, err := parseMacPattern(mac)
+			if err != nil {
+				continue
+			}
+			identified = true
+			if pattern.isExact() {
+				matcher.byMAC[pattern.value.String()] = key
+			} else {
+				matcher.patterns = append(matcher.patterns, matchRule[macPattern]{pattern, key})
+			}
+		}
+		for _, address := range device.Addresses {
+			if network, err := parseAddress(address); err == nil {
+				matcher.networks = append(matcher.networks, matchRule[*net.IPNet]{network, key})
+				identified = true
+			}
+		}
+		for _, hostname := range device.Hostnames {
+			matcher.hostnames[normalizeHostname(hostname)] = key
+			if !identified {
+				matcher.claims[normalizeHostname(hostname)] = key
+			}
+		}
+	}
+	return matcher
+}
+
+// match returns the key and the settings of the device which sent the packet.
+func (matcher *deviceMatcher) match(packet *multicastPacket) (macAddress, multicastDevice, bool) {
+	key, ok := matcher.matchKey(packet)
+	if !ok {
+		return "", multicastDevice{}, false
+	}
+	return key, matcher.devices[key], true
+}
+
+func (matcher *deviceMatcher) matchKey(packet *multicastPacket) (macAddress, bool) {
+	if packet.srcMAC != nil {
+		if key, ok := matcher.byMAC[packet.srcMAC.String()]; ok {
+			return key, true
+		}
+		for _, rule := range matcher.patterns {
+			if rule.match.matches(*packet.srcMAC) {
+				return rule.device, true
+			}
+		}
+	}
+	if packet.srcIP != nil {
+		for _, rule := range matcher.networks {
+			if rule.match.Contains(*packet.srcIP) {
+				return rule.device, true
+			}
+		}
+	}
+	if len(matcher.claims) > 0 && packet.isDNSResponse {
+		if msg, err := parseDNSMessage(packet.payload); err == nil {
+			for _, name := range advertisedNames(msg) {
+				if key, ok := matcher.claims[name]; ok {
+					return key, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// advertisedNames returns the host names and service instance names in an mDNS response.
+func advertisedNames(msg *dnsMessage) (names []string) {
+	for _, section := range [][]dnsRecord{msg.answers, msg.additionals} {
+		for _, rr := range section {
+			switch rr.rtype {
+			case dnsTypeA, dnsTypeAAAA, dnsTypeSRV, dnsTypeTXT:
+				names = append(names, normalizeHostname(rr.name))
+			}
+		}
+	}
+	return names
+}
+
+// normalizeHostname returns the first label of a name in lower case, so "Living Room TV._googlecast._tcp.local",
+// "living room tv" and "TV.local" become "living room tv" and "tv".
+func normalizeHostname(name string) string {
+	labels := splitDNSName(name)
+	if len(labels) == 0 {
+		return ""
+	}
+	return strings.ToLower(labels[0])
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDeviceMatcher(t *testing.T) {
+	matcher := newDeviceMatcher(mapLowerCaseMac(map[macAddress]multicastDevice{
+		"00:14:22:01:23:45": {Description: "Test Chromecast", OriginPool: 45, Macs: []string{"00:14:22:01:23:46"}},
+		"printers":          {Description: "Test printers", OriginPool: 46, Macs: []string{"3C:2A:F4"}},
+		"speakers":          {Description: "Test speakers", OriginPool: 47, Macs: []string{"b8:27:eb:*:*:0a"}},
+		"nas":               {Description: "Test NAS", OriginPool: 48, Addresses: []string{"192.168.48.0/24", "fd00::48"}},
+		"tv":                {Description: "Test TV", OriginPool: 49, Hostnames: []string{"Living Room TV"}},
+		"speaker":           {Description: "Test speaker", OriginPool: 49, Macs: []string{"02:00:00:00:00:05"}, Hostnames: []string{"Kitchen"}},
+	}))
+
+	mdnsResponse := (&dnsMessage{flags: dnsFlagResponse, answers: []dnsRecord{
+		{name: "Living Room TV._airplay._tcp.local", rtype: dnsTypeTXT, class: dnsClassIN, ttl: 4500, rdata: []byte{0}},
+	}}).pack()
+	spoofedResponse := (&dnsMessage{flags: dnsFlagResponse, answers: []dnsRecord{
+		{name: "kitchen.local", rtype: dnsTypeA, class: dnsClassIN, ttl: 120, rdata: []byte{192, 168, 49, 4}},
+	}}).pack()
+
+	testCases := []struct {
+		mac      string
+		ip       string
+		payload  []byte
+		expected macAddress
+	}{
+		{"00:14:22:01:23:45", "192.168.45.2", nil, "00:14:22:01:23:45"},
+		{"00:14:22:01:23:46", "192.168.45.3", nil, "00:14:22:01:23:45"},
+		{"3c:2a:f4:11:22:33", "192.168.46.2", nil, "printers"},
+		{"b8:27:eb:11:22:0a", "192.168.47.2", nil, "speakers"},
+		{"b8:27:eb:11:22:0b", "192.168.47.3", nil, ""},
+		{"02:00:00:00:00:01", "192.168.48.20", nil, "nas"},
+		{"02:00:00:00:00:02", "fd00::48", nil, "nas"},
+		{"02:00:00:00:00:03", "192.168.49.2", mdnsResponse, "tv"},
+		{"02:00:00:00:00:04", "192.168.49.3", nil, ""},
+		{"02:00:00:00:00:05", "192.168.49.4", spoofedResponse, "speaker"},
+		{"02:00:00:00:00:06", "192.168.49.5", spoofedResponse, ""},
+	}
+
+	for _, testCase := range testCases {
+		mac, _ := net.ParseMAC(testCase.mac)
+		ip := net.ParseIP(testCase.ip)
+		packet := multicastPacket{srcMAC: &mac, srcIP: &ip, payload: testCase.payload, isDNSResponse: testCase.payload != nil}
+
+		key, _, ok := matcher.match(&packet)
+		if key != testCase.expected || ok != (testCase.expected != "") {
+			t.Errorf("Error in match() for %s %s: expected %q, got %q", testCase.mac, testCase.ip, testCase.expected, key)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// gatewayServer answers unicast DNS queries from routed networks, which cannot receive mDNS, from the mDNS
+// cache (RFC 6763 wide-area DNS-SD, like the discovery proxy of RFC 8766). The names of the devices are
+// served under the domain of dns_gateway instead of .local, to the clients of the subnets in its pools.
+type gatewayServer struct {
+	policies *policyStore
+	cache    *mdnsCache
+	renames  *instanceRenames
+	// queries asks the mDNS processor to query the devices when the cache has no answer
+	queries chan<- gatewayQuery
+}
+
+// gatewayQuery is a question the mDNS processor forwards to the origin VLANs of the devices shared with the VLAN.
+type gatewayQuery struct {
+	vlan     uint16
+	question dnsQuestion
+}
+
+// gatewayQueryWait is how long the gateway waits for the answers of the devices to a query it asked for.
+var gatewayQueryWait = 500 * time.Millisecond
+
+// gatewayStripNetworks are the addresses which are never served, routed clients cannot reach them.
+var gatewayStripNetworks = []*net.IPNet{
+	{IP: net.ParseIP("fe80::"), Mask: net.CIDRMask(10, 128)},
+	{IP: net.IPv4(169, 254, 0, 0).To4(), Mask: net.CIDRMask(16, 32)},
+}
+
+const (
+	dnsTypeOPT = 41
+
+	dnsRcodeFormatError    = 1
+	dnsRcodeNotImplemented = 4
+	dnsRcodeRefused        = 5
+
+	dnsFlagRecursionDesired = 0x0100
+	dnsOpcodeMask           = 0x7800
+)
+
+// serveDNSGateway listens for DNS queries on UDP and TCP at the address, it only returns when it cannot listen.
+func serveDNSGateway(address string, policies *policyStore, cache *mdnsCache, renames *instanceRenames, queries chan<- gatewayQuery) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	server := &gatewayServer{policies: policies, cache: cache, renames: renames, queries: queries}
+	logrus.Infof("DNS gateway listening on %s", address)
+	go server.serveTCP(listener)
+	server.serveUDP(conn)
+	return nil
+}
+
+func (server *gatewayServer) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			logrus.Errorf("DNS gateway stopped: %v", err)
+			return
+		}
+		payload := append([]byte{}, buf[:n]...)
+		go func(addr net.Addr) {
+			client := addr.(*net.UDPAddr).IP
+			if response := server.handle(payload, client, false); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}(addr)
+	}
+}
+
+func (server *gatewayServer) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logrus.Errorf("DNS gateway stopped accepting TCP connections: %v", err)
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			client := conn.RemoteAddr().(*net.TCPAddr).IP
+			for {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				payload := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, payload); err != nil {
+					return
+				}
+				response := server.handle(payload, client, true)
+				if response == nil {
+					return
+				}
+				if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...)); err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+}
+
+// handle returns the response to a DNS query from the client, or nil when the payload is not a query.
+func (server *gatewayServer) handle(payload []byte, client net.IP, overTCP bool) []byte {
+	query, err := parseDNSMessage(payload)
+	if err != nil || query.isResponse() {
+		return nil
+	}
+	response := &dnsMessage{
+		id:        query.id,
+		flags:     dnsFlagResponse | query.flags&(dnsOpcodeMask|dnsFlagRecursionDesired),
+		questions: query.questions,
+	}
+	maxSize := 512
+	for _, rr := range query.additionals {
+		if rr.rtype == dnsTypeOPT {
+			// EDNS(0), the class is the UDP payload size of the client
+			maxSize = max(int(rr.class), maxSize)
+			response.additionals = append(response.additionals, dnsRecord{rtype: dnsTypeOPT, class: 1232})
+		}
+	}
+	if overTCP {
+		maxSize = 65535
+	}
+
+	active := server.policies.Load()
+	domain := active.cfg.DNSGateway.gatewayDomain()
+	vlan, ok := active.gatewayPool(client)
+	switch {
+	case query.flags&dnsOpcodeMask != 0:
+		response.flags |= dnsRcodeNotImplemented
+	case !ok:
+		logrus.Debugf("Refused DNS query from %s, which is not in a dns_gateway pool", client)
+		response.flags |= dnsRcodeRefused
+	case len(query.questions) != 1:
+		response.flags |= dnsRcodeFormatError
+	case !inDomain(query.questions[0].name, domain):
+		response.flags |= dnsRcodeRefused
+	default:
+		response.flags |= dnsFlagAuthoritative
+		response.answers, response.additionals = server.answer(active, vlan, query.questions[0], domain, response.additionals)
+	}
+
+	packed := response.pack()
+	if len(packed) > maxSize {
+		// The additional records are optional, without the answers the client retries over TCP
+		response.additionals = filterRecords(response.additionals, func(rr dnsRecord) bool { return rr.rtype == dnsTypeOPT })
+		if packed = response.pack(); len(packed) > maxSize {
+			response.answers = nil
+			response.flags |= dnsFlagTruncated
+			packed = response.pack()
+		}
+	}
+	return packed
+}
+
+// answer returns the records for the question in the domain, and the additional records after 'additionals'.
+func (server *gatewayServer) answer(active *policy, vlan uint16, question dnsQuestion, domain string, additionals []dnsRecord) ([]dnsRecord, []dnsRecord) {
+	name := strings.ToLower(strings.TrimSuffix(question.name, "."))
+	// The browsing domains of RFC 6763 section 11 point at the domain itself
+	for _, browse := range []string{"b._dns-sd._udp.", "db._dns-sd._udp.", "lb._dns-sd._udp."} {
+		if name == browse+domain && (question.qtype == dnsTypePTR || question.qtype == dnsTypeANY) {
+			return []dnsRecord{{name: question.name, rtype: dnsTypePTR, class: dnsClassIN, ttl: 3600, rdata: appendDNSName(nil, domain, nil, 0)}}, additionals
+		}
+	}
+
+	mdnsName := server.renames.original(vlan, translateDNSName(question.name, domain, "local"))
+	mdnsQuery := &dnsMessage{questions: []dnsQuestion{{name: mdnsName, qtype: question.qtype, qclass: dnsClassIN}}}
+	msg, ok := server.cache.answer(mdnsQuery, time.Now(), sharedWith(active, nil, vlan, time.Now()))
+	if !ok {
+		select {
+		case server.queries <- gatewayQuery{vlan: vlan, question: mdnsQuery.questions[0]}:
+		default:
+		}
+		time.Sleep(gatewayQueryWait)
+		if msg, ok = server.cache.answer(mdnsQuery, time.Now(), sharedWith(active, nil, vlan, time.Now())); !ok {
+			return nil, additionals
+		}
+	}
+	msg = stripAddresses(msg, append(append([]*net.IPNet{}, gatewayStripNetworks...), active.stripNetworks...))
+
+	translate := func(records []dnsRecord) []dnsRecord {
+		var translated []dnsRecord
+		for _, rr := range records {
+			translated = append(translated, translateRecord(rr, "local", domain))
+		}
+		return translated
+	}
+	return translate(msg.answers), append(additionals, translate(msg.additionals)...)
+}
+
+// inDomain reports whether the name is the domain or a name in it.
+func inDomain(name, domain string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// translateDNSName replaces the domain 'from' at the end of the name by 'to'.
+func translateDNSName(name, from, to string) string {
+	trimmed := strings.TrimSuffix(name, ".")
+	if len(trimmed) > len(from) && strings.EqualFold(trimmed[len(trimmed)-len(from):], from) && trimmed[len(trimmed)-len(from)-1] == '.' {
+		return trimmed[:len(trimmed)-len(from)] + to
+	}
+	if strings.EqualFold(trimmed, from) {
+		return to
+	}
+	return name
+}
+
+// translateRecord moves the record and the names in its data from the domain 'from' to 'to', as a unicast DNS record.
+func translateRecord(rr dnsRecord, from, to string) dnsRecord {
+	rr = mapRecordNames(rr, func(name string) string { return translateDNSName(name, from, to) })
+	rr.class &^= dnsClassCacheFlush
+	return rr
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDNSGateway(t *testing.T) {
+	cfg := config{
+		Devices: map[macAddress]multicastDevice{
+			"aa:bb:cc:dd:ee:ff": {OriginPool: 100, SharedPools: []uint16{101}, Services: []string{"_googlecast._tcp"}},
+		},
+		DNSGateway: dnsGateway{
+			Listen: "127.0.0.1:53",
+			Pools:  map[vlanID][]string{"101": {"10.8.0.0/24"}, "102": {"10.9.0.0/24"}},
+		},
+	}
+	queries := make(chan gatewayQuery, 1)
+	server := &gatewayServer{policies: newPolicyStore(newPolicy(cfg)), cache: newMDNSCache(), renames: newInstanceRenames(), queries: queries}
+	server.cache.add("aa:bb:cc:dd:ee:ff", createMockServiceResponse(), time.Now())
+	gatewayQueryWait = 0
+	defer func() { gatewayQueryWait = 500 * time.Millisecond }()
+
+	ask := func(client string, name string, qtype uint16) *dnsMessage {
+		query := &dnsMessage{id: 42, flags: dnsFlagRecursionDesired, questions: []dnsQuestion{{name: name, qtype: qtype, qclass: dnsClassIN}}}
+		response, err := parseDNSMessage(server.handle(query.pack(), net.ParseIP(client), false))
+		if err != nil {
+			t.Fatalf("Error in handle(): cannot parse the response: %v", err)
+		}
+		if response.id != 42 || !response.isResponse() {
+			t.Errorf("Error in handle(): expected a response with id 42, got %+v", response)
+		}
+		return response
+	}
+	names := func(records []dnsRecord) (names []string) {
+		for _, rr := range records {
+			names = append(names, rr.name+"/"+rr.target())
+		}
+		return names
+	}
+
+	// The records of the shared device are served under home.arpa
+	response := ask("10.8.0.5", "_googlecast._tcp.home.arpa", dnsTypePTR)
+	if response.flags&0xf != 0 || response.flags&dnsFlagAuthoritative == 0 {
+		t.Errorf("Error in handle(): expected an authoritative answer, got flags %#x", response.flags)
+	}
+	expectedAnswers := []string{"_googlecast._tcp.home.arpa/Living Room TV._googlecast._tcp.home.arpa"}
+	if computedResult := names(response.answers); !reflect.DeepEqual(expectedAnswers, computedResult) {
+		t.Errorf("Error in handle(): got answers %q", computedResult)
+	}
+	expectedAdditionals := []string{
+		"Living Room TV._googlecast._tcp.home.arpa/tv.home.arpa",
+		"Living Room TV._googlecast._tcp.home.arpa/",
+		"tv.home.arpa/",
+	}
+	if computedResult := names(response.additionals); !reflect.DeepEqual(expectedAdditionals, computedResult) {
+		t.Errorf("Error in handle(): got additionals %q", computedResult)
+	}
+	for _, rr := range append(response.answers, response.additionals...) {
+		if rr.cacheFlush() {
+			t.Errorf("Error in handle(): the cache-flush bit of %s is set in a unicast DNS response", rr.name)
+		}
+	}
+
+	// The devices which are not shared with the VLAN of the pool are asked for, and not answered
+	if response := ask("10.9.0.5", "_googlecast._tcp.home.arpa", dnsTypePTR); len(response.answers) != 0 {
+		t.Errorf("Error in handle(): answered a client of VLAN 102 with %q", names(response.answers))
+	}
+	select {
+	case query := <-queries:
+		if query.vlan != 102 || query.question.name != "_googlecast._tcp.local" {
+			t.Errorf("Error in handle(): expected a query for _googlecast._tcp.local from VLAN 102, got %+v", query)
+		}
+	default:
+		t.Error("Error in handle(): expected the gateway to ask for the missing records")
+	}
+
+	if response := ask("10.8.0.5", "b._dns-sd._udp.home.arpa", dnsTypePTR); !reflect.DeepEqual([]string{"b._dns-sd._udp.home.arpa/home.arpa"}, names(response.answers)) {
+		t.Errorf("Error in handle(): got browsing domains %q", names(response.answers))
+	}
+	if response := ask("10.8.0.5", "example.com", dnsTypeA); response.flags&0xf != dnsRcodeRefused {
+		t.Errorf("Error in handle(): expected REFUSED for a name outside the domain, got flags %#x", response.flags)
+	}
+	if response := ask("192.168.1.5", "_googlecast._tcp.home.arpa", dnsTypePTR); response.flags&0xf != dnsRcodeRefused {
+		t.Errorf("Error in handle(): expected REFUSED for a client outside the pools, got flags %#x", response.flags)
+	}
+}
+
+func TestTranslateDNSName(t *testing.T) {
+	testCases := []struct {
+		name, expected string
+	}{
+		{"tv.local", "tv.home.arpa"},
+		{"TV.LOCAL.", "TV.home.arpa"},
+		{"local", "home.arpa"},
+		{"notlocal", "notlocal"},
+		{"tv.example.com", "tv.example.com"},
+	}
+	for _, testCase := range testCases {
+		if computedResult := translateDNSName(testCase.name, "local", "home.arpa"); computedResult != testCase.expected {
+			t.Errorf("Error in translateDNSName(%s): expected %s, got %s", testCase.name, testCase.expected, computedResult)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// gopacket can decode mDNS messages, but it cannot serialize NSEC records which mDNS responders
+// add to almost every response. dnsMessage is a small codec that keeps the record data of unknown
+// types as is, and decompresses the domain names in the record data of the types that have them,
+// so records can be removed, added or rewritten before the message is packed again.
+
+const (
+	dnsTypeA     = 1
+	dnsTypeNS    = 2
+	dnsTypeCNAME = 5
+	dnsTypePTR   = 12
+	dnsTypeTXT   = 16
+	dnsTypeAAAA  = 28
+	dnsTypeSRV   = 33
+	dnsTypeNSEC  = 47
+	dnsTypeANY   = 255
+
+	dnsClassIN = 1
+	// mDNS uses the top bit of the class as cache-flush bit in records and
+	// as unicast-response bit in questions (RFC 6762 section 10.2 and 5.4)
+	dnsClassCacheFlush  = 0x8000
+	dnsClassUnicastResp = 0x8000
+
+	dnsFlagResponse      = 0x8000
+	dnsFlagAuthoritative = 0x0400
+	dnsFlagTruncated     = 0x0200
+)
+
+type dnsQuestion struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	class uint16
+	ttl   uint32
+	// rdata holds the record data, domain names in it are never compressed
+	rdata []byte
+}
+
+type dnsMessage struct {
+	id          uint16
+	flags       uint16
+	questions   []dnsQuestion
+	answers     []dnsRecord
+	authorities []dnsRecord
+	additionals []dnsRecord
+}
+
+var errDNSMessageTooShort = errors.New("dns message too short")
+
+func parseDNSMessage(payload []byte) (*dnsMessage, error) {
+	if len(payload) < 12 {
+		return nil, errDNSMessageTooShort
+	}
+	msg := &dnsMessage{
+		id:    binary.BigEndian.Uint16(payload[0:]),
+		flags: binary.BigEndian.Uint16(payload[2:]),
+	}
+	qdCount := int(binary.BigEndian.Uint16(payload[4:]))
+	anCount := int(binary.BigEndian.Uint16(payload[6:]))
+	nsCount := int(binary.BigEndian.Uint16(payload[8:]))
+	arCount := int(binary.BigEndian.Uint16(payload[10:]))
+
+	offset := 12
+	for i := 0; i < qdCount; i++ {
+		name, next, err := readDNSName(payload, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(payload) {
+			return nil, errDNSMessageTooShort
+		}
+		msg.questions = append(msg.questions, dnsQuestion{
+			name:   name,
+			qtype:  binary.BigEndian.Uint16(payload[next:]),
+			qclass: binary.BigEndian.Uint16(payload[next+2:]),
+		})
+		offset = next + 4
+	}
+
+	var err error
+	if msg.answers, offset, err = readDNSRecords(payload, offset, anCount); err != nil {
+		return nil, err
+	}
+	if msg.authorities, offset, err = readDNSRecords(payload, offset, nsCount); err != nil {
+		return nil, err
+	}
+	if msg.additionals, _, err = readDNSRecords(payload, offset, arCount); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// dnsTransactionID returns the ID of the DNS message in the payload, or 0 when the payload is too short.
+func dnsTransactionID(payload []byte) uint16 {
+	if len(payload) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(payload)
+}
+
+func readDNSRecords(payload []byte, offset int, count int) ([]dnsRecord, int, error) {
+	var records []dnsRecord
+	for i := 0; i < count; i++ {
+		name, next, err := readDNSName(payload, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		if next+10 > len(payload) {
+			return nil, 0, errDNSMessageTooShort
+		}
+		rr := dnsRecord{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(payload[next:]),
+			class: binary.BigEndian.Uint16(payload[next+2:]),
+			ttl:   binary.BigEndian.Uint32(payload[next+4:]),
+		}
+		length := int(binary.BigEndian.Uint16(payload[next+8:]))
+		start := next + 10
+		if start+length > len(payload) {
+			return nil, 0, errDNSMessageTooShort
+		}
+
+		switch rr.rtype {
+		case dnsTypePTR, dnsTypeCNAME, dnsTypeNS:
+			target, _, err := readDNSName(payload, start)
+			if err != nil {
+				return nil, 0, err
+			}
+			rr.rdata = appendDNSName(nil, target, nil, 0)
+		case dnsTypeSRV:
+			if length < 7 {
+				return nil, 0, errDNSMessageTooShort
+			}
+			target, _, err := readDNSName(payload, start+6)
+			if err != nil {
+				return nil, 0, err
+			}
+			rr.rdata = appendDNSName(append([]byte{}, payload[start:start+6]...), target, nil, 0)
+		case dnsTypeNSEC:
+			nextName, bitmap, err := readDNSName(payload, start)
+			if err != nil || bitmap > start+length {
+				return nil, 0, errDNSMessageTooShort
+			}
+			rr.rdata = append(appendDNSName(nil, nextName, nil, 0), payload[bitmap:start+length]...)
+		default:
+			rr.rdata = append([]byte{}, payload[start:start+length]...)
+		}
+		records = append(records, rr)
+		offset = start + length
+	}
+	return records, offset, nil
+}
+
+// readDNSName reads a possibly compressed domain name, and returns it
+// together with the offset of the first byte after the name.
+func readDNSName(payload []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(payload) {
+			return "", 0, errDNSMessageTooShort
+		}
+		length := int(payload[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return joinDNSLabels(labels), next, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(payload) {
+				return "", 0, errDNSMessageTooShort
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			jumps++
+			if jumps > 16 {
+				return "", 0, errors.New("dns name compression loop")
+			}
+			offset = int(binary.BigEndian.Uint16(payload[offset:]) & 0x3FFF)
+		case length&0xC0 != 0:
+			return "", 0, errors.New("unsupported dns label type")
+		default:
+			if offset+1+length > len(payload) {
+				return "", 0, errDNSMessageTooShort
+			}
+			labels = append(labels, string(payload[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// pack serializes the message, owner names and domain names in PTR and SRV data are compressed.
+func (msg *dnsMessage) pack() []byte {
+	buf := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(buf[0:], msg.id)
+	binary.BigEndian.PutUint16(buf[2:], msg.flags)
+	binary.BigEndian.PutUint16(buf[4:], uint16(len(msg.questions)))
+	binary.BigEndian.PutUint16(buf[6:], uint16(len(msg.answers)))
+	binary.BigEndian.PutUint16(buf[8:], uint16(len(msg.authorities)))
+	binary.BigEndian.PutUint16(buf[10:], uint16(len(msg.additionals)))
+
+	compression := make(map[string]int)
+	for _, question := range msg.questions {
+		buf = appendDNSName(buf, question.name, compression, len(buf))
+		buf = binary.BigEndian.AppendUint16(buf, question.qtype)
+		buf = binary.BigEndian.AppendUint16(buf, question.qclass)
+	}
+	for _, section := range [][]dnsRecord{msg.answers, msg.authorities, msg.additionals} {
+		for _, rr := range section {
+			buf = appendDNSName(buf, rr.name, compression, len(buf))
+			buf = binary.BigEndian.AppendUint16(buf, rr.rtype)
+			buf = binary.BigEndian.AppendUint16(buf, rr.class)
+			buf = binary.BigEndian.AppendUint32(buf, rr.ttl)
+			lengthOffset := len(buf)
+			buf = append(buf, 0, 0)
+			switch rr.rtype {
+			case dnsTypePTR, dnsTypeCNAME, dnsTypeNS:
+				buf = appendDNSName(buf, rr.target(), compression, len(buf))
+			case dnsTypeSRV:
+				buf = append(buf, rr.rdata[:6]...)
+				buf = appendDNSName(buf, rr.target(), compression, len(buf))
+			default:
+				buf = append(buf, rr.rdata...)
+			}
+			binary.BigEndian.PutUint16(buf[lengthOffset:], uint16(len(buf)-lengthOffset-2))
+		}
+	}
+	return buf
+}
+
+// appendDNSName appends the name in wire format. When compression is not nil, suffixes
+// which were written before are replaced by a pointer, and new suffixes are remembered
+// at their offset in the message, which starts at 'offset'.
+func appendDNSName(buf []byte, name string, compression map[string]int, offset int) []byte {
+	labels := splitDNSName(name)
+	for i := range labels {
+		if compression != nil {
+			suffix := joinDNSLabels(labels[i:])
+			if pointer, ok := compression[suffix]; ok {
+				return binary.BigEndian.AppendUint16(buf, uint16(0xC000|pointer))
+			}
+			if offset < 0x3FFF {
+				compression[suffix] = offset
+			}
+		}
+		label := labels[i]
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+		offset += 1 + len(label)
+	}
+	return append(buf, 0)
+}
+
+// splitDNSName splits a name in presentation format into labels, "\." and "\\" are a dot and a
+// backslash inside a label.
+func splitDNSName(name string) []string {
+	var labels []string
+	var label strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch {
+		case name[i] == '\\' && i+1 < len(name):
+			i++
+			label.WriteByte(name[i])
+		case name[i] == '.':
+			if label.Len() > 0 {
+				labels = append(labels, label.String())
+			}
+			label.Reset()
+		default:
+			label.WriteByte(name[i])
+		}
+	}
+	if label.Len() > 0 {
+		labels = append(labels, label.String())
+	}
+	return labels
+}
+
+func joinDNSLabels(labels []string) string {
+	escaped := make([]string, len(labels))
+	for i, label := range labels {
+		escaped[i] = strings.ReplaceAll(strings.ReplaceAll(label, `\`, `\\`), ".", `\.`)
+	}
+	return strings.Join(escaped, ".")
+}
+
+// target returns the domain name in the data of PTR, CNAME, NS, SRV and NSEC records.
+func (rr dnsRecord) target() string {
+	offset := 0
+	switch rr.rtype {
+	case dnsTypePTR, dnsTypeCNAME, dnsTypeNS, dnsTypeNSEC:
+	case dnsTypeSRV:
+		offset = 6
+	default:
+		return ""
+	}
+	if len(rr.rdata) <= offset {
+		return ""
+	}
+	name, _, err := readDNSName(rr.rdata, offset)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// ip returns the address of A and AAAA records.
+func (rr dnsRecord) ip() net.IP {
+	switch {
+	case rr.rtype == dnsTypeA && len(rr.rdata) == net.IPv4len:
+		return net.IP(rr.rdata)
+	case rr.rtype == dnsTypeAAAA && len(rr.rdata) == net.IPv6len:
+		return net.IP(rr.rdata)
+	}
+	return nil
+}
+
+func (rr dnsRecord) cacheFlush() bool {
+	return rr.class&dnsClassCacheFlush != 0
+}
+
+func (question dnsQuestion) unicastResponse() bool {
+	return question.qclass&dnsClassUnicastResp != 0
+}
+
+func (msg *dnsMessage) isResponse() bool {
+	return msg.flags&dnsFlagResponse != 0
+}
+
+// copyMessage returns a copy of the message with its own record slices.
+func (msg *dnsMessage) copyMessage() *dnsMessage {
+	copied := *msg
+	copied.questions = append([]dnsQuestion{}, msg.questions...)
+	copied.answers = append([]dnsRecord{}, msg.answers...)
+	copied.authorities = append([]dnsRecord{}, msg.authorities...)
+	copied.additionals = append([]dnsRecord{}, msg.additionals...)
+	return &copied
+}
+
+// equalDNSNames compares two names in presentation format, ignoring case and a trailing dot.
+func equalDNSNames(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+const dnssdServicesName = "_services._dns-sd._udp.local"
+
+// normalizeServiceType turns "_googlecast._tcp", "_googlecast._tcp." and "_googlecast._tcp.local"
+// into "_googlecast._tcp.local".
+func normalizeServiceType(service string) string {
+	service = strings.ToLower(strings.TrimSuffix(service, "."))
+	if !strings.HasSuffix(service, ".local") {
+		service += ".local"
+	}
+	return service
+}
+
+// isServiceType reports whether the config value looks like a DNS-SD service type, like "_airplay._tcp".
+func isServiceType(service string) bool {
+	labels := splitDNSName(strings.TrimSuffix(normalizeServiceType(service), ".local"))
+	if len(labels) != 2 || (labels[1] != "_tcp" && labels[1] != "_udp") {
+		return false
+	}
+	return len(labels[0]) > 1 && strings.HasPrefix(labels[0], "_")
+}
+
+// belongsToService reports whether the name is the service type itself, a subtype or an instance of one of the services.
+func belongsToService(name string, services []string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, service := range services {
+		service = normalizeServiceType(service)
+		if name == service || strings.HasSuffix(name, "."+service) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterServices returns a copy of the mDNS response with only the records of the DNS-SD service types
+// in 'services': the PTR, SRV, TXT and NSEC records of the service instances, the service enumeration
+// PTR records pointing at them, and the address records of the hosts they run on.
+// Address records are also kept for the hosts in knownHosts, this allows answers to host lookups
+// which follow a service lookup. The SRV targets of the kept records are added to knownHosts.
+func filterServices(msg *dnsMessage, services []string, knownHosts map[string]bool) *dnsMessage {
+	hosts := make(map[string]bool)
+	for host := range knownHosts {
+		hosts[host] = true
+	}
+	for _, section := range [][]dnsRecord{msg.answers, msg.authorities, msg.additionals} {
+		for _, rr := range section {
+			if rr.rtype == dnsTypeSRV && belongsToService(rr.name, services) {
+				host := strings.ToLower(rr.target())
+				hosts[host] = true
+				if knownHosts != nil {
+					knownHosts[host] = true
+				}
+			}
+		}
+	}
+
+	keep := func(rr dnsRecord) bool {
+		switch {
+		case belongsToService(rr.name, services):
+			return true
+		case rr.rtype == dnsTypePTR && equalDNSNames(rr.name, dnssdServicesName):
+			return belongsToService(rr.target(), services)
+		case rr.rtype == dnsTypeA || rr.rtype == dnsTypeAAAA || rr.rtype == dnsTypeNSEC:
+			return hosts[strings.ToLower(strings.TrimSuffix(rr.name, "."))]
+		}
+		return false
+	}
+
+	filtered := msg.copyMessage()
+	filtered.answers = filterRecords(msg.answers, keep)
+	filtered.authorities = filterRecords(msg.authorities, keep)
+	filtered.additionals = filterRecords(msg.additionals, keep)
+	return filtered
+}
+
+// stripAddresses returns a copy of the mDNS response without the A and AAAA records of an address in 'networks',
+// like link-local addresses which cannot be reached from another VLAN. The records left of a record set which
+// was sent with the cache-flush bit all get the bit, so receivers still flush the stripped addresses.
+func stripAddresses(msg *dnsMessage, networks []*net.IPNet) *dnsMessage {
+	type recordSet struct {
+		name  string
+		rtype uint16
+	}
+	flushed := make(map[recordSet]bool)
+	keep := func(rr dnsRecord) bool {
+		if rr.rtype != dnsTypeA && rr.rtype != dnsTypeAAAA {
+			return true
+		}
+		if rr.cacheFlush() {
+			flushed[recordSet{cacheName(rr.name), rr.rtype}] = true
+		}
+		ip := rr.ip()
+		for _, network := range networks {
+			if ip != nil && network.Contains(ip) {
+				return false
+			}
+		}
+		return true
+	}
+
+	stripped := msg.copyMessage()
+	stripped.answers = filterRecords(msg.answers, keep)
+	stripped.authorities = filterRecords(msg.authorities, keep)
+	stripped.additionals = filterRecords(msg.additionals, keep)
+	for _, section := range [][]dnsRecord{stripped.answers, stripped.authorities, stripped.additionals} {
+		for i, rr := range section {
+			if flushed[recordSet{cacheName(rr.name), rr.rtype}] {
+				section[i].class |= dnsClassCacheFlush
+			}
+		}
+	}
+	return stripped
+}
+
+func filterRecords(records []dnsRecord, keep func(dnsRecord) bool) []dnsRecord {
+	var kept []dnsRecord
+	for _, rr := range records {
+		if keep(rr) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
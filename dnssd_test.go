@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func createMockServiceResponse() *dnsMessage {
+	srv := func(name, target string, port byte) dnsRecord {
+		return dnsRecord{name: name, rtype: dnsTypeSRV, class: dnsClassIN | dnsClassCacheFlush, ttl: 120, rdata: appendDNSName([]byte{0, 0, 0, 0, 0, port}, target, nil, 0)}
+	}
+	ptr := func(name, target string) dnsRecord {
+		return dnsRecord{name: name, rtype: dnsTypePTR, class: dnsClassIN, ttl: 4500, rdata: appendDNSName(nil, target, nil, 0)}
+	}
+	return &dnsMessage{
+		flags: dnsFlagResponse | dnsFlagAuthoritative,
+		answers: []dnsRecord{
+			ptr("_googlecast._tcp.local", "Living Room TV._googlecast._tcp.local"),
+			ptr("_spotify-connect._tcp.local", "Living Room TV._spotify-connect._tcp.local"),
+			ptr(dnssdServicesName, "_googlecast._tcp.local"),
+			ptr(dnssdServicesName, "_spotify-connect._tcp.local"),
+		},
+		additionals: []dnsRecord{
+			srv("Living Room TV._googlecast._tcp.local", "tv.local", 8),
+			{name: "Living Room TV._googlecast._tcp.local", rtype: dnsTypeTXT, class: dnsClassIN | dnsClassCacheFlush, ttl: 4500, rdata: []byte("\x05md=TV")},
+			srv("Living Room TV._spotify-connect._tcp.local", "tv.local", 9),
+			{name: "tv.local", rtype: dnsTypeA, class: dnsClassIN | dnsClassCacheFlush, ttl: 120, rdata: net.IP{192, 168, 1, 10}.To4()},
+			{name: "tv.local", rtype: dnsTypeNSEC, class: dnsClassIN | dnsClassCacheFlush, ttl: 120, rdata: append(appendDNSName(nil, "tv.local", nil, 0), 0, 4, 0x40, 0, 0, 8)},
+			{name: "other.local", rtype: dnsTypeA, class: dnsClassIN | dnsClassCacheFlush, ttl: 120, rdata: net.IP{192, 168, 1, 11}.To4()},
+		},
+	}
+}
+
+func TestDNSMessageRoundTrip(t *testing.T) {
+	msg := createMockServiceResponse()
+	packed := msg.pack()
+	computedResult, err := parseDNSMessage(packed)
+	if err != nil {
+		t.Fatalf("Error in parseDNSMessage(): %v", err)
+	}
+	if !reflect.DeepEqual(msg, computedResult) {
+		t.Errorf("Error in parseDNSMessage(): message changed after pack and parse:\n%+v\n%+v", msg, computedResult)
+	}
+	// Every name ends with .local, which should only be written once, and once in the uncompressed NSEC data
+	if count := bytes.Count(packed, []byte("\x05local")); count != 2 {
+		t.Errorf("Error in pack(): expected compressed names, found .local %d times", count)
+	}
+
+	escaped := `John\.s iPhone._airplay._tcp.local`
+	if labels := splitDNSName(escaped); len(labels) != 4 || labels[0] != "John.s iPhone" {
+		t.Errorf("Error in splitDNSName(): got %q", labels)
+	}
+	if name := joinDNSLabels(splitDNSName(escaped)); name != escaped {
+		t.Errorf("Error in joinDNSLabels(): got %s", name)
+	}
+}
+
+func TestFilterServices(t *testing.T) {
+	msg := createMockServiceResponse()
+	knownHosts := make(map[string]bool)
+
+	filtered := filterServices(msg, []string{"_googlecast._tcp"}, knownHosts)
+
+	var computedResult []string
+	for _, rr := range append(filtered.answers, filtered.additionals...) {
+		computedResult = append(computedResult, rr.name+"/"+rr.target())
+	}
+	expectedResult := []string{
+		"_googlecast._tcp.local/Living Room TV._googlecast._tcp.local",
+		dnssdServicesName + "/_googlecast._tcp.local",
+		"Living Room TV._googlecast._tcp.local/tv.local",
+		"Living Room TV._googlecast._tcp.local/",
+		"tv.local/",
+		"tv.local/tv.local",
+	}
+	if !reflect.DeepEqual(expectedResult, computedResult) {
+		t.Errorf("Error in filterServices(): got %q", computedResult)
+	}
+	if !knownHosts["tv.local"] {
+		t.Error("Error in filterServices(): SRV target was not added to the known hosts")
+	}
+
+	// A host lookup of a known host keeps its address records
+	hostLookup := &dnsMessage{flags: dnsFlagResponse, answers: msg.additionals[3:4]}
+	if filtered := filterServices(hostLookup, []string{"_googlecast._tcp"}, knownHosts); len(filtered.answers) != 1 {
+		t.Error("Error in filterServices(): address record of a known host was removed")
+	}
+
+	if filtered := filterServices(msg, []string{"_airplay._tcp"}, nil); len(filtered.answers) != 0 || len(filtered.additionals) != 0 {
+		t.Error("Error in filterServices(): records of services which are not shared were kept")
+	}
+}
+
+func TestStripAddresses(t *testing.T) {
+	_, linkLocal, _ := net.ParseCIDR("fe80::/10")
+	_, autoConfigured, _ := net.ParseCIDR("169.254.0.0/16")
+	address := func(ip string, class uint16) dnsRecord {
+		parsed := net.ParseIP(ip)
+		if parsed.To4() != nil {
+			return dnsRecord{name: "tv.local", rtype: dnsTypeA, class: class, ttl: 120, rdata: parsed.To4()}
+		}
+		return dnsRecord{name: "tv.local", rtype: dnsTypeAAAA, class: class, ttl: 120, rdata: parsed}
+	}
+	msg := &dnsMessage{
+		flags: dnsFlagResponse | dnsFlagAuthoritative,
+		answers: []dnsRecord{
+			address("fe80::1", dnsClassIN|dnsClassCacheFlush),
+			address("2001:db8::1", dnsClassIN),
+			address("169.254.10.1", dnsClassIN|dnsClassCacheFlush),
+			address("192.168.1.10", dnsClassIN|dnsClassCacheFlush),
+		},
+	}
+
+	stripped := stripAddresses(msg, []*net.IPNet{linkLocal})
+	var computedResult []string
+	for _, rr := range stripped.answers {
+		computedResult = append(computedResult, fmt.Sprintf("%s/%t", rr.ip(), rr.cacheFlush()))
+	}
+	expectedResult := []string{"2001:db8::1/true", "169.254.10.1/true", "192.168.1.10/true"}
+	if !reflect.DeepEqual(expectedResult, computedResult) {
+		t.Errorf("Error in stripAddresses(): got %q", computedResult)
+	}
+	if msg.answers[1].cacheFlush() {
+		t.Error("Error in stripAddresses(): the original message was modified")
+	}
+
+	if stripped := stripAddresses(msg, []*net.IPNet{linkLocal, autoConfigured}); len(stripped.answers) != 2 {
+		t.Errorf("Error in stripAddresses(): expected 2 answers without link-local addresses, got %d", len(stripped.answers))
+	}
+}
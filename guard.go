@@ -0,0 +1,123 @@
+package main
+
+import (
+	"hash/fnv"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// loopGuard protects one protocol against other reflectors on the same VLANs, like avahi-daemon with
+// enable-reflector or a second bonjour-reflector. Those send our packets back with their own MAC address,
+// which the BPF filter does not catch, so the guard remembers a hash of the payloads it sent to every VLAN
+// recently. A packet which comes back on a VLAN with one of those payloads is a suspected loop. The guard also trips a circuit breaker
+// for a VLAN which sends more than max_packets_per_second.
+type loopGuard struct {
+	mu       sync.Mutex
+	protocol string
+	sent     map[uint64]emission
+	vlans    map[uint16]*vlanGuard
+	// lastSweep is when expired hashes were last removed
+	lastSweep time.Time
+}
+
+type emission struct {
+	vlans   []uint16
+	expires time.Time
+}
+
+type vlanGuard struct {
+	second       time.Time
+	packets      int
+	trippedUntil time.Time
+	lastLoopLog  time.Time
+}
+
+// loopWindow is how long the hash of a sent payload is kept. A reflector which sends it back does so within
+// milliseconds, and it is shorter than the one second after which a querier repeats the same query.
+var loopWindow = 500 * time.Millisecond
+
+// circuitBreakerCooldown is how long the packets of a VLAN are dropped after it exceeded max_packets_per_second.
+var circuitBreakerCooldown = 10 * time.Second
+
+// loopLogInterval limits the warnings about suspected loops to one per VLAN per interval.
+var loopLogInterval = 10 * time.Second
+
+func newLoopGuard(protocol string) *loopGuard {
+	return &loopGuard{
+		protocol: protocol,
+		sent:     make(map[uint64]emission),
+		vlans:    make(map[uint16]*vlanGuard),
+	}
+}
+
+func payloadHash(payload []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(payload)
+	return h.Sum64()
+}
+
+// sentTo remembers that the payload was sent to the VLAN.
+func (guard *loopGuard) sentTo(vlan uint16, payload []byte, now time.Time) {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	hash := payloadHash(payload)
+	sent := guard.sent[hash]
+	if now.After(sent.expires) {
+		sent.vlans = nil
+	}
+	if !slices.Contains(sent.vlans, vlan) {
+		sent.vlans = append(sent.vlans, vlan)
+	}
+	sent.expires = now.Add(loopWindow)
+	guard.sent[hash] = sent
+
+	if now.Sub(guard.lastSweep) >= loopWindow {
+		guard.lastSweep = now
+		for hash, sent := range guard.sent {
+			if now.After(sent.expires) {
+				delete(guard.sent, hash)
+			}
+		}
+	}
+}
+
+// allow reports whether a packet received on the VLAN should be processed. It returns false while the
+// circuit breaker of the VLAN is tripped, and for a payload the reflector sent to the VLAN within loopWindow.
+// Devices repeat their packets on their own VLAN, so those are not mistaken for a loop.
+// A limit of 0 disables the circuit breaker.
+func (guard *loopGuard) allow(vlan uint16, payload []byte, limit int, now time.Time) bool {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	state, ok := guard.vlans[vlan]
+	if !ok {
+		state = &vlanGuard{}
+		guard.vlans[vlan] = state
+	}
+
+	if now.Before(state.trippedUntil) {
+		return false
+	}
+	if now.Sub(state.second) >= time.Second {
+		state.second, state.packets = now, 0
+	}
+	state.packets++
+	if limit > 0 && state.packets > limit {
+		state.trippedUntil = now.Add(circuitBreakerCooldown)
+		logrus.Warningf("Circuit breaker tripped for %s on VLAN %d, more than %d packets per second. Dropping its %s packets for %s.", guard.protocol, vlan, limit, guard.protocol, circuitBreakerCooldown)
+		return false
+	}
+
+	if sent, ok := guard.sent[payloadHash(payload)]; ok && !now.After(sent.expires) && slices.Contains(sent.vlans, vlan) {
+		if now.Sub(state.lastLoopLog) >= loopLogInterval {
+			state.lastLoopLog = now
+			logrus.Warningf("Loop suspected, dropped a %s packet on VLAN %d which the reflector sent to it. Is another reflector or mDNS repeater running on this VLAN?", guard.protocol, vlan)
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoopGuard(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	guard := newLoopGuard("mDNS")
+	query := createMockServiceResponse().pack()
+
+	// A query from VLAN 101 is forwarded to VLAN 100, another reflector sends it back to VLAN 100
+	if !guard.allow(101, query, 0, now) {
+		t.Fatal("Error in allow(): dropped the first packet")
+	}
+	guard.sentTo(100, query, now)
+	if guard.allow(100, query, 0, now.Add(10*time.Millisecond)) {
+		t.Error("Error in allow(): expected the packet which came back on VLAN 100 to be dropped")
+	}
+	// The querier repeats its query on its own VLAN
+	if !guard.allow(101, query, 0, now.Add(20*time.Millisecond)) {
+		t.Error("Error in allow(): dropped a repeated packet on the VLAN it came from")
+	}
+	if !guard.allow(100, query, 0, now.Add(loopWindow+time.Millisecond)) {
+		t.Error("Error in allow(): dropped the packet after the loop window")
+	}
+
+	// The circuit breaker trips at the fourth packet in a second, and stays tripped for the cooldown
+	other := []byte("NOTIFY * HTTP/1.1\r\n")
+	later := now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		if !guard.allow(102, other, 3, later) {
+			t.Fatalf("Error in allow(): dropped packet %d below the limit", i+1)
+		}
+	}
+	if guard.allow(102, other, 3, later) {
+		t.Error("Error in allow(): expected the circuit breaker to trip")
+	}
+	if guard.allow(102, other, 3, later.Add(2*time.Second)) {
+		t.Error("Error in allow(): expected the circuit breaker to stay tripped during the cooldown")
+	}
+	if !guard.allow(103, other, 3, later.Add(2*time.Second)) {
+		t.Error("Error in allow(): the circuit breaker of VLAN 102 dropped a packet of VLAN 103")
+	}
+	if !guard.allow(102, other, 3, later.Add(circuitBreakerCooldown+time.Second)) {
+		t.Error("Error in allow(): expected the circuit breaker to reset after the cooldown")
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"expvar"
 	"flag"
-	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	//_ "net/http/pprof"
 
@@ -12,10 +16,12 @@ import (
 
 func main() {
 	// Read config file and generate mDNS forwarding maps
-	configPath := flag.String("config", "", "Config file in TOML format")
+	configPath := flag.String("config", "", "Config file in TOML format, or a directory of config files")
 	//debug := flag.Bool("debug", false, "Enable pprof server on /debug/pprof/")
 	verbose := flag.Bool("verbose", false, "See packets")
 	silent := flag.Bool("silent", false, "Only warnings and errors")
+	check := flag.Bool("check", false, "Validate the config file and exit")
+	metrics := flag.String("metrics", "", "Serve the session counters on /debug/vars at this address, like localhost:6061")
 
 	flag.Parse()
 
@@ -39,33 +45,75 @@ func main() {
 			logrus.Fatal("Could not find config file")
 		}
 	}
+	if *check {
+		os.Exit(runCheck(*configPath))
+	}
 	cfg, err := readConfig(*configPath)
 	if err != nil {
 		logrus.Fatalf("Could not read configuration: %v", err)
 	}
-	poolsMap := mapByPool(cfg.Devices)
-	vlanIPMap := mapIpSourceByVlan(cfg.VlanIPSource)
+	policies := newPolicyStore(newPolicy(cfg))
 
-	intf, err := net.InterfaceByName(cfg.NetInterface)
-	if err != nil {
-		logrus.Fatal(err)
+	if *metrics != "" {
+		go metricsServer(*metrics)
 	}
-	srcMACAddress := intf.HardwareAddr
-
-	removeVlanFilter(intf.Name)
 
 	stop := make(chan struct{})
 	defer close(stop)
 
-	go ownupNetworkAddresses(cfg.NetInterface, srcMACAddress, vlanIPMap, stop)
+	go watchConfig(*configPath, policies, stop)
+	go watchSharingRules(policies, stop)
+
+	var trunks []*trunk
+	for _, name := range cfg.interfaces() {
+		t, err := newTrunk(name)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		trunks = append(trunks, t)
+		go ownupNetworkAddresses(t, policies, stop)
+	}
+
+	// Records of the shared devices, for mdns_cache and the DNS gateway
+	cache := newMDNSCache()
+	// Instances renamed by instance_name, to restore their names in queries
+	renames := newInstanceRenames()
+	gatewayQueries := make(chan gatewayQuery, 16)
+	if cfg.DNSGateway.Listen != "" {
+		go func() {
+			if err := serveDNSGateway(cfg.DNSGateway.Listen, policies, cache, renames, gatewayQueries); err != nil {
+				logrus.Fatalf("Could not start the DNS gateway: %v", err)
+			}
+		}()
+	}
+
+	proxy := newSSDPProxy(policies)
+	go proxy.serve(stop)
+	go processSSDPPackets(trunks, policies, proxy)
+	go processWSDiscoveryPackets(trunks, policies)
 
-	allowedMacsMap := mapLowerCaseMac(cfg.Devices)
-	go processSSDPPackets(cfg.NetInterface, srcMACAddress, poolsMap, vlanIPMap, allowedMacsMap)
+	// Send the goodbyes of the static services before exiting
+	shutdown := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-signals
+		close(shutdown)
+	}()
 
-	processBonjourPackets(cfg.NetInterface, srcMACAddress, poolsMap, vlanIPMap, allowedMacsMap)
+	processBonjourPackets(trunks, policies, cache, renames, gatewayQueries, shutdown)
 
 }
 
+func metricsServer(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		logrus.Fatalf("The application was started with -metrics flag but could not listen on %v: \n %s", address, err)
+	}
+}
+
 //func debugServer(port int) {
 //	err := http.ListenAndServe(fmt.Sprintf("localhost:%d", port), nil)
 //	if err != nil {
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mdnsCache holds the records of the mDNS responses of the shared devices, so queries
+// can be answered by the reflector instead of being forwarded to the origin VLANs.
+// It follows the caching rules of RFC 6762 section 10.
+type mdnsCache struct {
+	mu sync.Mutex
+	// records are keyed by their lower case name
+	records   map[string][]cachedRecord
+	lastSweep time.Time
+}
+
+type cachedRecord struct {
+	dnsRecord
+	// device is the key of the device entry which sent the record
+	device   macAddress
+	received time.Time
+	expires  time.Time
+}
+
+// mdnsCacheSweepInterval is how often expired records of names which are not seen anymore are removed.
+var mdnsCacheSweepInterval = time.Minute
+
+func newMDNSCache() *mdnsCache {
+	return &mdnsCache{records: make(map[string][]cachedRecord)}
+}
+
+func cacheName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// add stores the answers and additional records of an mDNS response of a device.
+func (cache *mdnsCache) add(device macAddress, msg *dnsMessage, now time.Time) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for _, section := range [][]dnsRecord{msg.answers, msg.additionals} {
+		for _, rr := range section {
+			name := cacheName(rr.name)
+			var kept []cachedRecord
+			updated := false
+			for _, cached := range cache.records[name] {
+				sameSet := cached.rtype == rr.rtype && cached.class&^dnsClassCacheFlush == rr.class&^dnsClassCacheFlush
+				switch {
+				case !now.Before(cached.expires):
+					// expired
+				case sameSet && string(cached.rdata) == string(rr.rdata):
+					cached.dnsRecord, cached.device, cached.received = rr, device, now
+					cached.expires = now.Add(time.Duration(rr.ttl) * time.Second)
+					if rr.ttl == 0 {
+						// A goodbye packet, the record is removed after one second (section 10.1)
+						cached.expires = now.Add(time.Second)
+					}
+					kept = append(kept, cached)
+					updated = true
+				case sameSet && rr.cacheFlush() && now.Sub(cached.received) > time.Second:
+					// The other records of a unique record set are flushed (section 10.2)
+				default:
+					kept = append(kept, cached)
+				}
+			}
+			if !updated && rr.ttl > 0 {
+				kept = append(kept, cachedRecord{dnsRecord: rr, device: device, received: now, expires: now.Add(time.Duration(rr.ttl) * time.Second)})
+			}
+			cache.store(name, kept)
+		}
+	}
+
+	if now.Sub(cache.lastSweep) >= mdnsCacheSweepInterval {
+		cache.sweep(now)
+	}
+}
+
+func (cache *mdnsCache) store(name string, records []cachedRecord) {
+	if len(records) == 0 {
+		delete(cache.records, name)
+		return
+	}
+	cache.records[name] = records
+}
+
+func (cache *mdnsCache) sweep(now time.Time) {
+	cache.lastSweep = now
+	for name, records := range cache.records {
+		var kept []cachedRecord
+		for _, cached := range records {
+			if now.Before(cached.expires) {
+				kept = append(kept, cached)
+			}
+		}
+		cache.store(name, kept)
+	}
+}
+
+// lookup returns the fresh records with the name and type, a record is not fresh anymore after 80%
+// of its TTL, when queriers should refresh it (section 5.2). The TTL is set to the remaining TTL.
+func (cache *mdnsCache) lookup(name string, rtype uint16, now time.Time) []cachedRecord {
+	var found []cachedRecord
+	for _, cached := range cache.records[cacheName(name)] {
+		if rtype != dnsTypeANY && cached.rtype != rtype {
+			continue
+		}
+		remaining := cached.expires.Sub(now)
+		if cached.ttl == 0 || remaining*5 < time.Duration(cached.ttl)*time.Second {
+			continue
+		}
+		cached.ttl = uint32(remaining / time.Second)
+		found = append(found, cached)
+	}
+	return found
+}
+
+// sharedDevice returns the services a device shares with the VLAN of the querier, the hosts of those
+// services and the privacy rules for the VLAN. It returns false when the device is not shared with the VLAN.
+type sharedDevice func(device macAddress) (services []string, hosts map[string]bool, privacy privacyRules, ok bool)
+
+// sharedWith returns the sharedDevice of the VLAN in the active policy. The hosts are taken from knownHosts,
+// which may be nil when the caller runs outside the mDNS processor.
+func sharedWith(active *policy, knownHosts map[macAddress]map[string]bool, vlan uint16, now time.Time) sharedDevice {
+	return func(key macAddress) ([]string, map[string]bool, privacyRules, bool) {
+		device, ok := active.allowedDevices.devices[key]
+		if !ok || !slices.Contains(device.SharedPools, vlan) || !device.sharedAt(vlan, now) {
+			return nil, nil, privacyRules{}, false
+		}
+		if knownHosts == nil {
+			return device.servicesFor(vlan), nil, active.privacyFor(device, vlan), true
+		}
+		return device.servicesFor(vlan), deviceHosts(knownHosts, key), active.privacyFor(device, vlan), true
+	}
+}
+
+// answer returns the response to the query from the cached records of the shared devices, with
+// the records in the answer section of the query removed (known-answer suppression, section 7.1).
+// It returns false when one of the questions cannot be answered from the cache.
+func (cache *mdnsCache) answer(query *dnsMessage, now time.Time, shared sharedDevice) (*dnsMessage, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	perDevice := make(map[macAddress]*dnsMessage)
+	appendTo := func(section func(*dnsMessage) *[]dnsRecord, records []cachedRecord, device macAddress) {
+		for _, cached := range records {
+			if device != "" && cached.device != device {
+				continue
+			}
+			msg, ok := perDevice[cached.device]
+			if !ok {
+				msg = &dnsMessage{}
+				perDevice[cached.device] = msg
+			}
+			*section(msg) = append(*section(msg), cached.dnsRecord)
+		}
+	}
+	answers := func(msg *dnsMessage) *[]dnsRecord { return &msg.answers }
+	additionals := func(msg *dnsMessage) *[]dnsRecord { return &msg.additionals }
+
+	for _, question := range query.questions {
+		appendTo(answers, cache.lookup(question.name, question.qtype, now), "")
+	}
+
+	devices := make([]macAddress, 0, len(perDevice))
+	for device := range perDevice {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i] < devices[j] })
+
+	response := &dnsMessage{flags: dnsFlagResponse | dnsFlagAuthoritative}
+	type recordKey struct {
+		name  string
+		rtype uint16
+		rdata string
+	}
+	seen := make(map[recordKey]bool)
+	add := func(section *[]dnsRecord, records []dnsRecord) {
+		for _, rr := range records {
+			key := recordKey{cacheName(rr.name), rr.rtype, string(rr.rdata)}
+			if !seen[key] {
+				seen[key] = true
+				*section = append(*section, rr)
+			}
+		}
+	}
+	answered := make([]bool, len(query.questions))
+	for _, device := range devices {
+		services, hosts, privacy, ok := shared(device)
+		if !ok {
+			continue
+		}
+		// The SRV and TXT records of service instances, and the address records of their hosts (section 12)
+		msg := perDevice[device]
+		for _, rr := range msg.answers {
+			if rr.rtype == dnsTypePTR {
+				appendTo(additionals, cache.lookup(rr.target(), dnsTypeSRV, now), device)
+				appendTo(additionals, cache.lookup(rr.target(), dnsTypeTXT, now), device)
+			}
+		}
+		for _, rr := range append(append([]dnsRecord{}, msg.answers...), msg.additionals...) {
+			if rr.rtype == dnsTypeSRV {
+				appendTo(additionals, cache.lookup(rr.target(), dnsTypeA, now), device)
+				appendTo(additionals, cache.lookup(rr.target(), dnsTypeAAAA, now), device)
+			}
+		}
+
+		if services != nil {
+			msg = filterServices(msg, services, hosts)
+		}
+		// The questions use the names the devices know, instance_name only renames the answers
+		for i, question := range query.questions {
+			answered[i] = answered[i] || slices.ContainsFunc(msg.answers, func(rr dnsRecord) bool {
+				return equalDNSNames(rr.name, question.name) && (question.qtype == dnsTypeANY || rr.rtype == question.qtype)
+			})
+		}
+		msg = applyPrivacy(msg, privacy, nil)
+		add(&response.answers, msg.answers)
+		add(&response.additionals, msg.additionals)
+	}
+
+	if slices.Contains(answered, false) {
+		return nil, false
+	}
+
+	response.answers = filterRecords(response.answers, func(rr dnsRecord) bool {
+		return !isKnownAnswer(query.answers, rr)
+	})
+	return response, true
+}
+
+// isKnownAnswer reports whether the querier already has the record, with at least half of its TTL left.
+func isKnownAnswer(knownAnswers []dnsRecord, rr dnsRecord) bool {
+	for _, known := range knownAnswers {
+		if known.rtype == rr.rtype && equalDNSNames(known.name, rr.name) && string(known.rdata) == string(rr.rdata) && known.ttl >= rr.ttl/2 {
+			return true
+		}
+	}
+	return false
+}
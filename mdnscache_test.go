@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMDNSCache(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	cache := newMDNSCache()
+	cache.add("aa:bb:cc:dd:ee:ff", createMockServiceResponse(), now)
+
+	shareAll := func(device macAddress) ([]string, map[string]bool, privacyRules, bool) {
+		return nil, nil, privacyRules{}, true
+	}
+	names := func(records []dnsRecord) (names []string) {
+		for _, rr := range records {
+			names = append(names, rr.name+"/"+rr.target())
+		}
+		return names
+	}
+	query := &dnsMessage{questions: []dnsQuestion{{name: "_googlecast._tcp.local", qtype: dnsTypePTR, qclass: dnsClassIN}}}
+
+	// The SRV, TXT and address records of the instance are added as additional records
+	response, ok := cache.answer(query, now.Add(10*time.Second), shareAll)
+	if !ok {
+		t.Fatalf("Error in answer(): query for a cached PTR record was not answered")
+	}
+	expectedAnswers := []string{"_googlecast._tcp.local/Living Room TV._googlecast._tcp.local"}
+	if computedResult := names(response.answers); !reflect.DeepEqual(expectedAnswers, computedResult) {
+		t.Errorf("Error in answer(): got answers %q", computedResult)
+	}
+	expectedAdditionals := []string{
+		"Living Room TV._googlecast._tcp.local/tv.local",
+		"Living Room TV._googlecast._tcp.local/",
+		"tv.local/",
+	}
+	if computedResult := names(response.additionals); !reflect.DeepEqual(expectedAdditionals, computedResult) {
+		t.Errorf("Error in answer(): got additionals %q", computedResult)
+	}
+	if ttl := response.answers[0].ttl; ttl != 4490 {
+		t.Errorf("Error in answer(): expected the remaining TTL 4490, got %d", ttl)
+	}
+
+	// A device which is not shared with the VLAN of the querier is not answered
+	if _, ok := cache.answer(query, now, func(device macAddress) ([]string, map[string]bool, privacyRules, bool) {
+		return nil, nil, privacyRules{}, false
+	}); ok {
+		t.Errorf("Error in answer(): answered from a device which is not shared")
+	}
+
+	// Only the shared services of the device are answered
+	services := &dnsMessage{questions: []dnsQuestion{{name: dnssdServicesName, qtype: dnsTypePTR, qclass: dnsClassIN}}}
+	response, ok = cache.answer(services, now, func(device macAddress) ([]string, map[string]bool, privacyRules, bool) {
+		return []string{"_spotify-connect._tcp"}, make(map[string]bool), privacyRules{}, true
+	})
+	if computedResult := names(response.answers); !ok || !reflect.DeepEqual([]string{dnssdServicesName + "/_spotify-connect._tcp.local"}, computedResult) {
+		t.Errorf("Error in answer(): got services %q", computedResult)
+	}
+
+	// Known-answer suppression, when the querier has at least half of the TTL left
+	known := *query
+	known.answers = []dnsRecord{createMockServiceResponse().answers[0]}
+	known.answers[0].ttl = 2300
+	if response, ok := cache.answer(&known, now, shareAll); !ok || len(response.answers) != 0 {
+		t.Errorf("Error in answer(): expected the known answer to be suppressed, got %q", names(response.answers))
+	}
+	known.answers[0].ttl = 2200
+	if response, ok := cache.answer(&known, now, shareAll); !ok || len(response.answers) != 1 {
+		t.Errorf("Error in answer(): expected the known answer with less than half of the TTL to be answered")
+	}
+
+	// A record is not answered after 80% of its TTL, the device should be asked to refresh it
+	address := &dnsMessage{questions: []dnsQuestion{{name: "tv.local", qtype: dnsTypeA, qclass: dnsClassIN}}}
+	if _, ok := cache.answer(address, now.Add(95*time.Second), shareAll); !ok {
+		t.Errorf("Error in answer(): fresh A record was not answered")
+	}
+	if _, ok := cache.answer(address, now.Add(97*time.Second), shareAll); ok {
+		t.Errorf("Error in answer(): A record was answered after 80%% of its TTL")
+	}
+
+	// The cache-flush bit replaces the address of tv.local, one second after it was received
+	moved := &dnsMessage{flags: dnsFlagResponse, answers: []dnsRecord{{name: "tv.local", rtype: dnsTypeA, class: dnsClassIN | dnsClassCacheFlush, ttl: 120, rdata: []byte{192, 168, 1, 20}}}}
+	cache.add("aa:bb:cc:dd:ee:ff", moved, now.Add(30*time.Second))
+	response, ok = cache.answer(address, now.Add(30*time.Second), shareAll)
+	if !ok || len(response.answers) != 1 || response.answers[0].ip().String() != "192.168.1.20" {
+		t.Errorf("Error in add(): expected the cache-flush bit to replace the address, got %+v", response)
+	}
+
+	// A goodbye packet removes the record
+	goodbye := &dnsMessage{flags: dnsFlagResponse, answers: []dnsRecord{createMockServiceResponse().answers[0]}}
+	goodbye.answers[0].ttl = 0
+	cache.add("aa:bb:cc:dd:ee:ff", goodbye, now.Add(40*time.Second))
+	if _, ok := cache.answer(query, now.Add(40*time.Second), shareAll); ok {
+		t.Errorf("Error in add(): record was answered after its goodbye packet")
+	}
+}
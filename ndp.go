@@ -9,24 +9,22 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-var IPv6Address net.IP
-
-func respondToNeighborSolicitation(rawTraffic *pcap.Handle, packet gopacket.Packet, srcMACAddress net.HardwareAddr, vlanIPMap map[uint16]net.IP) {
-	var tag uint16
-
-	if parsedTag := packet.Layer(layers.LayerTypeDot1Q); parsedTag != nil {
-		tag = parsedTag.(*layers.Dot1Q).VLANIdentifier
-	}
-	if vlanIPMap[tag] == nil {
-		return
-	}
-
+// respondToNeighborSolicitation replies to a neighbor solicitation for one of the owned addresses,
+// the link-local address of the trunk or the ip6_source, on the VLAN with the tag the packet was received on.
+// Duplicate address detection by another host is answered to all nodes, to defend the address.
+func respondToNeighborSolicitation(rawTraffic *pcap.Handle, packet gopacket.Packet, srcMACAddress net.HardwareAddr, owned []net.IP, tag uint16) {
 	nsLayer := packet.Layer(layers.LayerTypeICMPv6NeighborSolicitation)
 	if nsLayer == nil {
 		return
 	}
 	ns := nsLayer.(*layers.ICMPv6NeighborSolicitation)
-	if !net.IP(ns.TargetAddress).Equal(IPv6Address) {
+	var ipv6Address net.IP
+	for _, ip := range owned {
+		if net.IP(ns.TargetAddress).Equal(ip) {
+			ipv6Address = ip
+		}
+	}
+	if ipv6Address == nil {
 		return
 	}
 
@@ -39,13 +37,17 @@ func respondToNeighborSolicitation(rawTraffic *pcap.Handle, packet gopacket.Pack
 	if parsedIP := packet.Layer(layers.LayerTypeIPv6); parsedIP != nil {
 		srcIP = parsedIP.(*layers.IPv6).SrcIP
 	}
-	err := sendNA(rawTraffic, srcMACAddress, srcMAC, IPv6Address, srcIP, tag)
+	if srcIP.IsUnspecified() {
+		srcMAC = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+		srcIP = net.IPv6linklocalallnodes
+	}
+	err := sendNA(rawTraffic, srcMACAddress, srcMAC, ipv6Address, srcIP, tag)
 	if err != nil {
 		logrus.Error(err)
 		return
 	}
 
-	logrus.Debugf("Replied to %v for ip %s", net.HardwareAddr(srcMAC), IPv6Address.String())
+	logrus.Debugf("Replied to %v for ip %s", net.HardwareAddr(srcMAC), ipv6Address.String())
 
 }
 
@@ -53,13 +55,7 @@ func sendNA(rawTraffic *pcap.Handle, srcMACAddress net.HardwareAddr, dstMACAddre
 	sendEth := layers.Ethernet{
 		SrcMAC:       srcMACAddress,
 		DstMAC:       dstMACAddress,
-		EthernetType: layers.EthernetTypeDot1Q,
-	}
-	sendTag := layers.Dot1Q{
-		Priority:       0,
-		DropEligible:   false,
-		VLANIdentifier: vlanTag,
-		Type:           layers.EthernetTypeIPv6,
+		EthernetType: layers.EthernetTypeIPv6,
 	}
 	sendIpv6 := layers.IPv6{
 		Version:    6,
@@ -94,7 +90,7 @@ func sendNA(rawTraffic *pcap.Handle, srcMACAddress net.HardwareAddr, dstMACAddre
 		ComputeChecksums: true,
 	}
 
-	err := gopacket.SerializeLayers(buf, opts, &sendEth, &sendTag, &sendIpv6, &sendICMPv6, &sendNA)
+	err := gopacket.SerializeLayers(buf, opts, tagFrame([]gopacket.SerializableLayer{&sendEth, &sendIpv6, &sendICMPv6, &sendNA}, vlanTag)...)
 	if err != nil {
 		return err
 	}
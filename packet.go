@@ -14,12 +14,14 @@ import (
 
 type multicastPacket struct {
 	packet              gopacket.Packet
+	netInterface        string
 	srcMAC              *net.HardwareAddr
 	dstMAC              *net.HardwareAddr
 	srcIP               *net.IP
 	dstIP               *net.IP
 	srcPort             *layers.UDPPort
 	dstPort             *layers.UDPPort
+	payload             []byte
 	isIPv6              bool
 	vlanTag             *uint16
 	isDNSQuery          bool
@@ -28,6 +30,12 @@ type multicastPacket struct {
 	isSSDPAdvertisement bool
 	isSSDPResponse      bool
 	maxWaitTime         uint8
+	// rewrittenPayload replaces the UDP payload when the packet is sent, if set
+	rewrittenPayload []byte
+	// validPayload is the payload of an mDNS response without the records which failed validate_answers, if set
+	validPayload []byte
+	// rewrittenPorts is set when a UDP port of the packet was replaced
+	rewrittenPorts bool
 }
 
 func parsePacketsLazily(source *gopacket.PacketSource) chan multicastPacket {
@@ -40,52 +48,58 @@ func parsePacketsLazily(source *gopacket.PacketSource) chan multicastPacket {
 
 	go func() {
 		for packet := range source.Packets() {
-			tag := parseVLANTag(packet)
+			// Pass on the packet for its next adventure
+			packetChan <- parseMulticastPacket(packet)
+		}
+	}()
 
-			// Get source and destination mac addresses
-			srcMAC, dstMAC := parseEthernetLayer(packet)
+	return packetChan
+}
 
-			// Check IP protocol version
-			isIPv6, srcIP, dstIP := parseIPLayer(packet)
+// parseMulticastPacket returns the fields of a received packet which the packet processors use.
+func parseMulticastPacket(packet gopacket.Packet) multicastPacket {
+	tag := parseVLANTag(packet)
 
-			// Get UDP payload
-			payload, srcPort, dstPort := parseUDPLayer(packet)
+	// Get source and destination mac addresses
+	srcMAC, dstMAC := parseEthernetLayer(packet)
 
-			// Check if DNS query
-			isDNSQuery, isDNSResponse := false, false
-			if dstPort != nil && srcPort != nil && (*dstPort == 5353 || *srcPort == 5353) {
-				isDNSQuery, isDNSResponse = parseDNSPayload(payload)
-			}
+	// Check IP protocol version
+	isIPv6, srcIP, dstIP := parseIPLayer(packet)
 
-			// Check if SSDP query
-			isSSDPQuery, isSSDPAdvertisement, isSSDPResponse, maxWaitTime := false, false, false, uint8(ssdpSessionDuration)
-			if dstPort != nil && *dstPort == 1900 {
-				isSSDPQuery, isSSDPAdvertisement, maxWaitTime = parseSSDPQuery(payload)
-			} else if !isDNSQuery && !isDNSResponse {
-				isSSDPResponse = parseSSDPResponse(payload)
-			}
-			// Pass on the packet for its next adventure
-			packetChan <- multicastPacket{
-				packet:              packet,
-				vlanTag:             tag,
-				srcMAC:              srcMAC,
-				dstMAC:              dstMAC,
-				srcIP:               srcIP,
-				dstIP:               dstIP,
-				srcPort:             srcPort,
-				dstPort:             dstPort,
-				isIPv6:              isIPv6,
-				isDNSQuery:          isDNSQuery,
-				isDNSResponse:       isDNSResponse,
-				isSSDPQuery:         isSSDPQuery,
-				isSSDPAdvertisement: isSSDPAdvertisement,
-				isSSDPResponse:      isSSDPResponse,
-				maxWaitTime:         maxWaitTime,
-			}
-		}
-	}()
+	// Get UDP payload
+	payload, srcPort, dstPort := parseUDPLayer(packet)
 
-	return packetChan
+	// Check if DNS query
+	isDNSQuery, isDNSResponse := false, false
+	if dstPort != nil && srcPort != nil && (*dstPort == 5353 || *srcPort == 5353) {
+		isDNSQuery, isDNSResponse = parseDNSPayload(payload)
+	}
+
+	// Check if SSDP query
+	isSSDPQuery, isSSDPAdvertisement, isSSDPResponse, maxWaitTime := false, false, false, uint8(ssdpSessionDuration)
+	if dstPort != nil && *dstPort == 1900 {
+		isSSDPQuery, isSSDPAdvertisement, maxWaitTime = parseSSDPQuery(payload, dstIP != nil && !dstIP.IsMulticast())
+	} else if !isDNSQuery && !isDNSResponse {
+		isSSDPResponse = parseSSDPResponse(payload)
+	}
+	return multicastPacket{
+		packet:              packet,
+		vlanTag:             tag,
+		srcMAC:              srcMAC,
+		dstMAC:              dstMAC,
+		srcIP:               srcIP,
+		dstIP:               dstIP,
+		srcPort:             srcPort,
+		dstPort:             dstPort,
+		payload:             payload,
+		isIPv6:              isIPv6,
+		isDNSQuery:          isDNSQuery,
+		isDNSResponse:       isDNSResponse,
+		isSSDPQuery:         isSSDPQuery,
+		isSSDPAdvertisement: isSSDPAdvertisement,
+		isSSDPResponse:      isSSDPResponse,
+		maxWaitTime:         maxWaitTime,
+	}
 }
 
 func parseEthernetLayer(packet gopacket.Packet) (srcMAC, dstMAC *net.HardwareAddr) {
@@ -135,7 +149,8 @@ func parseDNSPayload(payload []byte) (isDNSQuery bool, isDNSResponse bool) {
 	return
 }
 
-func parseSSDPQuery(payload []byte) (isSSDPQuery bool, isSSDPAdvertisement bool, maxWaitTime uint8) {
+// parseSSDPQuery parses an M-SEARCH or NOTIFY request. A unicast M-SEARCH (UDA 1.1) has no MX, it is answered within a second.
+func parseSSDPQuery(payload []byte, unicast bool) (isSSDPQuery bool, isSSDPAdvertisement bool, maxWaitTime uint8) {
 
 	// SSDP packets are HTTP-like, so we can parse them as such
 	// https://tools.ietf.org/html/draft-cai-ssdp-v1-03
@@ -156,7 +171,9 @@ func parseSSDPQuery(payload []byte) (isSSDPQuery bool, isSSDPAdvertisement bool,
 		parsedHTTP.Header.Get("NT") != "" &&
 		(parsedHTTP.Header.Get("NTS") == "ssdp:alive" || parsedHTTP.Header.Get("NTS") == "ssdp:byebye")
 
-	if isSSDPQuery {
+	if isSSDPQuery && unicast && parsedHTTP.Header.Get("MX") == "" {
+		maxWaitTime = 1
+	} else if isSSDPQuery {
 		if mx, err := strconv.Atoi(parsedHTTP.Header.Get("MX")); err == nil {
 			if mx >= 1 && mx <= 120 {
 				maxWaitTime = uint8(mx)
@@ -197,6 +214,7 @@ type packetWriter interface {
 	WritePacketData([]byte) error
 }
 
+// sendPacket sends the packet to the VLAN with the tag, a tag of 0 sends the packet untagged to the native VLAN.
 func sendPacket(handle packetWriter, packet *multicastPacket, tag uint16, srcMACAddress net.HardwareAddr, dstMacAddress net.HardwareAddr, srcIP net.IP, dstIP net.IP) {
 	*packet.vlanTag = tag
 	*packet.srcMAC = srcMACAddress
@@ -205,7 +223,7 @@ func sendPacket(handle packetWriter, packet *multicastPacket, tag uint16, srcMAC
 	buf := gopacket.NewSerializeBuffer()
 	serializeOptions := gopacket.SerializeOptions{}
 
-	if srcIP != nil || dstIP != nil {
+	if srcIP != nil || dstIP != nil || packet.rewrittenPayload != nil || packet.rewrittenPorts {
 		serializeOptions = gopacket.SerializeOptions{ComputeChecksums: true}
 
 		if srcIP != nil {
@@ -214,7 +232,7 @@ func sendPacket(handle packetWriter, packet *multicastPacket, tag uint16, srcMAC
 		if dstIP != nil {
 			*packet.dstIP = dstIP
 		}
-		// We recalculate the checksum since the IP was modified
+		// We recalculate the checksum since the IP or the payload was modified
 		if packet.isIPv6 {
 			if parsedIP := packet.packet.Layer(layers.LayerTypeIPv6); parsedIP != nil {
 				if parsedUDP := packet.packet.Layer(layers.LayerTypeUDP); parsedUDP != nil {
@@ -230,8 +248,126 @@ func sendPacket(handle packetWriter, packet *multicastPacket, tag uint16, srcMAC
 		}
 	}
 
-	gopacket.SerializePacket(buf, serializeOptions, packet.packet)
+	var serializableLayers []gopacket.SerializableLayer
+	for _, layer := range packet.packet.Layers() {
+		serializableLayer, ok := layer.(gopacket.SerializableLayer)
+		if !ok && packet.rewrittenPayload == nil {
+			logrus.Debugf("Could not send packet, layer %s is not serializable", layer.LayerType())
+			return
+		}
+		if !ok {
+			break
+		}
+		serializableLayers = append(serializableLayers, serializableLayer)
+		if packet.rewrittenPayload != nil && layer.LayerType() == layers.LayerTypeUDP {
+			break
+		}
+	}
+	if packet.rewrittenPayload != nil {
+		// Replace everything after the UDP layer with the new payload
+		serializeOptions.FixLengths = true
+		serializableLayers = append(serializableLayers, gopacket.Payload(packet.rewrittenPayload))
+	}
+	gopacket.SerializeLayers(buf, serializeOptions, tagFrame(serializableLayers, tag)...)
 	handle.WritePacketData(buf.Bytes())
 
 	logrus.Debugf("Packet sent:\n%s", packet.packet.String())
 }
+
+// setSrcPort sets the UDP source port sendPacket sends the packet from, the reply port of a session.
+func (packet *multicastPacket) setSrcPort(port layers.UDPPort) {
+	*packet.srcPort = port
+	packet.rewrittenPorts = true
+}
+
+// setDstPort sets the UDP destination port sendPacket sends the packet to, the port of the querier of a session.
+func (packet *multicastPacket) setDstPort(port layers.UDPPort) {
+	*packet.dstPort = port
+	packet.rewrittenPorts = true
+}
+
+// udpPayload returns the UDP payload sendPacket sends for the packet.
+func (packet *multicastPacket) udpPayload() []byte {
+	if packet.rewrittenPayload != nil {
+		return packet.rewrittenPayload
+	}
+	return packet.payload
+}
+
+// tagFrame returns the layers with a Dot1Q layer for the tag after the Ethernet layer,
+// or without a Dot1Q layer when the tag is 0. The layers of the received packet are not modified.
+func tagFrame(serializableLayers []gopacket.SerializableLayer, tag uint16) []gopacket.SerializableLayer {
+	if len(serializableLayers) < 2 {
+		return serializableLayers
+	}
+	ethernet, ok := serializableLayers[0].(*layers.Ethernet)
+	if !ok {
+		return serializableLayers
+	}
+	sendEth := *ethernet
+	sendTag := layers.Dot1Q{Type: ethernet.EthernetType}
+	rest := serializableLayers[1:]
+	if dot1Q, ok := rest[0].(*layers.Dot1Q); ok {
+		sendTag = *dot1Q
+		rest = rest[1:]
+	}
+
+	tagged := []gopacket.SerializableLayer{&sendEth}
+	if tag == 0 {
+		sendEth.EthernetType = sendTag.Type
+	} else {
+		sendEth.EthernetType = layers.EthernetTypeDot1Q
+		sendTag.VLANIdentifier = tag
+		tagged = append(tagged, &sendTag)
+	}
+	return append(tagged, rest...)
+}
+
+// sendUDP builds a UDP packet from scratch and sends it to the VLAN with the tag, 0 for the native VLAN.
+// The IP version follows srcIP. The IP TTL is 255, as mDNS requires it (RFC 6762 section 11).
+func sendUDP(handle packetWriter, tag uint16, srcMACAddress net.HardwareAddr, dstMacAddress net.HardwareAddr, srcIP net.IP, dstIP net.IP, srcPort layers.UDPPort, dstPort layers.UDPPort, payload []byte) error {
+	sendEth := layers.Ethernet{
+		SrcMAC: srcMACAddress,
+		DstMAC: dstMacAddress,
+	}
+	sendUDP := layers.UDP{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+	}
+	var sendIP gopacket.SerializableLayer
+	if srcIP.To4() != nil {
+		sendEth.EthernetType = layers.EthernetTypeIPv4
+		sendIPv4 := &layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      255,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    srcIP.To4(),
+			DstIP:    dstIP.To4(),
+		}
+		sendUDP.SetNetworkLayerForChecksum(sendIPv4)
+		sendIP = sendIPv4
+	} else {
+		sendEth.EthernetType = layers.EthernetTypeIPv6
+		sendIPv6 := &layers.IPv6{
+			Version:    6,
+			HopLimit:   255,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      srcIP,
+			DstIP:      dstIP,
+		}
+		sendUDP.SetNetworkLayerForChecksum(sendIPv6)
+		sendIP = sendIPv6
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	err := gopacket.SerializeLayers(buf, opts, tagFrame([]gopacket.SerializableLayer{&sendEth, sendIP, &sendUDP, gopacket.Payload(payload)}, tag)...)
+	if err != nil {
+		return err
+	}
+	return handle.WritePacketData(buf.Bytes())
+}
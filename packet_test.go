@@ -34,6 +34,27 @@ func createMockmDNSPacket(isIPv4 bool, isDNSQuery bool) []byte {
 	return createRawPacket(isIPv4, isDNSQuery, vlanIdentifierTest, dstIPv6Test, srcMACTest, dstMACTest, dstUDPPortTest)
 }
 
+// createUDPPacket returns an IPv4 UDP packet with the payload as received on the trunk test0.
+func createUDPPacket(srcMAC, dstMAC string, vlan uint16, srcIP, dstIP string, srcPort, dstPort layers.UDPPort, payload []byte) multicastPacket {
+	src, _ := net.ParseMAC(srcMAC)
+	dst, _ := net.ParseMAC(dstMAC)
+	ipLayer := &layers.IPv4{Version: 4, IHL: 5, TTL: 1, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP(srcIP).To4(), DstIP: net.ParseIP(dstIP).To4()}
+	udpLayer := &layers.UDP{SrcPort: srcPort, DstPort: dstPort}
+	udpLayer.SetNetworkLayerForChecksum(ipLayer)
+
+	buffer := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: src, DstMAC: dst, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: vlan, Type: layers.EthernetTypeIPv4},
+		ipLayer,
+		udpLayer,
+		gopacket.Payload(payload),
+	)
+	packet := parseMulticastPacket(gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true}))
+	packet.netInterface = "test0"
+	return packet
+}
+
 func createRawPacket(isIPv4 bool, isDNSQuery bool, vlanTag uint16, dstIP net.IP, srcMAC net.HardwareAddr, dstMAC net.HardwareAddr, dstPort layers.UDPPort) []byte {
 	var ethernetLayer, dot1QLayer, ipLayer, udpLayer, dnsLayer gopacket.SerializableLayer
 
@@ -342,3 +363,72 @@ func cmpPacket(a, b []gopacket.Layer) bool {
 	bBytes := b[udpLayer].(*layers.UDP).Payload
 	return bytes.Equal(aBytes, bBytes)
 }
+
+func TestSendPacketRewrittenPayload(t *testing.T) {
+	decoder := gopacket.DecodersByLayerName["Ethernet"]
+	initialPacket := gopacket.NewPacket(createMockmDNSPacket(true, false), decoder, gopacket.DecodeOptions{Lazy: true})
+
+	srcMAC, dstMAC := parseEthernetLayer(initialPacket)
+	_, srcIP, dstIP := parseIPLayer(initialPacket)
+	bonjourTestPacket := multicastPacket{
+		packet:           initialPacket,
+		vlanTag:          parseVLANTag(initialPacket),
+		srcMAC:           srcMAC,
+		dstMAC:           dstMAC,
+		srcIP:            srcIP,
+		dstIP:            dstIP,
+		isDNSResponse:    true,
+		rewrittenPayload: (&dnsMessage{flags: dnsFlagResponse}).pack(),
+	}
+
+	pw := &mockPacketWriter{packet: nil}
+	sendPacket(pw, &bonjourTestPacket, 29, brMACTest, dstMACTest, nil, nil)
+
+	udp, ok := pw.packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok || !bytes.Equal(udp.Payload, bonjourTestPacket.rewrittenPayload) {
+		t.Fatal("Error in sendPacket(): payload was not replaced")
+	}
+	if int(udp.Length) != 8+len(bonjourTestPacket.rewrittenPayload) {
+		t.Errorf("Error in sendPacket(): UDP length %d does not match the new payload", udp.Length)
+	}
+	if ipv4 := pw.packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); int(ipv4.Length) != 20+int(udp.Length) {
+		t.Errorf("Error in sendPacket(): IPv4 length %d does not match the new payload", ipv4.Length)
+	}
+}
+
+func TestTagFrame(t *testing.T) {
+	decoder := gopacket.DecodersByLayerName["Ethernet"]
+	initialPacket := gopacket.NewPacket(createMockmDNSPacket(true, true), decoder, gopacket.Default)
+	var serializableLayers []gopacket.SerializableLayer
+	for _, layer := range initialPacket.Layers() {
+		serializableLayers = append(serializableLayers, layer.(gopacket.SerializableLayer))
+	}
+
+	// Untag the frame for the native VLAN
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, tagFrame(serializableLayers, 0)...); err != nil {
+		t.Fatal(err)
+	}
+	untagged := gopacket.NewPacket(buf.Bytes(), decoder, gopacket.Default)
+	if untagged.Layer(layers.LayerTypeDot1Q) != nil || untagged.Layer(layers.LayerTypeIPv4) == nil {
+		t.Fatalf("Error in tagFrame(): expected an untagged IPv4 frame, got\n%s", untagged)
+	}
+	if initialPacket.Layer(layers.LayerTypeEthernet).(*layers.Ethernet).EthernetType != layers.EthernetTypeDot1Q {
+		t.Error("Error in tagFrame(): the layers of the received packet were modified")
+	}
+
+	// Tag the untagged frame again
+	var untaggedLayers []gopacket.SerializableLayer
+	for _, layer := range untagged.Layers() {
+		untaggedLayers = append(untaggedLayers, layer.(gopacket.SerializableLayer))
+	}
+	buf = gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, tagFrame(untaggedLayers, 42)...); err != nil {
+		t.Fatal(err)
+	}
+	tagged := gopacket.NewPacket(buf.Bytes(), decoder, gopacket.Default)
+	dot1Q, ok := tagged.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q)
+	if !ok || dot1Q.VLANIdentifier != 42 || tagged.Layer(layers.LayerTypeIPv4) == nil {
+		t.Errorf("Error in tagFrame(): expected an IPv4 frame tagged with VLAN 42, got\n%s", tagged)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// isEmpty reports whether the rules leave the records and headers as they are.
+func (rules privacyRules) isEmpty() bool {
+	return len(rules.TXTDrop) == 0 && len(rules.TXTReplace) == 0 && rules.InstanceName == "" && len(rules.SSDPDrop) == 0 && len(rules.SSDPReplace) == 0
+}
+
+// extend returns the rules with the rules of 'other' added, the replacements and the instance name of 'other' win.
+func (rules privacyRules) extend(other privacyRules) privacyRules {
+	extended := privacyRules{
+		TXTDrop:      append(slices.Clone(rules.TXTDrop), other.TXTDrop...),
+		TXTReplace:   mergeFold(rules.TXTReplace, other.TXTReplace),
+		InstanceName: rules.InstanceName,
+		SSDPDrop:     append(slices.Clone(rules.SSDPDrop), other.SSDPDrop...),
+		SSDPReplace:  mergeFold(rules.SSDPReplace, other.SSDPReplace),
+	}
+	if other.InstanceName != "" {
+		extended.InstanceName = other.InstanceName
+	}
+	return extended
+}
+
+// mergeFold returns the values of both maps, a key of 'b' replaces the same key of 'a' without case.
+func mergeFold(a, b map[string]string) map[string]string {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	merged := make(map[string]string)
+	for _, values := range []map[string]string{a, b} {
+		for key, value := range values {
+			for other := range merged {
+				if strings.EqualFold(other, key) {
+					delete(merged, other)
+				}
+			}
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+func lookupFold(values map[string]string, key string) (string, bool) {
+	for other, value := range values {
+		if strings.EqualFold(other, key) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// privacyFor returns the privacy rules for a device reflected to the pool: the rules of the [vlan] entry
+// of the pool, extended by the rules of the device and then by the rules of its pool table.
+func (p *policy) privacyFor(device multicastDevice, pool uint16) privacyRules {
+	rules := p.cfg.VlanIPSource[vlanID(strconv.Itoa(int(pool)))].Privacy.extend(device.Privacy)
+	if override, ok := device.poolSettings(pool); ok {
+		rules = rules.extend(override.Privacy)
+	}
+	return rules
+}
+
+// applyPrivacy returns the mDNS message with the TXT records and the instance names rewritten by the rules.
+// 'renamed' is called with the original and the new name of every renamed instance, it may be nil.
+func applyPrivacy(msg *dnsMessage, rules privacyRules, renamed func(original, name string)) *dnsMessage {
+	if rules.isEmpty() {
+		return msg
+	}
+	rewritten := msg.copyMessage()
+	for _, section := range [][]dnsRecord{rewritten.answers, rewritten.authorities, rewritten.additionals} {
+		for i, rr := range section {
+			if rr.rtype == dnsTypeTXT {
+				rr.rdata = filterTXT(rr.rdata, rules)
+			}
+			if rules.InstanceName != "" {
+				rr = mapRecordNames(rr, func(name string) string {
+					renamedName, ok := renameInstance(name, rules.InstanceName)
+					if ok && renamed != nil {
+						renamed(name, renamedName)
+					}
+					return renamedName
+				})
+			}
+			section[i] = rr
+		}
+	}
+	return rewritten
+}
+
+// filterTXT removes and replaces the key/value pairs of TXT record data (RFC 6763 section 6).
+func filterTXT(rdata []byte, rules privacyRules) []byte {
+	var filtered []byte
+	for offset := 0; offset < len(rdata); {
+		length := int(rdata[offset])
+		if offset+1+length > len(rdata) {
+			return rdata
+		}
+		entry := rdata[offset+1 : offset+1+length]
+		offset += 1 + length
+
+		key, _, hasValue := bytes.Cut(entry, []byte("="))
+		if len(key) == 0 {
+			continue
+		}
+		if slices.ContainsFunc(rules.TXTDrop, func(drop string) bool { return strings.EqualFold(drop, string(key)) }) {
+			continue
+		}
+		if value, ok := lookupFold(rules.TXTReplace, string(key)); ok && hasValue {
+			entry = append(append(append([]byte{}, key...), '='), value...)
+			if len(entry) > 255 {
+				entry = entry[:255]
+			}
+		}
+		filtered = append(append(filtered, byte(len(entry))), entry...)
+	}
+	if len(filtered) == 0 {
+		// A TXT record without data has a single empty string
+		return []byte{0}
+	}
+	return filtered
+}
+
+// isInstanceName reports whether the labels are a DNS-SD service instance, like "TV._googlecast._tcp.local".
+func isInstanceName(labels []string) bool {
+	return len(labels) == 4 && !strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_") &&
+		(strings.EqualFold(labels[2], "_tcp") || strings.EqualFold(labels[2], "_udp")) && strings.EqualFold(labels[3], "local")
+}
+
+// renameInstance replaces the instance label of a service instance name, other names are returned as they are.
+func renameInstance(name string, instance string) (string, bool) {
+	labels := splitDNSName(name)
+	if !isInstanceName(labels) || labels[0] == instance {
+		return name, false
+	}
+	labels[0] = instance
+	return joinDNSLabels(labels), true
+}
+
+// mapRecordNames returns the record with its name and the names in its data of PTR, CNAME, NS, SRV and NSEC
+// records replaced by 'f'.
+func mapRecordNames(rr dnsRecord, f func(string) string) dnsRecord {
+	rr.name = f(rr.name)
+	switch rr.rtype {
+	case dnsTypePTR, dnsTypeCNAME, dnsTypeNS:
+		rr.rdata = appendDNSName(nil, f(rr.target()), nil, 0)
+	case dnsTypeSRV:
+		if len(rr.rdata) > 6 {
+			rr.rdata = appendDNSName(append([]byte{}, rr.rdata[:6]...), f(rr.target()), nil, 0)
+		}
+	case dnsTypeNSEC:
+		if _, offset, err := readDNSName(rr.rdata, 0); err == nil {
+			rr.rdata = append(appendDNSName(nil, f(rr.target()), nil, 0), rr.rdata[offset:]...)
+		}
+	}
+	return rr
+}
+
+// instanceRenames remembers per pool the original names of the instances renamed by instance_name, so
+// queries for the new name can be sent to the devices with the name they know.
+type instanceRenames struct {
+	mu    sync.Mutex
+	names map[renameKey]string
+}
+
+type renameKey struct {
+	vlan uint16
+	name string
+}
+
+func newInstanceRenames() *instanceRenames {
+	return &instanceRenames{names: make(map[renameKey]string)}
+}
+
+// recorder returns the function applyPrivacy reports the renamed instances of the pool to.
+func (renames *instanceRenames) recorder(vlan uint16) func(original, name string) {
+	return func(original, name string) {
+		renames.mu.Lock()
+		defer renames.mu.Unlock()
+		renames.names[renameKey{vlan, cacheName(name)}] = original
+	}
+}
+
+// original returns the name the device knows for a name in the pool.
+func (renames *instanceRenames) original(vlan uint16, name string) string {
+	renames.mu.Lock()
+	defer renames.mu.Unlock()
+	if original, ok := renames.names[renameKey{vlan, cacheName(name)}]; ok {
+		return original
+	}
+	return name
+}
+
+// restore returns the query from the pool with the original names of the renamed instances, and whether
+// any name was restored.
+func (renames *instanceRenames) restore(vlan uint16, query *dnsMessage) (*dnsMessage, bool) {
+	renames.mu.Lock()
+	empty := len(renames.names) == 0
+	renames.mu.Unlock()
+	if empty {
+		return query, false
+	}
+
+	restored, changed := query.copyMessage(), false
+	original := func(name string) string {
+		if original := renames.original(vlan, name); original != name {
+			changed = true
+			return original
+		}
+		return name
+	}
+	for i := range restored.questions {
+		restored.questions[i].name = original(restored.questions[i].name)
+	}
+	for _, section := range [][]dnsRecord{restored.answers, restored.authorities, restored.additionals} {
+		for i := range section {
+			section[i] = mapRecordNames(section[i], original)
+		}
+	}
+	return restored, changed
+}
+
+// filterSSDPHeaders removes and replaces the headers of an SSDP advertisement or response.
+// The start line and the headers which are not in the rules are kept as they are.
+func filterSSDPHeaders(payload []byte, rules privacyRules) []byte {
+	if len(rules.SSDPDrop) == 0 && len(rules.SSDPReplace) == 0 {
+		return payload
+	}
+	head, body, found := bytes.Cut(payload, []byte("\r\n\r\n"))
+	lines := bytes.Split(head, []byte("\r\n"))
+	filtered := [][]byte{lines[0]}
+	for _, line := range lines[1:] {
+		name, _, ok := bytes.Cut(line, []byte(":"))
+		header := strings.TrimSpace(string(name))
+		if ok && slices.ContainsFunc(rules.SSDPDrop, func(drop string) bool { return strings.EqualFold(drop, header) }) {
+			continue
+		}
+		if value, replace := lookupFold(rules.SSDPReplace, header); ok && replace {
+			line = []byte(header + ": " + value)
+		}
+		filtered = append(filtered, line)
+	}
+	rewritten := bytes.Join(filtered, []byte("\r\n"))
+	if found {
+		rewritten = append(append(rewritten, "\r\n\r\n"...), body...)
+	}
+	return rewritten
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterTXT(t *testing.T) {
+	rules := privacyRules{TXTDrop: []string{"id"}, TXTReplace: map[string]string{"FN": "TV"}}
+	testCases := []struct {
+		rdata, expected string
+	}{
+		{"\x05id=42\x0cfn=Jane's TV\x05md=TV", "\x05fn=TV\x05md=TV"},
+		{"\x02id", "\x00"},
+		{"\x02fn", "\x02fn"},
+		{"\x09truncated", "\x09truncated"},
+	}
+	for _, testCase := range testCases {
+		if computedResult := string(filterTXT([]byte(testCase.rdata), rules)); computedResult != testCase.expected {
+			t.Errorf("Error in filterTXT(%q): expected %q, got %q", testCase.rdata, testCase.expected, computedResult)
+		}
+	}
+}
+
+func TestApplyPrivacy(t *testing.T) {
+	renames := newInstanceRenames()
+	msg := applyPrivacy(createMockServiceResponse(), privacyRules{InstanceName: "TV", TXTDrop: []string{"md"}}, renames.recorder(101))
+	names := func(records []dnsRecord) (names []string) {
+		for _, rr := range records {
+			names = append(names, rr.name+"/"+rr.target())
+		}
+		return names
+	}
+
+	expectedAnswers := []string{
+		"_googlecast._tcp.local/TV._googlecast._tcp.local",
+		"_spotify-connect._tcp.local/TV._spotify-connect._tcp.local",
+		"_services._dns-sd._udp.local/_googlecast._tcp.local",
+		"_services._dns-sd._udp.local/_spotify-connect._tcp.local",
+	}
+	if computedResult := names(msg.answers); !reflect.DeepEqual(expectedAnswers, computedResult) {
+		t.Errorf("Error in applyPrivacy(): got answers %q", computedResult)
+	}
+	if msg.additionals[0].name != "TV._googlecast._tcp.local" || msg.additionals[0].target() != "tv.local" {
+		t.Errorf("Error in applyPrivacy(): got SRV record %s/%s", msg.additionals[0].name, msg.additionals[0].target())
+	}
+	if txt := string(msg.additionals[1].rdata); txt != "\x00" {
+		t.Errorf("Error in applyPrivacy(): expected the md key to be dropped, got %q", txt)
+	}
+	if original := createMockServiceResponse(); original.answers[0].target() != "Living Room TV._googlecast._tcp.local" {
+		t.Error("Error in applyPrivacy(): the original message was modified")
+	}
+
+	// Queries from the pool for the new name are restored to the name the device knows
+	query := &dnsMessage{questions: []dnsQuestion{{name: "tv._googlecast._tcp.local", qtype: dnsTypeSRV, qclass: dnsClassIN}}}
+	restored, ok := renames.restore(101, query)
+	if !ok || restored.questions[0].name != "Living Room TV._googlecast._tcp.local" {
+		t.Errorf("Error in restore(): expected the original instance name, got %+v", restored.questions)
+	}
+	if _, ok := renames.restore(102, query); ok {
+		t.Error("Error in restore(): restored a name renamed for another pool")
+	}
+}
+
+func TestPrivacyFor(t *testing.T) {
+	device := multicastDevice{
+		OriginPool:  100,
+		SharedPools: []uint16{101, 102},
+		Privacy:     privacyRules{TXTDrop: []string{"id"}, TXTReplace: map[string]string{"fn": "Device"}},
+		Pools:       map[vlanID]sharedPool{"102": {Privacy: privacyRules{InstanceName: "Guest TV", TXTReplace: map[string]string{"FN": "Guest"}}}},
+	}
+	active := newPolicy(config{
+		Devices:      map[macAddress]multicastDevice{"aa:bb:cc:dd:ee:ff": device},
+		VlanIPSource: map[vlanID]vlanIpSource{"102": {Privacy: privacyRules{TXTDrop: []string{"serial"}, SSDPDrop: []string{"USN"}}}},
+	})
+
+	if computedResult := active.privacyFor(device, 101); !reflect.DeepEqual(device.Privacy, computedResult) {
+		t.Errorf("Error in privacyFor(): expected the device rules on VLAN 101, got %+v", computedResult)
+	}
+	expectedResult := privacyRules{
+		TXTDrop:      []string{"serial", "id"},
+		TXTReplace:   map[string]string{"FN": "Guest"},
+		InstanceName: "Guest TV",
+		SSDPDrop:     []string{"USN"},
+	}
+	if computedResult := active.privacyFor(device, 102); !reflect.DeepEqual(expectedResult, computedResult) {
+		t.Errorf("Error in privacyFor(): expected %+v on VLAN 102, got %+v", expectedResult, computedResult)
+	}
+}
+
+func TestFilterSSDPHeaders(t *testing.T) {
+	payload := "HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=1800\r\nServer: Linux/5.10 UPnP/1.0 Jane's TV/1.2\r\nUSN: uuid:1234::upnp:rootdevice\r\nX-Serial: 42\r\n\r\n"
+	rules := privacyRules{SSDPDrop: []string{"x-serial"}, SSDPReplace: map[string]string{"SERVER": "UPnP/1.0"}}
+	expectedResult := "HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=1800\r\nServer: UPnP/1.0\r\nUSN: uuid:1234::upnp:rootdevice\r\n\r\n"
+	if computedResult := string(filterSSDPHeaders([]byte(payload), rules)); computedResult != expectedResult {
+		t.Errorf("Error in filterSSDPHeaders(): expected %q, got %q", expectedResult, computedResult)
+	}
+	if computedResult := string(filterSSDPHeaders([]byte(payload), privacyRules{TXTDrop: []string{"id"}})); computedResult != payload {
+		t.Errorf("Error in filterSSDPHeaders(): expected the payload without SSDP rules, got %q", computedResult)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ssdpProxy is the HTTP proxy for the LOCATION URLs of the shared SSDP devices, when ssdp_proxy_port is set.
+// It listens on the ip_source of every VLAN, and a client can only reach the devices shared with its VLAN.
+type ssdpProxy struct {
+	policies *policyStore
+
+	mu sync.Mutex
+	// targets are the device addresses behind the proxy URLs, by the first path segment of the URL
+	targets map[string]proxyTarget
+	// listeners are the running listeners by VLAN
+	listeners map[uint16]net.Listener
+}
+
+type proxyTarget struct {
+	device macAddress
+	// host is the host:port of the LOCATION URL of the device
+	host    string
+	expires time.Time
+}
+
+// proxyTargetTTL is how long a proxy URL stays valid after the device last advertised its LOCATION.
+var proxyTargetTTL = time.Hour
+
+// proxyTimeout limits a request to a device, SSDP descriptions are small.
+var proxyTimeout = 30 * time.Second
+
+func newSSDPProxy(policies *policyStore) *ssdpProxy {
+	return &ssdpProxy{policies: policies, targets: make(map[string]proxyTarget), listeners: make(map[uint16]net.Listener)}
+}
+
+// serve starts and stops the listeners after every reload, until stop is closed.
+func (proxy *ssdpProxy) serve(stop chan struct{}) {
+	reloaded := proxy.policies.subscribe()
+	for {
+		proxy.listen(proxy.policies.Load())
+		select {
+		case <-stop:
+			proxy.listen(newPolicy(config{}))
+			return
+		case <-reloaded:
+		}
+	}
+}
+
+// listen listens on ip_source:ssdp_proxy_port of every VLAN in the policy, and closes the other listeners.
+func (proxy *ssdpProxy) listen(active *policy) {
+	addresses := make(map[uint16]string)
+	if port := active.cfg.SSDPProxyPort; port != 0 {
+		for vlan, ip := range mapIpSourceByVlan(active.cfg.VlanIPSource) {
+			addresses[vlan] = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+		}
+	}
+
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	for vlan, listener := range proxy.listeners {
+		if listener.Addr().String() != addresses[vlan] {
+			listener.Close()
+			delete(proxy.listeners, vlan)
+		}
+	}
+	for vlan, address := range addresses {
+		if _, ok := proxy.listeners[vlan]; ok {
+			continue
+		}
+		host, _, _ := net.SplitHostPort(address)
+		subnet := interfaceNetwork(net.ParseIP(host))
+		if subnet == nil {
+			logrus.Warningf("SSDP proxy cannot listen on %s for VLAN %d, LOCATION URLs are reflected unchanged: the address is not assigned to an interface", address, vlan)
+			continue
+		}
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			logrus.Warningf("SSDP proxy cannot listen on %s for VLAN %d, LOCATION URLs are reflected unchanged: %v", address, vlan, err)
+			continue
+		}
+		proxy.listeners[vlan] = listener
+		logrus.Infof("SSDP proxy listening on %s for VLAN %d, clients from %s", address, vlan, subnet)
+		server := &http.Server{Handler: proxy.handler(vlan, listener.Addr().String(), subnet), ReadHeaderTimeout: proxyTimeout}
+		go server.Serve(listener)
+	}
+}
+
+// location returns the LOCATION URL of a device advertised to the VLAN as a URL of the proxy. It returns false
+// when the proxy does not listen on the VLAN, or the URL is not a plain HTTP URL on the source address of the device.
+func (proxy *ssdpProxy) location(vlan uint16, device macAddress, srcIP net.IP, location string) (string, bool) {
+	if proxy == nil {
+		return "", false
+	}
+	target, err := url.Parse(location)
+	if err != nil || target.Scheme != "http" || target.User != nil || srcIP == nil || !srcIP.Equal(net.ParseIP(target.Hostname())) {
+		return "", false
+	}
+	host := target.Host
+	if target.Port() == "" {
+		host = net.JoinHostPort(target.Hostname(), "80")
+	}
+
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	listener, ok := proxy.listeners[vlan]
+	if !ok {
+		return "", false
+	}
+	now := time.Now()
+	for token, other := range proxy.targets {
+		if now.After(other.expires) {
+			delete(proxy.targets, token)
+		}
+	}
+	token := proxyToken(device, host)
+	proxy.targets[token] = proxyTarget{device: device, host: host, expires: now.Add(proxyTargetTTL)}
+
+	target.Scheme, target.Host = "http", listener.Addr().String()
+	target.Path = "/" + token + target.EscapedPath()
+	target.RawPath = ""
+	return target.String(), true
+}
+
+// proxyToken returns the first path segment of the proxy URLs of a device address.
+func proxyToken(device macAddress, host string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(string(device)) + "|" + host))
+	return hex.EncodeToString(sum[:8])
+}
+
+// interfaceNetwork returns the network of the interface address of the host which is the IP, or nil when the
+// IP is not assigned to the host.
+func interfaceNetwork(ip net.IP) *net.IPNet {
+	addresses, err := net.InterfaceAddrs()
+	if err != nil || ip == nil {
+		return nil
+	}
+	for _, address := range addresses {
+		if network, ok := address.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return &net.IPNet{IP: ip.Mask(network.Mask), Mask: network.Mask}
+		}
+	}
+	return nil
+}
+
+// handler returns the handler of the listener of the VLAN at the address. It forwards a request from a client
+// in the subnet of the VLAN to the device of the URL when the device is shared with the VLAN, and rewrites the
+// URLs of the device in description XML. Routed clients of other VLANs are refused, as the listener would
+// otherwise give them the devices of this VLAN.
+func (proxy *ssdpProxy) handler(vlan uint16, address string, subnet *net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if clientIP := net.ParseIP(client); clientIP == nil || !subnet.Contains(clientIP) {
+			logrus.Infof("SSDP proxy refused %s from %s, the client is not in the subnet %s of VLAN %d", r.URL.Path, r.RemoteAddr, subnet, vlan)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		token, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		proxy.mu.Lock()
+		target, ok := proxy.targets[token]
+		proxy.mu.Unlock()
+		if !ok || time.Now().After(target.expires) {
+			http.NotFound(w, r)
+			return
+		}
+		active := proxy.policies.Load()
+		device, ok := active.allowedDevices.devices[target.device]
+		if !ok || !slices.Contains(device.SharedPools, vlan) || !device.sharedAt(vlan, time.Now()) {
+			logrus.Infof("SSDP proxy refused %s from %s, device %s is not shared with VLAN %d", r.URL.Path, r.RemoteAddr, target.device, vlan)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		base := "http://" + address + "/" + token
+		reverse := &httputil.ReverseProxy{
+			Rewrite: func(out *httputil.ProxyRequest) {
+				out.Out.URL.Scheme = "http"
+				out.Out.URL.Host = target.host
+				out.Out.URL.Path = "/" + path
+				out.Out.URL.RawPath = ""
+				out.Out.Host = target.host
+			},
+			ModifyResponse: func(response *http.Response) error {
+				return rewriteDescription(response, "http://"+target.host, base)
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				logrus.Debugf("SSDP proxy cannot reach device %s at %s: %v", target.device, target.host, err)
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), proxyTimeout)
+		defer cancel()
+		reverse.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// rewriteDescription replaces the URLs of the device in an XML response, like its URLBase, by the URLs of the proxy.
+func rewriteDescription(response *http.Response, device string, proxy string) error {
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if mediaType != "text/xml" && mediaType != "application/xml" || response.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return err
+	}
+	body = bytes.ReplaceAll(body, []byte(device), []byte(proxy))
+	if host, port, err := net.SplitHostPort(strings.TrimPrefix(device, "http://")); err == nil && port == "80" {
+		body = bytes.ReplaceAll(body, []byte("http://"+host+"/"), []byte(proxy+"/"))
+	}
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	response.ContentLength = int64(len(body))
+	response.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// rewriteLocation returns the payload of an SSDP advertisement or response with the LOCATION header replaced
+// by the URL from 'location'. The payload is returned as it is when the URL is not replaced.
+func rewriteLocation(payload []byte, location func(string) (string, bool)) []byte {
+	head, body, found := bytes.Cut(payload, []byte("\r\n\r\n"))
+	lines := bytes.Split(head, []byte("\r\n"))
+	for i, line := range lines[1:] {
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !strings.EqualFold(strings.TrimSpace(string(name)), "LOCATION") {
+			continue
+		}
+		proxied, ok := location(strings.TrimSpace(string(value)))
+		if !ok {
+			return payload
+		}
+		lines[i+1] = []byte(string(name) + ": " + proxied)
+		rewritten := bytes.Join(lines, []byte("\r\n"))
+		if found {
+			rewritten = append(append(rewritten, "\r\n\r\n"...), body...)
+		}
+		return rewritten
+	}
+	return payload
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSSDPProxy(t *testing.T) {
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/description.xml" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		io.WriteString(w, "<root><URLBase>http://"+r.Host+"/</URLBase></root>")
+	}))
+	defer device.Close()
+	deviceURL, _ := url.Parse(device.URL)
+
+	cfg := config{
+		Devices: map[macAddress]multicastDevice{
+			"aa:bb:cc:dd:ee:ff": {OriginPool: 100, SharedPools: []uint16{101}},
+		},
+	}
+	proxy := newSSDPProxy(newPolicyStore(newPolicy(cfg)))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	proxy.listeners[101] = listener
+	proxy.listeners[102] = listener
+
+	srcIP := net.ParseIP(deviceURL.Hostname())
+	if _, ok := proxy.location(101, "aa:bb:cc:dd:ee:ff", net.ParseIP("192.168.1.10"), device.URL+"/description.xml"); ok {
+		t.Error("Error in location(): proxied a LOCATION which is not on the source address of the device")
+	}
+	if _, ok := proxy.location(103, "aa:bb:cc:dd:ee:ff", srcIP, device.URL+"/description.xml"); ok {
+		t.Error("Error in location(): proxied a LOCATION for a VLAN the proxy does not listen on")
+	}
+	location, ok := proxy.location(101, "aa:bb:cc:dd:ee:ff", srcIP, device.URL+"/description.xml")
+	if !ok || !strings.HasPrefix(location, "http://"+listener.Addr().String()+"/") || !strings.HasSuffix(location, "/description.xml") {
+		t.Fatalf("Error in location(): expected a URL of the proxy, got %s", location)
+	}
+	proxied, _ := url.Parse(location)
+	_, subnet, _ := net.ParseCIDR("192.0.2.0/24")
+
+	// The description is served with the URLBase of the proxy to the VLAN the device is shared with
+	recorder := httptest.NewRecorder()
+	proxy.handler(101, listener.Addr().String(), subnet).ServeHTTP(recorder, httptest.NewRequest("GET", proxied.Path, nil))
+	expectedResult := "<root><URLBase>" + strings.TrimSuffix(location, "description.xml") + "</URLBase></root>"
+	if recorder.Code != http.StatusOK || recorder.Body.String() != expectedResult {
+		t.Errorf("Error in handler(): expected %s, got %d %s", expectedResult, recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	proxy.handler(102, listener.Addr().String(), subnet).ServeHTTP(recorder, httptest.NewRequest("GET", proxied.Path, nil))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Error in handler(): expected a client of VLAN 102 to be refused, got %d", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	proxy.handler(101, listener.Addr().String(), subnet).ServeHTTP(recorder, httptest.NewRequest("GET", "/0123456789abcdef/description.xml", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Error in handler(): expected an unknown URL to be refused, got %d", recorder.Code)
+	}
+
+	// A routed client of another VLAN cannot use the listener of VLAN 101
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest("GET", proxied.Path, nil)
+	request.RemoteAddr = "198.51.100.7:51234"
+	proxy.handler(101, listener.Addr().String(), subnet).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Error in handler(): expected a client outside the subnet of VLAN 101 to be refused, got %d", recorder.Code)
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	payload := "NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nLocation: http://192.168.1.10:8008/ssdp/device-desc.xml\r\nNTS: ssdp:alive\r\n\r\n"
+	location := func(url string) (string, bool) {
+		return "http://192.168.101.2:8200/token/ssdp/device-desc.xml", url == "http://192.168.1.10:8008/ssdp/device-desc.xml"
+	}
+	expectedResult := "NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nLocation: http://192.168.101.2:8200/token/ssdp/device-desc.xml\r\nNTS: ssdp:alive\r\n\r\n"
+	if computedResult := string(rewriteLocation([]byte(payload), location)); computedResult != expectedResult {
+		t.Errorf("Error in rewriteLocation(): expected %q, got %q", expectedResult, computedResult)
+	}
+	unchanged := strings.Replace(payload, "8008", "8009", 1)
+	if computedResult := string(rewriteLocation([]byte(unchanged), location)); computedResult != unchanged {
+		t.Errorf("Error in rewriteLocation(): expected the payload unchanged, got %q", computedResult)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// policy holds the forwarding maps derived from one version of the config file.
+// A policy is never modified after it is created, a reload swaps in a new one.
+type policy struct {
+	cfg            config
+	poolsMap       map[uint16][]uint16
+	vlanIPMap      map[uint16]net.IP
+	vlanIP6Map     map[uint16]net.IP
+	vlanInterface  map[uint16]string
+	allowedDevices *deviceMatcher
+	stripNetworks  []*net.IPNet
+	vlanRateLimit  map[uint16]int
+	coalesceWindow time.Duration
+	gatewayClients []gatewaySubnet
+	staticRecords  map[uint16][]dnsRecord
+}
+
+func newPolicy(cfg config) *policy {
+	window, err := parseCoalesceWindow(cfg.CoalesceWindow)
+	if err != nil {
+		logrus.Errorf("cannot decode coalesce_window %s: %v", cfg.CoalesceWindow, err)
+	}
+	return &policy{
+		cfg:            cfg,
+		poolsMap:       mapByPool(cfg.Devices),
+		vlanIPMap:      mapIpSourceByVlan(cfg.VlanIPSource),
+		vlanIP6Map:     mapIp6SourceByVlan(cfg.VlanIPSource),
+		vlanInterface:  mapInterfaceByVlan(cfg),
+		allowedDevices: newDeviceMatcher(compileSharingRules(mapLowerCaseMac(cfg.Devices))),
+		stripNetworks:  stripNetworks(cfg),
+		vlanRateLimit:  mapRateLimitByVlan(cfg),
+		coalesceWindow: window,
+		gatewayClients: gatewaySubnets(cfg),
+		staticRecords:  mapStaticRecordsByVlan(cfg.StaticServices),
+	}
+}
+
+// rateLimit returns the max_packets_per_second of the VLAN per protocol, 0 when there is no limit.
+func (p *policy) rateLimit(vlan uint16) int {
+	if limit, ok := p.vlanRateLimit[vlan]; ok {
+		return limit
+	}
+	return p.cfg.MaxPacketsPerSecond
+}
+
+// gatewayPool returns the VLAN whose shared devices the DNS gateway serves to the client.
+func (p *policy) gatewayPool(client net.IP) (uint16, bool) {
+	for _, subnet := range p.gatewayClients {
+		if subnet.network.Contains(client) {
+			return subnet.vlan, true
+		}
+	}
+	return 0, false
+}
+
+// cachesResponses reports whether the responses of the devices are stored in the mDNS cache.
+func (p *policy) cachesResponses() bool {
+	return p.cfg.MDNSCache || p.cfg.DNSGateway.Listen != ""
+}
+
+// interfaceOf returns the trunk interface which carries the VLAN, or "" for a VLAN which is not in interfaces.
+func (p *policy) interfaceOf(vlan uint16) string {
+	if name, ok := p.vlanInterface[vlan]; ok {
+		return name
+	}
+	if len(p.cfg.Interfaces) != 0 {
+		return ""
+	}
+	return p.cfg.NetInterface
+}
+
+// vlanOf returns the VLAN of a frame received on a trunk, untagged frames belong to the native VLAN.
+// It returns false when the VLAN is not carried by the trunk.
+func (p *policy) vlanOf(netInterface string, tag *uint16) (uint16, bool) {
+	if tag == nil {
+		return p.cfg.NativeVlan, p.cfg.NativeVlan != 0 && p.interfaceOf(p.cfg.NativeVlan) == netInterface
+	}
+	return *tag, p.interfaceOf(*tag) == netInterface
+}
+
+// wireTag returns the 802.1Q tag to send frames to the VLAN with, 0 for the native VLAN which is untagged.
+func (p *policy) wireTag(vlan uint16) uint16 {
+	if vlan == p.cfg.NativeVlan {
+		return 0
+	}
+	return vlan
+}
+
+// vlanIPsOn returns the ip_source addresses of the VLANs on one trunk interface.
+func (p *policy) vlanIPsOn(netInterface string) map[uint16]net.IP {
+	vlanIPMap := make(map[uint16]net.IP)
+	for vlan, ip := range p.vlanIPMap {
+		if p.interfaceOf(vlan) == netInterface {
+			vlanIPMap[vlan] = ip
+		}
+	}
+	return vlanIPMap
+}
+
+// policyStore gives the packet processors access to the active policy.
+type policyStore struct {
+	current atomic.Pointer[policy]
+
+	mu sync.Mutex
+	// subscribers are signalled after a new policy has been stored
+	subscribers []chan struct{}
+}
+
+func newPolicyStore(p *policy) *policyStore {
+	store := &policyStore{}
+	store.current.Store(p)
+	return store
+}
+
+// subscribe returns a channel which is signalled after every reload.
+func (store *policyStore) subscribe() <-chan struct{} {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	reloaded := make(chan struct{}, 1)
+	store.subscribers = append(store.subscribers, reloaded)
+	return reloaded
+}
+
+func (store *policyStore) Load() *policy {
+	return store.current.Load()
+}
+
+func (store *policyStore) swap(p *policy) {
+	store.current.Store(p)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, reloaded := range store.subscribers {
+		select {
+		case reloaded <- struct{}{}:
+		default:
+		}
+	}
+}
+
+var configPollInterval = 5 * time.Second
+
+// watchConfig reloads the config file on SIGHUP or when the file, or one of the files it includes, changes on disk.
+//
+// watchConfig loops until 'stop' is closed.
+func watchConfig(path string, store *policyStore, stop chan struct{}) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	lastVersion := configVersion(path)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hangup:
+			logrus.Infof("Received SIGHUP, reloading %s", path)
+			lastVersion = configVersion(path)
+			reloadConfig(path, store)
+		case <-ticker.C:
+			version := configVersion(path)
+			if version == "" || version == lastVersion {
+				continue
+			}
+			lastVersion = version
+			logrus.Infof("Config file %s changed, reloading", path)
+			reloadConfig(path, store)
+		}
+	}
+}
+
+// configVersion returns the modification time and size of the config files, so a change
+// to one of them, or an added or removed file, changes the version.
+func configVersion(path string) string {
+	paths := []string{path}
+	if files, err := loadConfigFiles(path); err == nil {
+		paths = paths[:0]
+		for _, file := range files {
+			paths = append(paths, file.path)
+		}
+	}
+
+	var version strings.Builder
+	for _, file := range paths {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return ""
+		}
+		fmt.Fprintf(&version, "%s %d %d\n", file, stat.ModTime().UnixNano(), stat.Size())
+	}
+	return version.String()
+}
+
+// reloadConfig reads the config file and swaps in the new policy.
+// The active policy is kept when the new config cannot be read.
+func reloadConfig(path string, store *policyStore) {
+	cfg, err := readConfig(path)
+	if err != nil {
+		logrus.Errorf("Could not reload configuration, keeping the active one: %v", err)
+		return
+	}
+
+	old := store.Load()
+	if len(cfg.Interfaces) == 0 && len(old.cfg.Interfaces) == 0 && cfg.NetInterface != old.cfg.NetInterface {
+		logrus.Warningf("net_interface changed from %s to %s, this requires a restart. Keeping %s.", old.cfg.NetInterface, cfg.NetInterface, old.cfg.NetInterface)
+		cfg.NetInterface = old.cfg.NetInterface
+	}
+	for _, name := range cfg.interfaces() {
+		if !slices.Contains(old.cfg.interfaces(), name) {
+			logrus.Warningf("Interface %s is new, this requires a restart. Its VLANs are not reflected until then.", name)
+		}
+	}
+	if cfg.DNSGateway.Listen != old.cfg.DNSGateway.Listen {
+		logrus.Warningf("dns_gateway listen changed from %q to %q, this requires a restart. Keeping %q.", old.cfg.DNSGateway.Listen, cfg.DNSGateway.Listen, old.cfg.DNSGateway.Listen)
+		cfg.DNSGateway.Listen = old.cfg.DNSGateway.Listen
+	}
+
+	// diffConfig only describes the settings an operator looks for in the log, the policy is
+	// swapped whenever the config differs, so no other setting is silently kept
+	if reflect.DeepEqual(old.cfg, cfg) {
+		logrus.Info("Configuration reloaded, no changes")
+		return
+	}
+	changes := diffConfig(old.cfg, cfg)
+	if len(changes) == 0 {
+		logrus.Info("Configuration reloaded, no device or VLAN changes")
+	}
+	for _, change := range changes {
+		logrus.Infof("Configuration change: %s", change)
+	}
+	store.swap(newPolicy(cfg))
+}
+
+// diffConfig describes the device and VLAN differences between two configs.
+func diffConfig(oldCfg, newCfg config) []string {
+	var changes []string
+
+	oldDevices := mapLowerCaseMac(oldCfg.Devices)
+	newDevices := mapLowerCaseMac(newCfg.Devices)
+	for _, mac := range sortedMacs(oldDevices, newDevices) {
+		oldDevice, inOld := oldDevices[mac]
+		newDevice, inNew := newDevices[mac]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("device %s (%s) added, origin_pool %d, shared_pools %v", mac, newDevice.Description, newDevice.OriginPool, newDevice.SharedPools))
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("device %s (%s) removed", mac, oldDevice.Description))
+		case !reflect.DeepEqual(oldDevice, newDevice):
+			changes = append(changes, fmt.Sprintf("device %s (%s) changed, origin_pool %d -> %d, shared_pools %v -> %v", mac, newDevice.Description, oldDevice.OriginPool, newDevice.OriginPool, oldDevice.SharedPools, newDevice.SharedPools))
+		}
+	}
+
+	oldVlans := mapIpSourceByVlan(oldCfg.VlanIPSource)
+	newVlans := mapIpSourceByVlan(newCfg.VlanIPSource)
+	for _, vlan := range sortedVlans(oldVlans, newVlans) {
+		oldIP, inOld := oldVlans[vlan]
+		newIP, inNew := newVlans[vlan]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("vlan %d added, ip_source %s", vlan, newIP))
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("vlan %d removed, ip_source was %s", vlan, oldIP))
+		case !oldIP.Equal(newIP):
+			changes = append(changes, fmt.Sprintf("vlan %d ip_source changed from %s to %s", vlan, oldIP, newIP))
+		}
+	}
+
+	oldIP6s := mapIp6SourceByVlan(oldCfg.VlanIPSource)
+	newIP6s := mapIp6SourceByVlan(newCfg.VlanIPSource)
+	for _, vlan := range sortedVlans(oldIP6s, newIP6s) {
+		if !oldIP6s[vlan].Equal(newIP6s[vlan]) {
+			changes = append(changes, fmt.Sprintf("vlan %d ip6_source changed from %v to %v", vlan, oldIP6s[vlan], newIP6s[vlan]))
+		}
+	}
+
+	oldLimits := mapRateLimitByVlan(oldCfg)
+	newLimits := mapRateLimitByVlan(newCfg)
+	for _, vlan := range sortedVlans(oldLimits, newLimits) {
+		if oldLimits[vlan] != newLimits[vlan] {
+			changes = append(changes, fmt.Sprintf("vlan %d max_packets_per_second changed from %d to %d", vlan, oldLimits[vlan], newLimits[vlan]))
+		}
+	}
+
+	oldTargets := mapSSDPUnicastTargetByVlan(oldCfg)
+	newTargets := mapSSDPUnicastTargetByVlan(newCfg)
+	for _, vlan := range sortedVlans(oldTargets, newTargets) {
+		if oldTargets[vlan] != newTargets[vlan] {
+			changes = append(changes, fmt.Sprintf("vlan %d ssdp_unicast_target changed from %q to %q", vlan, oldTargets[vlan], newTargets[vlan]))
+		}
+	}
+
+	oldPrivacy := mapPrivacyByVlan(oldCfg)
+	newPrivacy := mapPrivacyByVlan(newCfg)
+	for _, vlan := range sortedVlans(oldPrivacy, newPrivacy) {
+		if !reflect.DeepEqual(oldPrivacy[vlan], newPrivacy[vlan]) {
+			changes = append(changes, fmt.Sprintf("vlan %d privacy changed from %+v to %+v", vlan, oldPrivacy[vlan], newPrivacy[vlan]))
+		}
+	}
+
+	if oldCfg.NativeVlan != newCfg.NativeVlan {
+		changes = append(changes, fmt.Sprintf("native_vlan changed from %d to %d", oldCfg.NativeVlan, newCfg.NativeVlan))
+	}
+	if !slices.Equal(oldCfg.StripAddresses, newCfg.StripAddresses) {
+		changes = append(changes, fmt.Sprintf("strip_addresses changed from %v to %v", oldCfg.StripAddresses, newCfg.StripAddresses))
+	}
+	if oldCfg.MaxPacketsPerSecond != newCfg.MaxPacketsPerSecond {
+		changes = append(changes, fmt.Sprintf("max_packets_per_second changed from %d to %d", oldCfg.MaxPacketsPerSecond, newCfg.MaxPacketsPerSecond))
+	}
+	if oldCfg.CoalesceWindow != newCfg.CoalesceWindow {
+		changes = append(changes, fmt.Sprintf("coalesce_window changed from %q to %q", oldCfg.CoalesceWindow, newCfg.CoalesceWindow))
+	}
+	if oldCfg.SSDPProxyPort != newCfg.SSDPProxyPort {
+		changes = append(changes, fmt.Sprintf("ssdp_proxy_port changed from %d to %d", oldCfg.SSDPProxyPort, newCfg.SSDPProxyPort))
+	}
+	if oldCfg.ValidateAnswers != newCfg.ValidateAnswers {
+		changes = append(changes, fmt.Sprintf("validate_answers changed from %q to %q", oldCfg.ValidateAnswers, newCfg.ValidateAnswers))
+	}
+	if !reflect.DeepEqual(oldCfg.DNSGateway, newCfg.DNSGateway) {
+		changes = append(changes, "dns_gateway changed")
+	}
+	if !reflect.DeepEqual(oldCfg.StaticServices, newCfg.StaticServices) {
+		changes = append(changes, fmt.Sprintf("static_services changed, %d -> %d services", len(oldCfg.StaticServices), len(newCfg.StaticServices)))
+	}
+	if oldCfg.MDNSCache != newCfg.MDNSCache {
+		changes = append(changes, fmt.Sprintf("mdns_cache changed from %t to %t", oldCfg.MDNSCache, newCfg.MDNSCache))
+	}
+	if oldCfg.SSDPCache != newCfg.SSDPCache {
+		changes = append(changes, fmt.Sprintf("ssdp_cache changed from %t to %t", oldCfg.SSDPCache, newCfg.SSDPCache))
+	}
+
+	oldInterfaces := mapInterfaceByVlan(oldCfg)
+	newInterfaces := mapInterfaceByVlan(newCfg)
+	if !reflect.DeepEqual(oldCfg.Interfaces, newCfg.Interfaces) {
+		changes = append(changes, fmt.Sprintf("interfaces changed from %v to %v", oldCfg.interfaces(), newCfg.interfaces()))
+	}
+	for _, vlan := range sortedVlans(oldInterfaces, newInterfaces) {
+		oldInterface, inOld := oldInterfaces[vlan]
+		newInterface, inNew := newInterfaces[vlan]
+		if inOld && inNew && oldInterface != newInterface {
+			changes = append(changes, fmt.Sprintf("vlan %d moved from interface %s to %s", vlan, oldInterface, newInterface))
+		}
+	}
+
+	return changes
+}
+
+func sortedMacs(a, b map[macAddress]multicastDevice) []macAddress {
+	seen := make(map[macAddress]bool)
+	var macs []macAddress
+	for _, devices := range []map[macAddress]multicastDevice{a, b} {
+		for mac := range devices {
+			if !seen[mac] {
+				seen[mac] = true
+				macs = append(macs, mac)
+			}
+		}
+	}
+	sort.Slice(macs, func(i, j int) bool { return macs[i] < macs[j] })
+	return macs
+}
+
+func sortedVlans[V any](a, b map[uint16]V) []uint16 {
+	seen := make(map[uint16]bool)
+	var vlans []uint16
+	for _, vlanMap := range []map[uint16]V{a, b} {
+		for vlan := range vlanMap {
+			if !seen[vlan] {
+				seen[vlan] = true
+				vlans = append(vlans, vlan)
+			}
+		}
+	}
+	sort.Slice(vlans, func(i, j int) bool { return vlans[i] < vlans[j] })
+	return vlans
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffConfig(t *testing.T) {
+	oldCfg := config{
+		Devices: map[macAddress]multicastDevice{
+			"00:14:22:01:23:45": {Description: "Test Chromecast", OriginPool: 45, SharedPools: []uint16{42}},
+			"00:14:22:01:23:46": {Description: "Test Spotify Air", OriginPool: 46, SharedPools: []uint16{176, 148}},
+		},
+		VlanIPSource: map[vlanID]vlanIpSource{
+			"42": {IpSource: net.ParseIP("192.168.42.2")},
+			"45": {IpSource: net.ParseIP("192.168.45.2")},
+		},
+	}
+	newCfg := config{
+		Devices: map[macAddress]multicastDevice{
+			"00:14:22:01:23:45": {Description: "Test Chromecast", OriginPool: 45, SharedPools: []uint16{42, 46}},
+			"00:14:22:01:23:47": {Description: "Test Spotify Air", OriginPool: 47, SharedPools: []uint16{13}},
+		},
+		VlanIPSource: map[vlanID]vlanIpSource{
+			"42": {IpSource: net.ParseIP("192.168.42.3")},
+			"46": {IpSource: net.ParseIP("192.168.46.2"), Ip6Source: net.ParseIP("fd00:46::2")},
+		},
+	}
+
+	expectedResult := []string{
+		"device 00:14:22:01:23:45 (Test Chromecast) changed, origin_pool 45 -> 45, shared_pools [42] -> [42 46]",
+		"device 00:14:22:01:23:46 (Test Spotify Air) removed",
+		"device 00:14:22:01:23:47 (Test Spotify Air) added, origin_pool 47, shared_pools [13]",
+		"vlan 42 ip_source changed from 192.168.42.2 to 192.168.42.3",
+		"vlan 45 removed, ip_source was 192.168.45.2",
+		"vlan 46 added, ip_source 192.168.46.2",
+		"vlan 46 ip6_source changed from <nil> to fd00:46::2",
+	}
+	computedResult := diffConfig(oldCfg, newCfg)
+	if !reflect.DeepEqual(expectedResult, computedResult) {
+		t.Errorf("Error in diffConfig(): got %q", computedResult)
+	}
+
+	if changes := diffConfig(oldCfg, oldCfg); len(changes) != 0 {
+		t.Errorf("Error in diffConfig(): expected no changes for identical configs, got %q", changes)
+	}
+}
+
+func TestNativeVlan(t *testing.T) {
+	p := newPolicy(config{
+		Interfaces: []trunkInterface{
+			{Name: "bond0", Vlans: []uint16{100}},
+			{Name: "bond1", Vlans: []uint16{200}},
+		},
+		NativeVlan: 200,
+		VlanIPSource: map[vlanID]vlanIpSource{
+			"100": {IpSource: net.ParseIP("192.168.100.2")},
+			"200": {IpSource: net.ParseIP("192.168.200.2")},
+		},
+	})
+
+	tag := uint16(100)
+	testCases := []struct {
+		netInterface string
+		tag          *uint16
+		vlan         uint16
+		ok           bool
+	}{
+		{"bond0", &tag, 100, true},
+		{"bond1", &tag, 100, false},
+		{"bond0", nil, 200, false},
+		{"bond1", nil, 200, true},
+	}
+	for _, testCase := range testCases {
+		vlan, ok := p.vlanOf(testCase.netInterface, testCase.tag)
+		if ok != testCase.ok || (ok && vlan != testCase.vlan) {
+			t.Errorf("Error in vlanOf(%s): expected %d %v, got %d %v", testCase.netInterface, testCase.vlan, testCase.ok, vlan, ok)
+		}
+	}
+	if p.wireTag(200) != 0 || p.wireTag(100) != 100 {
+		t.Error("Error in wireTag(): the native VLAN should be sent untagged")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.toml")
+	write := func(content string) {
+		if err := os.WriteFile(configFile, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`net_interface = "test0"
+[dns_gateway]
+listen = "127.0.0.1:5300"
+[dns_gateway.pools]
+42 = ["10.8.0.0/24"]
+`)
+	cfg, err := readConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newPolicyStore(newPolicy(cfg))
+
+	unchanged := store.Load()
+	reloadConfig(configFile, store)
+	if store.Load() != unchanged {
+		t.Error("Error in reloadConfig(): swapped the policy of an unchanged config")
+	}
+
+	// A setting diffConfig does not describe still swaps the policy, the listen address is kept until a restart
+	write(`net_interface = "test0"
+[aliases]
+clients = 42
+[dns_gateway]
+listen = "127.0.0.1:5301"
+[dns_gateway.pools]
+42 = ["10.8.0.0/24"]
+`)
+	reloadConfig(configFile, store)
+	reloaded := store.Load()
+	if reloaded == unchanged || reloaded.cfg.Aliases["clients"] != 42 {
+		t.Errorf("Error in reloadConfig(): expected a new policy with the aliases, got %+v", reloaded.cfg)
+	}
+	if reloaded.cfg.DNSGateway.Listen != "127.0.0.1:5300" {
+		t.Errorf("Error in reloadConfig(): expected dns_gateway listen 127.0.0.1:5300 until a restart, got %s", reloaded.cfg.DNSGateway.Listen)
+	}
+}
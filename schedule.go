@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// timeWindow is a daily 'schedule' like "08:00-23:00", in the local time of the reflector.
+// A window which ends before it starts, like "22:00-06:00", spans midnight.
+type timeWindow struct {
+	start, end time.Duration
+}
+
+func parseSchedule(schedule string) (timeWindow, error) {
+	start, end, ok := strings.Cut(schedule, "-")
+	if !ok {
+		return timeWindow{}, errors.New("expected a daily time window like 08:00-23:00")
+	}
+	var window timeWindow
+	for _, bound := range []struct {
+		value  string
+		offset *time.Duration
+	}{{start, &window.start}, {end, &window.end}} {
+		clock, err := time.Parse("15:04", strings.TrimSpace(bound.value))
+		if err != nil {
+			return timeWindow{}, errors.New("expected a daily time window like 08:00-23:00")
+		}
+		*bound.offset = time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute
+	}
+	if window.start == window.end {
+		// The window would be empty, and the device never shared
+		return timeWindow{}, errors.New("the window starts and ends at the same time, leave out the schedule to share all day")
+	}
+	return window, nil
+}
+
+func (window timeWindow) contains(now time.Time) bool {
+	offset := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+	if window.start <= window.end {
+		return offset >= window.start && offset < window.end
+	}
+	return offset >= window.start || offset < window.end
+}
+
+// expiresLayouts are the accepted formats of 'expires', dates and times without an offset are in local time.
+var expiresLayouts = []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02T15:04:05", time.RFC3339}
+
+// parseExpires parses the moment a sharing rule expires, a date expires at the start of that day.
+func parseExpires(expires string) (time.Time, error) {
+	for _, layout := range expiresLayouts {
+		if t, err := time.ParseInLocation(layout, expires, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("expected a date like 2026-10-23, or a date and time like 2026-10-23 18:00")
+}
+
+// sharingRule returns the schedule and expires of the device for the pool, the settings of the pool override the device.
+func (device multicastDevice) sharingRule(pool uint16) (schedule string, expires string) {
+	schedule, expires = device.Schedule, device.Expires
+	if override, ok := device.poolSettings(pool); ok {
+		if override.Schedule != "" {
+			schedule = override.Schedule
+		}
+		if override.Expires != "" {
+			expires = override.Expires
+		}
+	}
+	return schedule, expires
+}
+
+// compiledRule is a sharing rule of a device for a pool with its schedule and expires parsed, newPolicy
+// compiles the rules of every shared pool so the packet processors do not parse them for every packet.
+type compiledRule struct {
+	schedule   string
+	window     *timeWindow
+	expires    time.Time
+	hasExpires bool
+	// invalid is why a rule which cannot be parsed never shares, the check command reports it
+	invalid string
+}
+
+func compileSharingRule(schedule string, expires string) compiledRule {
+	rule := compiledRule{schedule: schedule}
+	if expires != "" {
+		t, err := parseExpires(expires)
+		if err != nil {
+			rule.invalid = fmt.Sprintf("invalid expires %s", expires)
+			return rule
+		}
+		rule.expires, rule.hasExpires = t, true
+	}
+	if schedule != "" {
+		window, err := parseSchedule(schedule)
+		if err != nil {
+			rule.invalid = fmt.Sprintf("invalid schedule %s", schedule)
+			return rule
+		}
+		rule.window = &window
+	}
+	return rule
+}
+
+// compileSharingRules returns the devices with the sharing rules of their shared pools compiled.
+func compileSharingRules(devices map[macAddress]multicastDevice) map[macAddress]multicastDevice {
+	for key, device := range devices {
+		device.sharing = make(map[uint16]compiledRule)
+		for _, pool := range device.SharedPools {
+			device.sharing[pool] = compileSharingRule(device.sharingRule(pool))
+		}
+		devices[key] = device
+	}
+	return devices
+}
+
+func (rule compiledRule) state(now time.Time) (bool, string) {
+	if rule.invalid != "" {
+		return false, rule.invalid
+	}
+	if rule.hasExpires && !now.Before(rule.expires) {
+		return false, fmt.Sprintf("expired at %s", rule.expires.Format(time.DateTime))
+	}
+	if rule.window != nil && !rule.window.contains(now) {
+		return false, fmt.Sprintf("outside the schedule %s", rule.schedule)
+	}
+	return true, ""
+}
+
+// sharingState reports whether the device is shared with the pool at 'now', and why not.
+// A rule which cannot be parsed never shares, the check command reports it.
+func (device multicastDevice) sharingState(pool uint16, now time.Time) (bool, string) {
+	rule, ok := device.sharing[pool]
+	if !ok {
+		rule = compileSharingRule(device.sharingRule(pool))
+	}
+	return rule.state(now)
+}
+
+// sharedAt reports whether the device is shared with the pool at 'now'.
+func (device multicastDevice) sharedAt(pool uint16, now time.Time) bool {
+	shared, _ := device.sharingState(pool, now)
+	return shared
+}
+
+var sharingRuleInterval = time.Minute
+
+// watchSharingRules logs when the schedule of a device starts or ends, and when it expires.
+// The packet processors evaluate the rules themselves, this is only for the log.
+//
+// watchSharingRules loops until 'stop' is closed.
+func watchSharingRules(policies *policyStore, stop chan struct{}) {
+	reloaded := policies.subscribe()
+	ticker := time.NewTicker(sharingRuleInterval)
+	defer ticker.Stop()
+
+	states := make(map[string]bool)
+	for {
+		states = logSharingRules(policies.Load(), states, time.Now())
+		select {
+		case <-stop:
+			return
+		case <-reloaded:
+		case <-ticker.C:
+		}
+	}
+}
+
+// logSharingRules logs the devices and pools with a sharing rule whose state differs from 'states',
+// and returns the new states.
+func logSharingRules(active *policy, states map[string]bool, now time.Time) map[string]bool {
+	newStates := make(map[string]bool)
+	for _, mac := range sortedMacs(active.cfg.Devices, nil) {
+		device := active.allowedDevices.devices[macAddress(strings.ToLower(string(mac)))]
+		for _, pool := range device.SharedPools {
+			if schedule, expires := device.sharingRule(pool); schedule == "" && expires == "" {
+				continue
+			}
+			key := fmt.Sprintf("%s/%d", mac, pool)
+			shared, reason := device.sharingState(pool, now)
+			newStates[key] = shared
+			if previous, ok := states[key]; ok && previous == shared {
+				continue
+			}
+			if shared {
+				logrus.Infof("Sharing device %s (%s) with VLAN %d is active", mac, device.Description, pool)
+			} else {
+				logrus.Infof("Sharing device %s (%s) with VLAN %d is inactive, %s", mac, device.Description, pool, reason)
+			}
+		}
+	}
+	return newStates
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSharingState(t *testing.T) {
+	device := multicastDevice{
+		OriginPool:  100,
+		SharedPools: []uint16{101, 120, 130},
+		Schedule:    "08:00-23:00",
+		Pools: map[vlanID]sharedPool{
+			"120": {Expires: "2026-10-23"},
+			"130": {Schedule: "22:00-06:00"},
+		},
+	}
+
+	at := func(value string) time.Time {
+		t, err := time.ParseInLocation(time.DateTime, value, time.Local)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	testCases := []struct {
+		pool     uint16
+		now      time.Time
+		expected bool
+	}{
+		{101, at("2026-10-20 07:59:59"), false},
+		{101, at("2026-10-20 08:00:00"), true},
+		{101, at("2026-10-20 22:59:59"), true},
+		{101, at("2026-10-20 23:00:00"), false},
+		// The pool overrides the expires, and keeps the schedule of the device
+		{120, at("2026-10-22 07:00:00"), false},
+		{120, at("2026-10-22 12:00:00"), true},
+		{120, at("2026-10-23 12:00:00"), false},
+		// A schedule over midnight
+		{130, at("2026-10-20 23:30:00"), true},
+		{130, at("2026-10-21 05:59:00"), true},
+		{130, at("2026-10-21 12:00:00"), false},
+	}
+	// The policy compiles the rules once, with the same results
+	compiled := newPolicy(config{Devices: map[macAddress]multicastDevice{"AA:BB:CC:DD:EE:FF": device}}).allowedDevices.devices["aa:bb:cc:dd:ee:ff"]
+	if len(compiled.sharing) != 3 || compiled.sharing[130].window == nil || !compiled.sharing[120].hasExpires {
+		t.Errorf("Error in newPolicy(): expected the compiled rules of the 3 shared pools, got %+v", compiled.sharing)
+	}
+	for _, testCase := range testCases {
+		if shared := device.sharedAt(testCase.pool, testCase.now); shared != testCase.expected {
+			t.Errorf("Error in sharedAt(%d, %s): expected %v, got %v", testCase.pool, testCase.now, testCase.expected, shared)
+		}
+		if shared := compiled.sharedAt(testCase.pool, testCase.now); shared != testCase.expected {
+			t.Errorf("Error in sharedAt(%d, %s) of the policy: expected %v, got %v", testCase.pool, testCase.now, testCase.expected, shared)
+		}
+	}
+
+	if shared, _ := (multicastDevice{Schedule: "8 to 11"}).sharingState(101, at("2026-10-20 09:00:00")); shared {
+		t.Error("Error in sharingState(): an invalid schedule should not share")
+	}
+	if _, err := parseSchedule("08:00-08:00"); err == nil {
+		t.Error("Error in parseSchedule(): expected an error for a window which starts and ends at the same time")
+	}
+}
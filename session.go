@@ -0,0 +1,191 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+// querier is the client of a query which expects a unicast reply from a device on another VLAN.
+type querier struct {
+	ip         net.IP
+	tag        uint16
+	macAddress net.HardwareAddr
+	// port is the UDP source port of the query, the reply is sent back to it
+	port layers.UDPPort
+	// allowedVlans are the VLANs the query was forwarded to, where the replies come from
+	allowedVlans []uint16
+}
+
+func (q querier) sameQuerier(other querier) bool {
+	return q.tag == other.tag && q.ip.Equal(other.ip)
+}
+
+// querierKey identifies the query of a querier: a legacy unicast DNS query by its transaction ID,
+// a WS-Discovery request by its MessageID.
+type querierKey struct {
+	tag       uint16
+	ip        string
+	port      layers.UDPPort
+	id        uint16
+	messageID string
+}
+
+type session struct {
+	querier
+	key     querierKey
+	expires time.Time
+}
+
+// sessionTable holds the queriers which wait for a unicast reply. Like a NAT, every query is forwarded
+// from a reply port of its own, so the reply of a device goes to exactly one querier, even when clients
+// on different VLANs use the same port and DNS transaction ID.
+// The table holds at most maxSize sessions, the session which expires first is evicted to make room.
+type sessionTable struct {
+	mu   sync.Mutex
+	name string
+	// sessions are the queriers by reply port, ports holds the reply port of every query
+	sessions map[layers.UDPPort]*session
+	ports    map[querierKey]layers.UDPPort
+	// firstPort is the first of the maxSize reply ports of the table, next the port to try first
+	firstPort layers.UDPPort
+	next      int
+	maxSize   int
+	// hits, misses and evictions are published in sessionMetrics under the name of the table
+	hits, misses, evictions expvar.Int
+}
+
+// maxSessions bounds the size of the session tables of the packet processors.
+var maxSessions = 4096
+
+// The reply ports of the session tables of the packet processors, each table uses maxSessions ports.
+const (
+	mdnsSessionPorts = layers.UDPPort(40000)
+	ssdpSessionPorts = layers.UDPPort(44096)
+	wsdSessionPorts  = layers.UDPPort(48192)
+)
+
+// sessionMetrics holds the hits, misses and evictions of the session tables, published at /debug/vars
+// when the reflector runs with -metrics.
+var sessionMetrics = expvar.NewMap("sessions")
+
+func newSessionTable(name string, maxSize int, firstPort layers.UDPPort) *sessionTable {
+	table := &sessionTable{
+		name:      name,
+		sessions:  make(map[layers.UDPPort]*session),
+		ports:     make(map[querierKey]layers.UDPPort),
+		firstPort: firstPort,
+		maxSize:   maxSize,
+	}
+	sessionMetrics.Set(name+"_hits", &table.hits)
+	sessionMetrics.Set(name+"_misses", &table.misses)
+	sessionMetrics.Set(name+"_evictions", &table.evictions)
+	return table
+}
+
+// add stores or refreshes the session of the querier for its query with the DNS transaction 'id', use 0
+// for protocols without one. It returns the port to forward the query from, the reply port of the session.
+func (table *sessionTable) add(q querier, id uint16, duration time.Duration, now time.Time) layers.UDPPort {
+	return table.store(q, querierKey{q.tag, q.ip.String(), q.port, id, ""}, duration, now)
+}
+
+// addMessage stores or refreshes the session of the querier for its request with the WS-Addressing 'messageID',
+// and returns the port to forward the request from.
+func (table *sessionTable) addMessage(q querier, messageID string, duration time.Duration, now time.Time) layers.UDPPort {
+	return table.store(q, querierKey{q.tag, q.ip.String(), q.port, 0, messageID}, duration, now)
+}
+
+func (table *sessionTable) store(q querier, key querierKey, duration time.Duration, now time.Time) layers.UDPPort {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	if port, ok := table.ports[key]; ok {
+		existing := table.sessions[port]
+		existing.querier = q
+		existing.expires = now.Add(duration)
+		return port
+	}
+	if len(table.sessions) >= table.maxSize {
+		table.sweep(now)
+	}
+	if len(table.sessions) >= table.maxSize {
+		table.evict()
+	}
+	port := table.freePort()
+	table.sessions[port] = &session{querier: q, key: key, expires: now.Add(duration)}
+	table.ports[key] = port
+	return port
+}
+
+// freePort returns the next reply port without a session, the table must have room for a session.
+func (table *sessionTable) freePort() layers.UDPPort {
+	for {
+		port := table.firstPort + layers.UDPPort(table.next)
+		table.next = (table.next + 1) % table.maxSize
+		if _, ok := table.sessions[port]; !ok {
+			return port
+		}
+	}
+}
+
+// lookup returns the querier of the session which a reply from 'vlan' to the reply port 'port' with the DNS
+// transaction 'id' belongs to, and refreshes the session, as a device may send more than one reply.
+func (table *sessionTable) lookup(port layers.UDPPort, id uint16, vlan uint16, refresh time.Duration, now time.Time) (querier, bool) {
+	return table.find(port, func(key querierKey) bool { return key.id == id }, vlan, refresh, now)
+}
+
+// lookupMessage returns the querier of the session which a reply from 'vlan' to the reply port 'port',
+// relating to the WS-Addressing 'messageID' of the request, belongs to.
+func (table *sessionTable) lookupMessage(port layers.UDPPort, messageID string, vlan uint16, refresh time.Duration, now time.Time) (querier, bool) {
+	return table.find(port, func(key querierKey) bool { return key.messageID == messageID }, vlan, refresh, now)
+}
+
+func (table *sessionTable) find(port layers.UDPPort, matches func(querierKey) bool, vlan uint16, refresh time.Duration, now time.Time) (querier, bool) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	s, ok := table.sessions[port]
+	if ok && !now.Before(s.expires) {
+		table.remove(port)
+		ok = false
+	}
+	if !ok || !matches(s.key) || !slices.Contains(s.allowedVlans, vlan) {
+		table.misses.Add(1)
+		return querier{}, false
+	}
+	s.expires = now.Add(refresh)
+	table.hits.Add(1)
+	return s.querier, true
+}
+
+func (table *sessionTable) remove(port layers.UDPPort) {
+	delete(table.ports, table.sessions[port].key)
+	delete(table.sessions, port)
+}
+
+func (table *sessionTable) sweep(now time.Time) {
+	for port, s := range table.sessions {
+		if !now.Before(s.expires) {
+			table.remove(port)
+		}
+	}
+}
+
+// evict removes the session which expires first.
+func (table *sessionTable) evict() {
+	var oldestPort layers.UDPPort
+	var oldest *session
+	for port, s := range table.sessions {
+		if oldest == nil || s.expires.Before(oldest.expires) {
+			oldestPort, oldest = port, s
+		}
+	}
+	if oldest != nil {
+		table.remove(oldestPort)
+		table.evictions.Add(1)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionTable(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	table := newSessionTable("test", 3, 40000)
+	laptop := querier{ip: net.IP{192, 168, 101, 10}, tag: 101, port: 50000, allowedVlans: []uint16{100}}
+	phone := querier{ip: net.IP{192, 168, 103, 10}, tag: 103, port: 50000, allowedVlans: []uint16{100, 200}}
+
+	// Both clients use port 50000 and transaction ID 1 on another VLAN, their queries get their own reply port
+	laptopPort := table.add(laptop, 1, 2*time.Second, now)
+	phonePort := table.add(phone, 1, 2*time.Second, now.Add(100*time.Millisecond))
+	if laptopPort == phonePort {
+		t.Fatalf("Error in add(): expected a reply port per querier, got %d for both", laptopPort)
+	}
+	if port := table.add(laptop, 1, 2*time.Second, now); port != laptopPort {
+		t.Errorf("Error in add(): expected the reply port %d of the repeated query, got %d", laptopPort, port)
+	}
+	if found, ok := table.lookup(laptopPort, 1, 100, 2*time.Second, now); !ok || !found.sameQuerier(laptop) || found.port != 50000 {
+		t.Errorf("Error in lookup(): expected only the laptop for its reply port, got %+v", found)
+	}
+	if found, ok := table.lookup(phonePort, 1, 100, 2*time.Second, now.Add(100*time.Millisecond)); !ok || !found.sameQuerier(phone) {
+		t.Errorf("Error in lookup(): expected only the phone for its reply port, got %+v", found)
+	}
+	// A reply with another transaction ID, or from a VLAN the query of the laptop was not forwarded to
+	if found, ok := table.lookup(laptopPort, 2, 100, 2*time.Second, now); ok {
+		t.Errorf("Error in lookup(): expected no querier for another transaction, got %+v", found)
+	}
+	if found, ok := table.lookup(laptopPort, 1, 200, 2*time.Second, now); ok {
+		t.Errorf("Error in lookup(): expected no querier for a reply from VLAN 200, got %+v", found)
+	}
+
+	// The table is full, so the session which expires first, of the laptop, is evicted
+	table.add(phone, 0, 2*time.Second, now.Add(200*time.Millisecond))
+	table.add(laptop, 0, 2*time.Second, now.Add(300*time.Millisecond))
+	if found, ok := table.lookup(laptopPort, 1, 100, 2*time.Second, now.Add(time.Second)); ok || len(table.sessions) != 3 {
+		t.Errorf("Error in add(): expected the session of the laptop for transaction 1 to be evicted, got %+v", found)
+	}
+	if evictions := table.evictions.Value(); evictions != 1 {
+		t.Errorf("Error in add(): expected 1 eviction, got %d", evictions)
+	}
+	if published := sessionMetrics.Get("test_evictions"); published != &table.evictions {
+		t.Errorf("Error in newSessionTable(): expected the evictions of the table in the metrics, got %v", published)
+	}
+
+	// A lookup refreshes the session of the phone for transaction 1, the sessions without one expire
+	later := now.Add(2500 * time.Millisecond)
+	table.lookup(phonePort, 1, 200, 2*time.Second, now.Add(time.Second))
+	if _, ok := table.lookup(phonePort, 1, 200, 2*time.Second, later); !ok {
+		t.Error("Error in lookup(): expected the refreshed session of the phone")
+	}
+	table.sweep(later)
+	if len(table.sessions) != 1 || len(table.ports) != 1 {
+		t.Errorf("Error in sweep(): expected the expired sessions to be removed, got %d sessions", len(table.sessions))
+	}
+}
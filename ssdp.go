@@ -1,80 +1,103 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"net"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/gopacket/gopacket"
-	"github.com/gopacket/gopacket/pcap"
+	"github.com/gopacket/gopacket/layers"
 	"github.com/sirupsen/logrus"
-	"github.com/zekroTJA/timedmap"
 )
 
-type ssdpRequest struct {
-	ip           net.IP
-	tag          uint16
-	macAddress   net.HardwareAddr
-	allowedVlans []uint16
-}
-
 var ssdpSessionDuration = 2 * time.Second
 
 // SSDP request = multicast
 // SSDP response = unicast to SSDP request src.
-func processSSDPPackets(netInterface string, srcMACAddress net.HardwareAddr, poolsMap map[uint16][]uint16, vlanIPMap map[uint16]net.IP, allowedMacsMap map[macAddress]multicastDevice) {
+// The LOCATION URLs of the devices are rewritten to URLs of the proxy when it listens on the VLAN.
+func processSSDPPackets(trunks []*trunk, policies *policyStore, proxy *ssdpProxy) {
 	var dstMacAddress net.HardwareAddr
 
-	// Get a handle on the network interface
-	rawTraffic, err := pcap.OpenLive(netInterface, 65536, true, time.Second)
-	if err != nil {
-		logrus.Fatalf("Could not find network interface: %v", netInterface)
-	}
+	// Get a channel of SSDP packets to process from a handle on every trunk. Of the unicast packets to the trunk only
+	// the unicast M-SEARCH requests and the responses to the reply ports of the sessions are SSDP, not DNS gateway queries.
+	filterTemplate := "udp and ((dst net (239.255.255.250 or ff02::c or ff05::c or ff08::c) and dst port 1900) or (ether dst %s and (dst port 1900 or dst portrange %d-%d)))"
+	handles, ssdpPackets := captureTrunks(trunks, func(t *trunk) string {
+		return vlanFilter(t, fmt.Sprintf(filterTemplate, t.hardwareAddr, int(ssdpSessionPorts), int(ssdpSessionPorts)+maxSessions-1))
+	})
 
-	filterTemplate := "not (ether src %s) and vlan and udp and ((dst net (239.255.255.250 or ff02::c or ff05::c or ff08::c) and dst port 1900) or (ether dst %s and not port 5353))"
-
-	err = rawTraffic.SetBPFFilter(fmt.Sprintf(filterTemplate, srcMACAddress, srcMACAddress))
-	if err != nil {
-		logrus.Fatalf("Could not apply filter on network interface: %v", err)
-	}
+	ssdpSessions := newSessionTable("ssdp", maxSessions, ssdpSessionPorts)
+	guard := newLoopGuard("SSDP")
+	cache := newSSDPCache()
+	addresses := make(ssdpAddresses)
+	replies := make(chan ssdpReply, 64)
 
-	// Get a channel of SSDP packets to process
-	decoder := gopacket.DecodersByLayerName["Ethernet"]
-	source := gopacket.NewPacketSource(rawTraffic, decoder)
-	ssdpPackets := parsePacketsLazily(source)
-
-	tmssdpQuerySession := timedmap.New(time.Second)
-
-	for ssdpPacket := range ssdpPackets {
+	for {
+		var ssdpPacket multicastPacket
+		select {
+		case reply := <-replies:
+			sendSSDPReply(handles, policies.Load(), reply)
+			continue
+		case ssdpPacket = <-ssdpPackets:
+		}
 		if !ssdpPacket.isSSDPAdvertisement && !ssdpPacket.isSSDPQuery && !ssdpPacket.isSSDPResponse {
 			logrus.Warnf("Got a packet that is not a SSDP query, response or advertisement:\n%s", ssdpPacket.packet.String())
 			continue
 		}
+		active := policies.Load()
+		poolsMap, allowedDevices := active.poolsMap, active.allowedDevices
+		vlan, ok := active.vlanOf(ssdpPacket.netInterface, ssdpPacket.vlanTag)
+		if !ok {
+			logrus.Debugf("Ignored SSDP packet on %s from a VLAN which is not configured on it", ssdpPacket.netInterface)
+			continue
+		}
+		ssdpPacket.vlanTag = &vlan
+		if !guard.allow(vlan, ssdpPacket.payload, active.rateLimit(vlan), time.Now()) {
+			continue
+		}
+		in := handles[ssdpPacket.netInterface]
 
 		var srcIP net.IP
-		if ssdpPacket.isIPv6 {
-			srcIP = IPv6Address // ssdp packet cannot be routed from other vlan as it is link-local, so just rewrite it to our own link-local.
-		}
 
 		// Forward the SSDP query to appropriate VLANs and save the SSDP request packet metadata for the response
 		// Forward the SSDP response to the appropriate VLAN, lookup the matching SSDP request to fill in the unicast destination.
 		if ssdpPacket.isSSDPQuery {
+			if ssdpPacket.dstIP != nil && !ssdpPacket.dstIP.IsMulticast() {
+				logrus.Debugf("Unicast SSDP query packet received:\n%s", ssdpPacket.packet.String())
+				forwardUnicastSearch(handles, active, addresses, ssdpSessions, &ssdpPacket)
+				continue
+			}
 			tags, ok := poolsMap[*ssdpPacket.vlanTag]
 			if !ok {
 				continue
 			}
+			tags = ssdpSearchPools(active, tags, vlan, ssdpTarget(ssdpPacket.payload), time.Now())
+			if len(tags) == 0 {
+				logrus.Debugf("Dropped SSDP query from %s, no device shared with VLAN %d has its search target", ssdpPacket.srcMAC.String(), vlan)
+				continue
+			}
 			logrus.Debugf("SSDP query packet received:\n%s", ssdpPacket.packet.String())
-			if ssdpPacket.dstMAC == &srcMACAddress {
+			if in.isUnicastTo(&ssdpPacket) {
 				logrus.Infof("Protocol violation from %s, got a SSDP query from an unicast packet.", ssdpPacket.srcMAC.String())
 				continue
 			}
 
+			if active.cfg.SSDPCache && answerSSDPFromCache(active, cache, proxy, &ssdpPacket, replies) {
+				logrus.Debugf("Answered SSDP query from %s from the cache", ssdpPacket.srcMAC.String())
+				continue
+			}
+
 			// Store network source network information for the SSDP response
-			ssdpSession := ssdpRequest{
-				ip:         *ssdpPacket.srcIP,
-				tag:        *ssdpPacket.vlanTag,
-				macAddress: *ssdpPacket.srcMAC,
+			ssdpSession := querier{
+				ip:           *ssdpPacket.srcIP,
+				tag:          *ssdpPacket.vlanTag,
+				macAddress:   *ssdpPacket.srcMAC,
+				port:         *ssdpPacket.srcPort,
+				allowedVlans: tags,
 			}
+			ssdpPacket.setSrcPort(ssdpSessions.add(ssdpSession, 0, time.Duration(ssdpPacket.maxWaitTime+1)*time.Second, time.Now()))
 
 			// Network devices may set dstMAC to the local MAC address
 			// Rewrite dstMAC to ensure that it is set to the appropriate multicast MAC address
@@ -85,18 +108,17 @@ func processSSDPPackets(netInterface string, srcMACAddress net.HardwareAddr, poo
 			}
 
 			for _, tag := range tags {
-				if !ssdpPacket.isIPv6 {
-					srcIP, ok = vlanIPMap[tag]
-					if !ok {
-						srcIP = nil
-					}
+				out, ok := handles.forVlan(active, tag)
+				if !ok {
+					continue
 				}
+				srcIP = out.sourceIP(active, tag, ssdpPacket.isIPv6)
 
-				tmssdpQuerySession.Set(*ssdpPacket.srcPort, ssdpSession, time.Duration(ssdpPacket.maxWaitTime+1)*time.Second)
-				sendPacket(rawTraffic, &ssdpPacket, tag, srcMACAddress, dstMacAddress, srcIP, nil)
+				sendPacket(out.handle, &ssdpPacket, active.wireTag(tag), out.hardwareAddr, dstMacAddress, srcIP, nil)
+				guard.sentTo(tag, ssdpPacket.udpPayload(), time.Now())
 			}
 		} else if ssdpPacket.isSSDPAdvertisement {
-			device, ok := allowedMacsMap[macAddress(ssdpPacket.srcMAC.String())]
+			deviceKey, device, ok := allowedDevices.match(&ssdpPacket)
 			if !ok {
 				continue
 			}
@@ -105,55 +127,242 @@ func processSSDPPackets(netInterface string, srcMACAddress net.HardwareAddr, poo
 				logrus.Warningf("spoofing/vlan leak detected from %s. Config expected traffic from VLAN %d, got a packet from %d.", ssdpPacket.srcMAC.String(), device.OriginPool, *ssdpPacket.vlanTag)
 				continue
 			}
-			if ssdpPacket.dstMAC == &srcMACAddress {
+			if in.isUnicastTo(&ssdpPacket) {
 				logrus.Infof("Protocol violation from %s, got a SSDP advertisement from an unicast packet.", ssdpPacket.srcMAC.String())
 				continue
 			}
-
-			// Network devices may set dstMAC to the local MAC address
-			// Rewrite dstMAC to ensure that it is set to the appropriate multicast MAC address
-			if ssdpPacket.isIPv6 {
-				dstMacAddress = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x03}
-			} else {
-				dstMacAddress = net.HardwareAddr{0x01, 0x00, 0x5E, 0x7F, 0xFF, 0xFA}
-			}
-
-			for _, tag := range device.SharedPools {
-				if !ssdpPacket.isIPv6 {
-					srcIP, ok = vlanIPMap[tag]
-					if !ok {
-						srcIP = nil
-					}
-				}
-				sendPacket(rawTraffic, &ssdpPacket, tag, srcMACAddress, dstMacAddress, srcIP, nil)
+			addresses.learn(deviceKey, &ssdpPacket, time.Now())
+			if active.cfg.SSDPCache {
+				cache.add(deviceKey, *ssdpPacket.srcIP, ssdpPacket.payload, time.Now())
 			}
+			forwardSSDPAdvertisement(handles, active, proxy, guard, deviceKey, device, &ssdpPacket, time.Now())
 			// Allowed Mac-address responding from on a SSDP query
-		} else if device, ok := allowedMacsMap[macAddress(ssdpPacket.srcMAC.String())]; ok && ssdpPacket.isSSDPResponse {
+		} else if deviceKey, device, ok := allowedDevices.match(&ssdpPacket); ok && ssdpPacket.isSSDPResponse {
 
 			logrus.Debugf("SSDP query response packet received:\n%s", ssdpPacket.packet.String())
 			if device.OriginPool != *ssdpPacket.vlanTag {
 				logrus.Warningf("spoofing/vlan leak detected from %s. Config expected traffic from VLAN %d, got a packet from VLAN %d.", ssdpPacket.srcMAC.String(), device.OriginPool, *ssdpPacket.vlanTag)
 				continue
 			}
-			if !tmssdpQuerySession.Contains(*ssdpPacket.dstPort) {
+			addresses.learn(deviceKey, &ssdpPacket, time.Now())
+			if active.cfg.SSDPCache {
+				cache.add(deviceKey, *ssdpPacket.srcIP, ssdpPacket.payload, time.Now())
+			}
+			ssdpSession, ok := ssdpSessions.lookup(*ssdpPacket.dstPort, 0, *ssdpPacket.vlanTag, ssdpSessionDuration, time.Now())
+			if !ok {
 				logrus.Infof("No matching SSDP session found with SSDP request/advertisement src port %d.\n", uint32(*ssdpPacket.dstPort))
 				continue
 			}
-			tmssdpQuerySession.Refresh(*ssdpPacket.dstPort, ssdpSessionDuration)
-			ssdpSession := tmssdpQuerySession.GetValue(*ssdpPacket.dstPort)
 
-			tag := ssdpSession.(ssdpRequest).tag
-			dstIP := ssdpSession.(ssdpRequest).ip
-			dstMacAddress := ssdpSession.(ssdpRequest).macAddress
-
-			if !ssdpPacket.isIPv6 {
-				srcIP, ok = vlanIPMap[tag]
-				if !ok {
-					srcIP = nil
-				}
+			tag := ssdpSession.tag
+			st := ssdpTarget(ssdpPacket.payload)
+			if !device.sharedAt(tag, time.Now()) {
+				logrus.Debugf("Dropped SSDP response from %s, sharing with VLAN %d is not active", ssdpPacket.srcMAC.String(), tag)
+				continue
+			}
+			if !ssdpTypeShared(device.ssdpTypesFor(tag), st) {
+				logrus.Debugf("Dropped SSDP response from %s, %s is not in its ssdp_types for VLAN %d", ssdpPacket.srcMAC.String(), st, tag)
+				continue
 			}
+			out, ok := handles.forVlan(active, tag)
+			if !ok {
+				continue
+			}
+			srcIP = out.sourceIP(active, tag, ssdpPacket.isIPv6)
+			rewriteSSDPHeaders(&ssdpPacket, active.privacyFor(device, tag), proxy, tag, deviceKey, *ssdpPacket.srcIP)
+
+			ssdpPacket.setDstPort(ssdpSession.port)
+			sendPacket(out.handle, &ssdpPacket, active.wireTag(tag), out.hardwareAddr, ssdpSession.macAddress, srcIP, ssdpSession.ip)
+		}
+	}
+}
+
+// ssdpTarget returns the NT header of an SSDP advertisement, or the ST header of a query or response.
+func ssdpTarget(payload []byte) string {
+	headers, ok := parseSSDPHeaders(payload)
+	if !ok {
+		return ""
+	}
+	if nt := headers.Get("NT"); nt != "" {
+		return nt
+	}
+	return headers.Get("ST")
+}
+
+// isSSDPType reports whether the value is an SSDP notification type: upnp:rootdevice, a uuid: or a device or
+// service type like urn:schemas-upnp-org:device:MediaRenderer:1.
+func isSSDPType(value string) bool {
+	if value == "upnp:rootdevice" || (strings.HasPrefix(value, "uuid:") && len(value) > len("uuid:")) {
+		return true
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) != 5 || parts[0] != "urn" || parts[1] == "" || (parts[2] != "device" && parts[2] != "service") || parts[3] == "" {
+		return false
+	}
+	_, err := strconv.Atoi(parts[4])
+	return err == nil
+}
+
+// ssdpTypeShared reports whether a notification type or search target of a device is in its ssdp_types,
+// nil types share everything.
+func ssdpTypeShared(types []string, target string) bool {
+	return types == nil || slices.ContainsFunc(types, func(shared string) bool { return matchSearchTarget(shared, target) })
+}
+
+// ssdpSearchShared reports whether a device with the ssdp_types can answer the search target.
+func ssdpSearchShared(types []string, st string) bool {
+	return types == nil || slices.ContainsFunc(types, func(shared string) bool { return matchSearchTarget(st, shared) })
+}
+
+// ssdpSearchPools returns the origin pools in 'pools' with a device shared with the VLAN at 'now' which can
+// answer the search target, according to its ssdp_types.
+func ssdpSearchPools(active *policy, pools []uint16, vlan uint16, st string, now time.Time) []uint16 {
+	answering := make(map[uint16]bool)
+	for _, device := range active.allowedDevices.devices {
+		if !slices.Contains(device.SharedPools, vlan) || !device.sharedAt(vlan, now) {
+			continue
+		}
+		if ssdpSearchShared(device.ssdpTypesFor(vlan), st) {
+			answering[device.OriginPool] = true
+		}
+	}
+	var searched []uint16
+	for _, pool := range pools {
+		if answering[pool] {
+			searched = append(searched, pool)
+		}
+	}
+	return searched
+}
+
+// ssdpAddresses are the addresses the shared devices last sent SSDP packets from, by device entry and IP version.
+type ssdpAddresses map[ssdpAddressKey]ssdpAddress
+
+type ssdpAddressKey struct {
+	device macAddress
+	isIPv6 bool
+}
+
+type ssdpAddress struct {
+	mac     net.HardwareAddr
+	ip      net.IP
+	expires time.Time
+}
+
+// ssdpAddressTTL is how long the address of a device is used after its last SSDP packet.
+var ssdpAddressTTL = time.Hour
+
+func (addresses ssdpAddresses) learn(device macAddress, packet *multicastPacket, now time.Time) {
+	if packet.srcMAC == nil || packet.srcIP == nil {
+		return
+	}
+	addresses[ssdpAddressKey{device, packet.isIPv6}] = ssdpAddress{
+		mac:     append(net.HardwareAddr{}, *packet.srcMAC...),
+		ip:      append(net.IP{}, *packet.srcIP...),
+		expires: now.Add(ssdpAddressTTL),
+	}
+}
+
+func (addresses ssdpAddresses) lookup(device macAddress, isIPv6 bool, now time.Time) (ssdpAddress, bool) {
+	address, ok := addresses[ssdpAddressKey{device, isIPv6}]
+	return address, ok && now.Before(address.expires)
+}
+
+// forwardUnicastSearch forwards a unicast M-SEARCH (UDA 1.1) to the ip_source of the VLAN to the ssdp_unicast_target
+// of the VLAN, as a unicast to the address the device last sent SSDP packets from. The session relays the response.
+func forwardUnicastSearch(handles trunkHandles, active *policy, addresses ssdpAddresses, sessions *sessionTable, packet *multicastPacket) {
+	vlan := *packet.vlanTag
+	now := time.Now()
+	if in, ok := handles.forVlan(active, vlan); !ok || !packet.dstIP.Equal(in.sourceIP(active, vlan, packet.isIPv6)) {
+		return
+	}
+	key := macAddress(strings.ToLower(string(active.cfg.VlanIPSource[vlanID(strconv.Itoa(int(vlan)))].SSDPUnicastTarget)))
+	if key == "" {
+		logrus.Debugf("Dropped unicast SSDP query from %s, VLAN %d has no ssdp_unicast_target", packet.srcMAC.String(), vlan)
+		return
+	}
+	device, ok := active.allowedDevices.devices[key]
+	if !ok || !slices.Contains(device.SharedPools, vlan) || !device.sharedAt(vlan, now) || !ssdpSearchShared(device.ssdpTypesFor(vlan), ssdpTarget(packet.payload)) {
+		logrus.Debugf("Dropped unicast SSDP query from %s, ssdp_unicast_target %s is not shared with VLAN %d", packet.srcMAC.String(), key, vlan)
+		return
+	}
+	address, ok := addresses.lookup(key, packet.isIPv6, now)
+	if !ok {
+		logrus.Debugf("Dropped unicast SSDP query from %s, the address of device %s is not known yet", packet.srcMAC.String(), key)
+		return
+	}
+	out, ok := handles.forVlan(active, device.OriginPool)
+	if !ok {
+		return
+	}
+	srcIP := out.sourceIP(active, device.OriginPool, packet.isIPv6)
+
+	packet.setSrcPort(sessions.add(querier{
+		ip:           *packet.srcIP,
+		tag:          vlan,
+		macAddress:   *packet.srcMAC,
+		port:         *packet.srcPort,
+		allowedVlans: []uint16{device.OriginPool},
+	}, 0, time.Duration(packet.maxWaitTime+1)*time.Second, now))
+
+	// The HOST header names the address the request is sent to
+	packet.rewrittenPayload = filterSSDPHeaders(packet.payload, privacyRules{SSDPReplace: map[string]string{"HOST": net.JoinHostPort(address.ip.String(), "1900")}})
+	sendPacket(out.handle, packet, active.wireTag(device.OriginPool), out.hardwareAddr, address.mac, srcIP, address.ip)
+}
+
+// forwardSSDPAdvertisement reflects a NOTIFY of the device to the VLANs it is shared with, with the headers
+// rewritten for every VLAN.
+func forwardSSDPAdvertisement(handles trunkHandles, active *policy, proxy *ssdpProxy, guard *loopGuard, deviceKey macAddress, device multicastDevice, packet *multicastPacket, now time.Time) {
+	// Network devices may set dstMAC to the local MAC address
+	// Rewrite dstMAC to ensure that it is set to the appropriate multicast MAC address
+	dstMacAddress := net.HardwareAddr{0x01, 0x00, 0x5E, 0x7F, 0xFF, 0xFA}
+	if packet.isIPv6 {
+		dstMacAddress = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x03}
+	}
 
-			sendPacket(rawTraffic, &ssdpPacket, tag, srcMACAddress, dstMacAddress, srcIP, dstIP)
+	// sendPacket replaces the source address, the LOCATION URLs are on the address of the device
+	deviceIP := *packet.srcIP
+	nt := ssdpTarget(packet.payload)
+	for _, tag := range device.SharedPools {
+		if !device.sharedAt(tag, now) || !ssdpTypeShared(device.ssdpTypesFor(tag), nt) {
+			continue
+		}
+		out, ok := handles.forVlan(active, tag)
+		if !ok {
+			continue
 		}
+		srcIP := out.sourceIP(active, tag, packet.isIPv6)
+		rewriteSSDPHeaders(packet, active.privacyFor(device, tag), proxy, tag, deviceKey, deviceIP)
+		sendPacket(out.handle, packet, active.wireTag(tag), out.hardwareAddr, dstMacAddress, srcIP, nil)
+		guard.sentTo(tag, packet.udpPayload(), now)
+	}
+}
+
+// sendSSDPReply sends an M-SEARCH response from the cache to the querier, from the ip_source of its VLAN.
+func sendSSDPReply(handles trunkHandles, active *policy, reply ssdpReply) {
+	out, ok := handles.forVlan(active, reply.vlan)
+	if !ok {
+		return
+	}
+	srcIP := out.sourceIP(active, reply.vlan, reply.isIPv6)
+	if srcIP == nil {
+		return
+	}
+	err := sendUDP(out.handle, active.wireTag(reply.vlan), out.hardwareAddr, reply.dstMAC, srcIP, reply.dstIP, 1900, layers.UDPPort(reply.dstPort), reply.payload)
+	if err != nil {
+		logrus.Warningf("Could not send SSDP response from the cache to VLAN %d: %v", reply.vlan, err)
+	}
+}
+
+// rewriteSSDPHeaders sets the payload sendPacket sends for an SSDP packet of the device to the VLAN, to the
+// payload with the headers filtered by the privacy rules and the LOCATION URL of the proxy. 'deviceIP' is the
+// address the device sent the packet from, the packet itself has the ip_source of the last VLAN it was sent to.
+func rewriteSSDPHeaders(packet *multicastPacket, rules privacyRules, proxy *ssdpProxy, vlan uint16, device macAddress, deviceIP net.IP) {
+	rewritten := rewriteLocation(filterSSDPHeaders(packet.payload, rules), func(location string) (string, bool) {
+		return proxy.location(vlan, device, deviceIP, location)
+	})
+	packet.rewrittenPayload = nil
+	if !bytes.Equal(rewritten, packet.payload) {
+		packet.rewrittenPayload = rewritten
 	}
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+func TestSSDPSearchPools(t *testing.T) {
+	dial := "urn:dial-multiscreen-org:service:dial:1"
+	// The sharing of the device in VLAN 104 has expired, searches are not forwarded to it
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	active := newPolicy(config{
+		Devices: map[macAddress]multicastDevice{
+			"aa:bb:cc:dd:ee:ff": {OriginPool: 100, SharedPools: []uint16{101, 102}, Pools: map[vlanID]sharedPool{"102": {SSDPTypes: []string{dial}}}},
+			"11:22:33:44:55:66": {OriginPool: 103, SharedPools: []uint16{102}, SSDPTypes: []string{"urn:schemas-upnp-org:device:MediaRenderer:2"}},
+			"22:33:44:55:66:77": {OriginPool: 104, SharedPools: []uint16{101, 102}, Expires: "2026-10-01"},
+		},
+	})
+	testCases := []struct {
+		vlan     uint16
+		st       string
+		expected []uint16
+	}{
+		{101, "upnp:rootdevice", []uint16{100}},
+		{102, "ssdp:all", []uint16{100, 103}},
+		{102, dial, []uint16{100}},
+		{102, "urn:schemas-upnp-org:device:MediaRenderer:1", []uint16{103}},
+		{102, "urn:schemas-upnp-org:device:MediaRenderer:3", nil},
+		{102, "upnp:rootdevice", nil},
+	}
+	for _, testCase := range testCases {
+		computedResult := ssdpSearchPools(active, active.poolsMap[testCase.vlan], testCase.vlan, testCase.st, now)
+		slices.Sort(computedResult)
+		if !reflect.DeepEqual(testCase.expected, computedResult) {
+			t.Errorf("Error in ssdpSearchPools(%d, %s): expected %v, got %v", testCase.vlan, testCase.st, testCase.expected, computedResult)
+		}
+	}
+
+	types := active.allowedDevices.devices["aa:bb:cc:dd:ee:ff"].ssdpTypesFor(102)
+	if !ssdpTypeShared(types, dial) || ssdpTypeShared(types, "upnp:rootdevice") || !ssdpTypeShared(nil, "upnp:rootdevice") {
+		t.Errorf("Error in ssdpTypeShared(): expected only %s to be shared with VLAN 102", dial)
+	}
+}
+
+func TestIsSSDPType(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected bool
+	}{
+		{"upnp:rootdevice", true},
+		{"uuid:2f402f80-da50-11e1-9b23-001788255acc", true},
+		{"urn:dial-multiscreen-org:service:dial:1", true},
+		{"urn:schemas-upnp-org:device:MediaRenderer:1", true},
+		{"dial", false},
+		{"uuid:", false},
+		{"urn:schemas-upnp-org:thing:MediaRenderer:1", false},
+		{"urn:schemas-upnp-org:device:MediaRenderer", false},
+	}
+	for _, testCase := range testCases {
+		if computedResult := isSSDPType(testCase.value); computedResult != testCase.expected {
+			t.Errorf("Error in isSSDPType(%s): expected %t, got %t", testCase.value, testCase.expected, computedResult)
+		}
+	}
+}
+
+func TestSSDPAddresses(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	addresses := make(ssdpAddresses)
+	srcMAC, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	srcIP := net.IPv4(192, 168, 1, 10)
+	addresses.learn("aa:bb:cc:dd:ee:ff", &multicastPacket{srcMAC: &srcMAC, srcIP: &srcIP}, now)
+
+	address, ok := addresses.lookup("aa:bb:cc:dd:ee:ff", false, now.Add(time.Minute))
+	if !ok || !address.ip.Equal(srcIP) || address.mac.String() != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("Error in lookup(): expected the learned address, got %+v", address)
+	}
+	if _, ok := addresses.lookup("aa:bb:cc:dd:ee:ff", true, now); ok {
+		t.Error("Error in lookup(): found an IPv6 address for a device which only sent over IPv4")
+	}
+	if _, ok := addresses.lookup("aa:bb:cc:dd:ee:ff", false, now.Add(ssdpAddressTTL)); ok {
+		t.Error("Error in lookup(): expected the address to be forgotten")
+	}
+}
+
+func TestParseSSDPQuery(t *testing.T) {
+	search := "M-SEARCH * HTTP/1.1\r\nHOST: 192.168.101.2:1900\r\nMAN: \"ssdp:discover\"\r\nST: upnp:rootdevice\r\n\r\n"
+	if isSSDPQuery, _, _ := parseSSDPQuery([]byte(search), false); isSSDPQuery {
+		t.Error("Error in parseSSDPQuery(): accepted a multicast M-SEARCH without MX")
+	}
+	if isSSDPQuery, _, maxWaitTime := parseSSDPQuery([]byte(search), true); !isSSDPQuery || maxWaitTime != 1 {
+		t.Errorf("Error in parseSSDPQuery(): expected a unicast M-SEARCH without MX to be answered within a second, got %t %d", isSSDPQuery, maxWaitTime)
+	}
+	search = strings.Replace(search, "\r\n\r\n", "\r\nMX: 3\r\n\r\n", 1)
+	if isSSDPQuery, _, maxWaitTime := parseSSDPQuery([]byte(search), false); !isSSDPQuery || maxWaitTime != 3 {
+		t.Errorf("Error in parseSSDPQuery(): expected MX 3, got %t %d", isSSDPQuery, maxWaitTime)
+	}
+}
+
+func TestForwardUnicastSearch(t *testing.T) {
+	active := newPolicy(config{
+		NetInterface: "test0",
+		Devices: map[macAddress]multicastDevice{
+			"00:14:22:01:23:45": {OriginPool: 100, SharedPools: []uint16{101}},
+		},
+		VlanIPSource: map[vlanID]vlanIpSource{
+			"100": {IpSource: net.ParseIP("192.168.100.2")},
+			"101": {IpSource: net.ParseIP("192.168.101.2"), SSDPUnicastTarget: "00:14:22:01:23:45"},
+		},
+	})
+	reflectorMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	pw := &mockPacketWriter{}
+	in := &trunkHandle{trunk: &trunk{name: "test0", hardwareAddr: reflectorMAC}, handle: pw}
+	handles := trunkHandles{"test0": in}
+	sessions := newSessionTable("test_ssdp", 16, ssdpSessionPorts)
+	addresses := make(ssdpAddresses)
+	search := []byte("M-SEARCH * HTTP/1.1\r\nHOST: 192.168.101.2:1900\r\nMAN: \"ssdp:discover\"\r\nST: upnp:rootdevice\r\n\r\n")
+	multicast := []byte("M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\nST: upnp:rootdevice\r\n\r\n")
+
+	// A multicast M-SEARCH sent to the MAC address of the reflector violates the protocol
+	multicastSearch := createUDPPacket("00:14:22:01:23:99", "01:00:5e:7f:ff:fa", 101, "192.168.101.20", "239.255.255.250", 50000, 1900, multicast)
+	if !multicastSearch.isSSDPQuery || in.isUnicastTo(&multicastSearch) {
+		t.Error("Error in isUnicastTo(): expected a multicast M-SEARCH to a multicast MAC address")
+	}
+	misdirectedSearch := createUDPPacket("00:14:22:01:23:99", "02:00:00:00:00:01", 101, "192.168.101.20", "239.255.255.250", 50000, 1900, multicast)
+	if !in.isUnicastTo(&misdirectedSearch) {
+		t.Error("Error in isUnicastTo(): expected a multicast M-SEARCH to the MAC address of the reflector")
+	}
+
+	unicastSearch := createUDPPacket("00:14:22:01:23:99", "02:00:00:00:00:01", 101, "192.168.101.20", "192.168.101.2", 50000, 1900, search)
+	if !unicastSearch.isSSDPQuery || !in.isUnicastTo(&unicastSearch) {
+		t.Fatal("Error in parseMulticastPacket(): expected a unicast M-SEARCH to the reflector")
+	}
+	forwardUnicastSearch(handles, active, addresses, sessions, &unicastSearch)
+	if pw.packet != nil {
+		t.Error("Error in forwardUnicastSearch(): forwarded a search before the address of the device is known")
+	}
+
+	deviceMAC, _ := net.ParseMAC("00:14:22:01:23:45")
+	deviceIP := net.ParseIP("192.168.100.20")
+	addresses.learn("00:14:22:01:23:45", &multicastPacket{srcMAC: &deviceMAC, srcIP: &deviceIP}, time.Now())
+	unicastSearch = createUDPPacket("00:14:22:01:23:99", "02:00:00:00:00:01", 101, "192.168.101.20", "192.168.101.2", 50000, 1900, search)
+	forwardUnicastSearch(handles, active, addresses, sessions, &unicastSearch)
+	if pw.packet == nil {
+		t.Fatal("Error in forwardUnicastSearch(): expected the search to be forwarded to the device")
+	}
+	sent := parseMulticastPacket(pw.packet)
+	if *sent.vlanTag != 100 || !sent.dstIP.Equal(deviceIP) || sent.dstMAC.String() != "00:14:22:01:23:45" || !bytes.Contains(sent.payload, []byte("HOST: 192.168.100.20:1900")) {
+		t.Errorf("Error in forwardUnicastSearch(): expected the search to 192.168.100.20 on VLAN 100, got:\n%s", sent.payload)
+	}
+	if q, ok := sessions.lookup(*sent.srcPort, 0, 100, ssdpSessionDuration, time.Now()); !ok || q.tag != 101 || q.port != 50000 {
+		t.Errorf("Error in forwardUnicastSearch(): expected a session for the client on VLAN 101 on the reply port %d, got %+v", *sent.srcPort, q)
+	}
+}
+
+// recordingPacketWriter keeps every packet written to it.
+type recordingPacketWriter struct {
+	packets []gopacket.Packet
+}
+
+func (pw *recordingPacketWriter) WritePacketData(bytes []byte) error {
+	pw.packets = append(pw.packets, gopacket.NewPacket(append([]byte{}, bytes...), layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true}))
+	return nil
+}
+
+func TestForwardSSDPAdvertisement(t *testing.T) {
+	active := newPolicy(config{
+		NetInterface: "test0",
+		Devices: map[macAddress]multicastDevice{
+			"00:14:22:01:23:45": {OriginPool: 100, SharedPools: []uint16{101, 102}},
+		},
+		VlanIPSource: map[vlanID]vlanIpSource{
+			"100": {IpSource: net.ParseIP("192.168.100.2")},
+			"101": {IpSource: net.ParseIP("192.168.101.2")},
+			"102": {IpSource: net.ParseIP("192.168.102.2")},
+		},
+	})
+	proxy := newSSDPProxy(newPolicyStore(active))
+	for _, vlan := range []uint16{101, 102} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		proxy.listeners[vlan] = listener
+	}
+	reflectorMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	pw := &recordingPacketWriter{}
+	handles := trunkHandles{"test0": &trunkHandle{trunk: &trunk{name: "test0", hardwareAddr: reflectorMAC}, handle: pw}}
+
+	notify := []byte("NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\nLOCATION: http://192.168.100.20:8008/ssdp/device-desc.xml\r\nUSN: uuid:1234::upnp:rootdevice\r\n\r\n")
+	packet := createUDPPacket("00:14:22:01:23:45", "01:00:5e:7f:ff:fa", 100, "192.168.100.20", "239.255.255.250", 1900, 1900, notify)
+	deviceKey, device, _ := active.allowedDevices.match(&packet)
+	forwardSSDPAdvertisement(handles, active, proxy, newLoopGuard("SSDP"), deviceKey, device, &packet, time.Now())
+
+	if len(pw.packets) != 2 {
+		t.Fatalf("Error in forwardSSDPAdvertisement(): expected a NOTIFY to VLANs 101 and 102, got %d packets", len(pw.packets))
+	}
+	for i, vlan := range []uint16{101, 102} {
+		sent := parseMulticastPacket(pw.packets[i])
+		location := "LOCATION: http://" + proxy.listeners[vlan].Addr().String() + "/"
+		if *sent.vlanTag != vlan || !bytes.Contains(sent.payload, []byte(location)) {
+			t.Errorf("Error in forwardSSDPAdvertisement(): expected a LOCATION of the proxy on VLAN %d, got:\n%s", vlan, sent.payload)
+		}
+	}
+}
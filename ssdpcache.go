@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ssdpCache holds the advertisements and M-SEARCH responses of the shared devices by USN, so M-SEARCH requests
+// can be answered by the reflector instead of being forwarded to the origin VLANs, also for sleeping devices.
+type ssdpCache struct {
+	mu             sync.Mutex
+	advertisements map[string]ssdpAdvertisement
+}
+
+type ssdpAdvertisement struct {
+	// device is the key of the device entry which sent the advertisement
+	device macAddress
+	srcIP  net.IP
+	// nt is the notification type of a NOTIFY, or the search target of a response
+	nt      string
+	usn     string
+	headers http.Header
+	expires time.Time
+}
+
+// ssdpCachedHeaders are the headers of an advertisement which are repeated in the responses from the cache.
+var ssdpCachedHeaders = []string{"LOCATION", "SERVER", "OPT", "01-NLS", "AL", "BOOTID.UPNP.ORG", "CONFIGID.UPNP.ORG", "SEARCHPORT.UPNP.ORG"}
+
+func newSSDPCache() *ssdpCache {
+	return &ssdpCache{advertisements: make(map[string]ssdpAdvertisement)}
+}
+
+// add stores an ssdp:alive NOTIFY or an M-SEARCH response of a device for its max-age, and removes
+// the advertisement of an ssdp:byebye.
+func (cache *ssdpCache) add(device macAddress, srcIP net.IP, payload []byte, now time.Time) {
+	headers, ok := parseSSDPHeaders(payload)
+	if !ok {
+		return
+	}
+	usn := headers.Get("USN")
+	nt := headers.Get("NT")
+	if bytes.HasPrefix(payload, []byte("HTTP/")) {
+		nt = headers.Get("ST")
+	}
+	maxAge, hasMaxAge := parseMaxAge(headers.Get("CACHE-CONTROL"))
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for key, advertisement := range cache.advertisements {
+		if !now.Before(advertisement.expires) {
+			delete(cache.advertisements, key)
+		}
+	}
+	if usn == "" {
+		return
+	}
+	key := strings.ToLower(usn)
+	if headers.Get("NTS") == "ssdp:byebye" {
+		delete(cache.advertisements, key)
+		return
+	}
+	if nt == "" || headers.Get("LOCATION") == "" || !hasMaxAge {
+		return
+	}
+	cache.advertisements[key] = ssdpAdvertisement{device: device, srcIP: srcIP, nt: nt, usn: usn, headers: headers, expires: now.Add(maxAge)}
+}
+
+// answer returns the advertisements of the shared devices which match the search target of an M-SEARCH.
+// 'shared' reports whether the device shares the notification type of an advertisement with the querier.
+func (cache *ssdpCache) answer(st string, shared func(device macAddress, nt string) bool, now time.Time) []ssdpAdvertisement {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	var found []ssdpAdvertisement
+	for _, advertisement := range cache.advertisements {
+		if now.Before(advertisement.expires) && matchSearchTarget(st, advertisement.nt) && shared(advertisement.device, advertisement.nt) {
+			found = append(found, advertisement)
+		}
+	}
+	slices.SortFunc(found, func(a, b ssdpAdvertisement) int { return strings.Compare(a.usn, b.usn) })
+	return found
+}
+
+// matchSearchTarget reports whether an advertisement of the notification type answers the search target.
+// A device or service type answers a search for the same type with a lower or equal version (UPnP 1.1, 1.3.2).
+func matchSearchTarget(st string, nt string) bool {
+	if st == "ssdp:all" || strings.EqualFold(st, nt) {
+		return true
+	}
+	if !strings.HasPrefix(st, "urn:") || !strings.HasPrefix(nt, "urn:") {
+		return false
+	}
+	stType, stVersion := st[:strings.LastIndex(st, ":")], st[strings.LastIndex(st, ":")+1:]
+	ntType, ntVersion := nt[:strings.LastIndex(nt, ":")], nt[strings.LastIndex(nt, ":")+1:]
+	want, err := strconv.Atoi(stVersion)
+	if err != nil {
+		return false
+	}
+	have, err := strconv.Atoi(ntVersion)
+	return err == nil && strings.EqualFold(stType, ntType) && have >= want
+}
+
+// response returns the M-SEARCH response for the advertisement, with the remaining max-age.
+func (advertisement ssdpAdvertisement) response(st string, now time.Time) []byte {
+	if st == "ssdp:all" {
+		st = advertisement.nt
+	}
+	var response bytes.Buffer
+	fmt.Fprintf(&response, "HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=%d\r\nEXT:\r\n", int(advertisement.expires.Sub(now).Seconds()))
+	for _, name := range ssdpCachedHeaders {
+		if value := advertisement.headers.Get(name); value != "" {
+			fmt.Fprintf(&response, "%s: %s\r\n", name, value)
+		}
+	}
+	fmt.Fprintf(&response, "ST: %s\r\nUSN: %s\r\n\r\n", st, advertisement.usn)
+	return response.Bytes()
+}
+
+// parseSSDPHeaders returns the headers of an SSDP request or response.
+func parseSSDPHeaders(payload []byte) (http.Header, bool) {
+	reader := bufio.NewReader(bytes.NewReader(payload))
+	if bytes.HasPrefix(payload, []byte("HTTP/")) {
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			return nil, false
+		}
+		response.Body.Close()
+		return response.Header, true
+	}
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, false
+	}
+	request.Body.Close()
+	return request.Header, true
+}
+
+// parseMaxAge returns the max-age of a CACHE-CONTROL header, like "max-age=1800".
+func parseMaxAge(cacheControl string) (time.Duration, bool) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, ok := strings.Cut(directive, "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "max-age") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || seconds <= 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// ssdpReply is an M-SEARCH response from the cache, sent after a random delay within the MX of the request.
+type ssdpReply struct {
+	vlan    uint16
+	isIPv6  bool
+	dstMAC  net.HardwareAddr
+	dstIP   net.IP
+	dstPort uint16
+	payload []byte
+}
+
+// answerSSDPFromCache answers an M-SEARCH from the cached advertisements of the devices shared with the VLAN
+// of the querier. The responses are sent to 'replies' after a random delay up to the MX of the request.
+// It returns false when no advertisement matches, so the request should be forwarded.
+func answerSSDPFromCache(active *policy, cache *ssdpCache, proxy *ssdpProxy, packet *multicastPacket, replies chan<- ssdpReply) bool {
+	headers, ok := parseSSDPHeaders(packet.payload)
+	if !ok || headers.Get("ST") == "" {
+		return false
+	}
+	vlan := *packet.vlanTag
+	now := time.Now()
+	found := cache.answer(headers.Get("ST"), func(key macAddress, nt string) bool {
+		device, ok := active.allowedDevices.devices[key]
+		return ok && slices.Contains(device.SharedPools, vlan) && device.sharedAt(vlan, now) && ssdpTypeShared(device.ssdpTypesFor(vlan), nt)
+	}, now)
+	if len(found) == 0 {
+		return false
+	}
+
+	for _, advertisement := range found {
+		device := active.allowedDevices.devices[advertisement.device]
+		payload := filterSSDPHeaders(advertisement.response(headers.Get("ST"), now), active.privacyFor(device, vlan))
+		payload = rewriteLocation(payload, func(location string) (string, bool) {
+			return proxy.location(vlan, advertisement.device, advertisement.srcIP, location)
+		})
+		reply := ssdpReply{
+			vlan:    vlan,
+			isIPv6:  packet.isIPv6,
+			dstMAC:  append(net.HardwareAddr{}, *packet.srcMAC...),
+			dstIP:   append(net.IP{}, *packet.srcIP...),
+			dstPort: uint16(*packet.srcPort),
+			payload: payload,
+		}
+		delay := rand.N(time.Duration(max(packet.maxWaitTime, 1)) * time.Second)
+		time.AfterFunc(delay, func() { replies <- reply })
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createMockSSDPNotify(nt string, nts string) []byte {
+	usn := "uuid:2f402f80-da50-11e1-9b23-001788255acc"
+	if nt != usn {
+		usn += "::" + nt
+	}
+	return []byte("NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nCACHE-CONTROL: max-age=100\r\nLOCATION: http://192.168.1.10:80/description.xml\r\n" +
+		"SERVER: Linux/3.14 UPnP/1.0 IpBridge/1.17\r\nNT: " + nt + "\r\nNTS: " + nts + "\r\nUSN: " + usn + "\r\n\r\n")
+}
+
+func TestSSDPCache(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	cache := newSSDPCache()
+	srcIP := net.ParseIP("192.168.1.10")
+	cache.add("aa:bb:cc:dd:ee:ff", srcIP, createMockSSDPNotify("upnp:rootdevice", "ssdp:alive"), now)
+	cache.add("aa:bb:cc:dd:ee:ff", srcIP, createMockSSDPNotify("urn:schemas-upnp-org:device:Basic:1", "ssdp:alive"), now)
+	cache.add("11:22:33:44:55:66", net.ParseIP("192.168.1.11"), []byte("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=1800\r\nEXT:\r\n"+
+		"LOCATION: http://192.168.1.11:8008/ssdp/device-desc.xml\r\nST: urn:dial-multiscreen-org:service:dial:1\r\nUSN: uuid:1234::urn:dial-multiscreen-org:service:dial:1\r\n\r\n"), now)
+	shareAll := func(device macAddress, nt string) bool { return true }
+
+	if found := cache.answer("ssdp:all", shareAll, now.Add(time.Second)); len(found) != 3 {
+		t.Errorf("Error in answer(): expected 3 advertisements for ssdp:all, got %d", len(found))
+	}
+	if found := cache.answer("ssdp:all", func(device macAddress, nt string) bool { return device == "11:22:33:44:55:66" }, now); len(found) != 1 || found[0].device != "11:22:33:44:55:66" {
+		t.Errorf("Error in answer(): expected only the advertisement of the shared device, got %+v", found)
+	}
+	found := cache.answer("urn:schemas-upnp-org:device:Basic:1", shareAll, now.Add(10*time.Second))
+	if len(found) != 1 {
+		t.Fatalf("Error in answer(): expected the Basic:1 device, got %+v", found)
+	}
+	response := string(found[0].response("urn:schemas-upnp-org:device:Basic:1", now.Add(10*time.Second)))
+	for _, header := range []string{
+		"HTTP/1.1 200 OK\r\n",
+		"CACHE-CONTROL: max-age=90\r\n",
+		"LOCATION: http://192.168.1.10:80/description.xml\r\n",
+		"SERVER: Linux/3.14 UPnP/1.0 IpBridge/1.17\r\n",
+		"ST: urn:schemas-upnp-org:device:Basic:1\r\n",
+		"USN: uuid:2f402f80-da50-11e1-9b23-001788255acc::urn:schemas-upnp-org:device:Basic:1\r\n",
+	} {
+		if !strings.Contains(response, header) {
+			t.Errorf("Error in response(): expected %q in %q", header, response)
+		}
+	}
+
+	// Advertisements are removed by ssdp:byebye and after their max-age
+	cache.add("aa:bb:cc:dd:ee:ff", srcIP, createMockSSDPNotify("upnp:rootdevice", "ssdp:byebye"), now.Add(20*time.Second))
+	if found := cache.answer("upnp:rootdevice", shareAll, now.Add(20*time.Second)); len(found) != 0 {
+		t.Errorf("Error in add(): expected the byebye to remove the root device, got %+v", found)
+	}
+	if found := cache.answer("ssdp:all", shareAll, now.Add(100*time.Second)); len(found) != 1 {
+		t.Errorf("Error in answer(): expected only the advertisement with max-age 1800 after 100 seconds, got %d", len(found))
+	}
+}
+
+func TestMatchSearchTarget(t *testing.T) {
+	testCases := []struct {
+		st, nt   string
+		expected bool
+	}{
+		{"ssdp:all", "upnp:rootdevice", true},
+		{"upnp:rootdevice", "upnp:rootdevice", true},
+		{"upnp:rootdevice", "uuid:1234", false},
+		{"urn:schemas-upnp-org:device:MediaRenderer:1", "urn:schemas-upnp-org:device:MediaRenderer:3", true},
+		{"urn:schemas-upnp-org:device:MediaRenderer:2", "urn:schemas-upnp-org:device:MediaRenderer:1", false},
+		{"urn:schemas-upnp-org:device:MediaRenderer:1", "urn:schemas-upnp-org:device:MediaServer:1", false},
+	}
+	for _, testCase := range testCases {
+		if computedResult := matchSearchTarget(testCase.st, testCase.nt); computedResult != testCase.expected {
+			t.Errorf("Error in matchSearchTarget(%s, %s): expected %t, got %t", testCase.st, testCase.nt, testCase.expected, computedResult)
+		}
+	}
+}
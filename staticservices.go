@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// staticAnnounceInterval is how often the static services are announced again, well within the
+// TTL of their host records, so caches never have to query for them.
+var staticAnnounceInterval = time.Minute
+
+// instanceName returns the name of the service instance, like "Office Printer._ipp._tcp.local".
+func (service staticService) instanceName() string {
+	return joinDNSLabels([]string{service.Name}) + "." + normalizeServiceType(service.Type)
+}
+
+// hostName returns the host of the service in .local, "printer" and "printer.local" are both "printer.local".
+func (service staticService) hostName() string {
+	return normalizeServiceType(service.Host)
+}
+
+// records returns the DNS-SD records of the service (RFC 6763), with the TTLs of RFC 6762 section 10:
+// 120 seconds for the records which contain a host name, 75 minutes for the others.
+func (service staticService) records() []dnsRecord {
+	serviceType, instance, host := normalizeServiceType(service.Type), service.instanceName(), service.hostName()
+
+	srv := binary.BigEndian.AppendUint16([]byte{0, 0, 0, 0}, service.Port)
+	var txt []byte
+	for _, entry := range service.TXT {
+		txt = append(append(txt, byte(len(entry))), entry...)
+	}
+	if len(txt) == 0 {
+		// A TXT record without data has a single empty string (section 6.1)
+		txt = []byte{0}
+	}
+
+	records := []dnsRecord{
+		{name: serviceType, rtype: dnsTypePTR, class: dnsClassIN, ttl: 4500, rdata: appendDNSName(nil, instance, nil, 0)},
+		{name: dnssdServicesName, rtype: dnsTypePTR, class: dnsClassIN, ttl: 4500, rdata: appendDNSName(nil, serviceType, nil, 0)},
+		{name: instance, rtype: dnsTypeSRV, class: dnsClassIN | dnsClassCacheFlush, ttl: 120, rdata: appendDNSName(srv, host, nil, 0)},
+		{name: instance, rtype: dnsTypeTXT, class: dnsClassIN | dnsClassCacheFlush, ttl: 4500, rdata: txt},
+	}
+	for _, address := range service.Addresses {
+		ip := net.ParseIP(address)
+		switch {
+		case ip == nil:
+		case ip.To4() != nil:
+			records = append(records, dnsRecord{name: host, rtype: dnsTypeA, class: dnsClassIN | dnsClassCacheFlush, ttl: 120, rdata: ip.To4()})
+		default:
+			records = append(records, dnsRecord{name: host, rtype: dnsTypeAAAA, class: dnsClassIN | dnsClassCacheFlush, ttl: 120, rdata: ip.To16()})
+		}
+	}
+	return records
+}
+
+// mapStaticRecordsByVlan returns per VLAN the records of the static services shared with it.
+// Services on the same host share its address records.
+func mapStaticRecordsByVlan(services []staticService) map[uint16][]dnsRecord {
+	recordsMap := make(map[uint16][]dnsRecord)
+	for _, service := range services {
+		records := service.records()
+		for _, vlan := range service.SharedPools {
+			for _, rr := range records {
+				if !slices.ContainsFunc(recordsMap[vlan], func(other dnsRecord) bool { return sameRecord(rr, other) }) {
+					recordsMap[vlan] = append(recordsMap[vlan], rr)
+				}
+			}
+		}
+	}
+	return recordsMap
+}
+
+func sameRecord(a, b dnsRecord) bool {
+	return a.rtype == b.rtype && equalDNSNames(a.name, b.name) && string(a.rdata) == string(b.rdata)
+}
+
+// staticAnswer returns the response to the query from the static records, with the SRV, TXT and address
+// records of the answers as additional records (RFC 6763 section 12). It returns nil when none of the
+// questions are about a static record, or the querier already knows all answers.
+func staticAnswer(records []dnsRecord, query *dnsMessage) *dnsMessage {
+	response := &dnsMessage{flags: dnsFlagResponse | dnsFlagAuthoritative}
+	addMatching := func(section *[]dnsRecord, name string, qtype uint16) {
+		for _, rr := range records {
+			if equalDNSNames(rr.name, name) && (qtype == dnsTypeANY || rr.rtype == qtype) && !slices.ContainsFunc(*section, func(other dnsRecord) bool { return sameRecord(rr, other) }) {
+				*section = append(*section, rr)
+			}
+		}
+	}
+	for _, question := range query.questions {
+		addMatching(&response.answers, question.name, question.qtype)
+	}
+	response.answers = filterRecords(response.answers, func(rr dnsRecord) bool {
+		return !isKnownAnswer(query.answers, rr)
+	})
+	if len(response.answers) == 0 {
+		return nil
+	}
+
+	for _, rr := range response.answers {
+		if rr.rtype == dnsTypePTR {
+			addMatching(&response.additionals, rr.target(), dnsTypeSRV)
+			addMatching(&response.additionals, rr.target(), dnsTypeTXT)
+		}
+	}
+	for _, rr := range append(append([]dnsRecord{}, response.answers...), response.additionals...) {
+		if rr.rtype == dnsTypeSRV {
+			addMatching(&response.additionals, rr.target(), dnsTypeA)
+			addMatching(&response.additionals, rr.target(), dnsTypeAAAA)
+		}
+	}
+	response.additionals = filterRecords(response.additionals, func(rr dnsRecord) bool {
+		return !slices.ContainsFunc(response.answers, func(answer dnsRecord) bool { return sameRecord(rr, answer) })
+	})
+	return response
+}
+
+// staticAnnouncer keeps track of the static records announced on every VLAN. New and changed records are
+// announced twice, one second apart (RFC 6762 section 8.3), and again every staticAnnounceInterval.
+// Removed records are sent with TTL 0, as a goodbye (section 10.1).
+type staticAnnouncer struct {
+	announced map[uint16][]dnsRecord
+	next      time.Time
+	repeat    bool
+}
+
+func newStaticAnnouncer() *staticAnnouncer {
+	return &staticAnnouncer{announced: make(map[uint16][]dnsRecord)}
+}
+
+// due returns per VLAN the records to send now, for the static records of the active policy.
+func (announcer *staticAnnouncer) due(current map[uint16][]dnsRecord, now time.Time) map[uint16][]dnsRecord {
+	due := make(map[uint16][]dnsRecord)
+	for vlan, records := range announcer.announced {
+		for _, rr := range records {
+			if !slices.ContainsFunc(current[vlan], func(other dnsRecord) bool { return sameRecord(rr, other) }) {
+				rr.ttl = 0
+				due[vlan] = append(due[vlan], rr)
+			}
+		}
+	}
+	if !reflect.DeepEqual(current, announcer.announced) {
+		announcer.announced, announcer.next, announcer.repeat = current, now, true
+	}
+	if now.Before(announcer.next) {
+		return due
+	}
+
+	for vlan, records := range current {
+		due[vlan] = append(due[vlan], records...)
+	}
+	if announcer.repeat {
+		announcer.next, announcer.repeat = now.Add(time.Second), false
+	} else {
+		announcer.next = now.Add(staticAnnounceInterval)
+	}
+	return due
+}
+
+// goodbyes returns per VLAN all announced records with TTL 0, and forgets them.
+func (announcer *staticAnnouncer) goodbyes() map[uint16][]dnsRecord {
+	return announcer.due(make(map[uint16][]dnsRecord), time.Time{})
+}
+
+// announceStatic multicasts the records on their VLANs, over IPv4 from the ip_source and over IPv6
+// from the ip6_source or link-local address of the trunk.
+func announceStatic(handles trunkHandles, active *policy, guard *loopGuard, due map[uint16][]dnsRecord) {
+	vlans := make([]uint16, 0, len(due))
+	for vlan := range due {
+		vlans = append(vlans, vlan)
+	}
+	sort.Slice(vlans, func(i, j int) bool { return vlans[i] < vlans[j] })
+
+	for _, vlan := range vlans {
+		out, ok := handles.forVlan(active, vlan)
+		if !ok {
+			continue
+		}
+		for _, msg := range splitResponse(due[vlan], maxCoalescedQuerySize) {
+			payload := msg.pack()
+			for _, isIPv6 := range []bool{false, true} {
+				dstMacAddress, dstIP := net.HardwareAddr{0x01, 0x00, 0x5E, 0x00, 0x00, 0xFB}, net.IPv4(224, 0, 0, 251)
+				if isIPv6 {
+					dstMacAddress, dstIP = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0xFB}, net.ParseIP("ff02::fb")
+				}
+				srcIP := out.sourceIP(active, vlan, isIPv6)
+				if srcIP == nil {
+					continue
+				}
+				if err := sendUDP(out.handle, active.wireTag(vlan), out.hardwareAddr, dstMacAddress, srcIP, dstIP, 5353, 5353, payload); err != nil {
+					logrus.Warningf("Could not announce static services on VLAN %d: %v", vlan, err)
+				}
+			}
+			guard.sentTo(vlan, payload, time.Now())
+		}
+		logrus.Debugf("Announced %d static records on VLAN %d", len(due[vlan]), vlan)
+	}
+}
+
+// splitResponse puts the records in as few unsolicited responses of at most 'size' bytes as possible.
+func splitResponse(records []dnsRecord, size int) []*dnsMessage {
+	var messages []*dnsMessage
+	msg := &dnsMessage{flags: dnsFlagResponse | dnsFlagAuthoritative}
+	for _, rr := range records {
+		msg.answers = append(msg.answers, rr)
+		if len(msg.answers) > 1 && len(msg.pack()) > size {
+			msg.answers = msg.answers[:len(msg.answers)-1]
+			messages = append(messages, msg)
+			msg = &dnsMessage{flags: dnsFlagResponse | dnsFlagAuthoritative, answers: []dnsRecord{rr}}
+		}
+	}
+	if len(msg.answers) > 0 {
+		messages = append(messages, msg)
+	}
+	return messages
+}
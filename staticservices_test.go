@@ -0,0 +1,117 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func createMockStaticService() staticService {
+	return staticService{
+		Name:        "Office Printer",
+		Type:        "_ipp._tcp",
+		Host:        "printer",
+		Port:        631,
+		TXT:         []string{"rp=ipp/print", "ty=Office"},
+		Addresses:   []string{"10.20.0.5", "fd00:20::5"},
+		SharedPools: []uint16{101, 102},
+	}
+}
+
+func TestStaticAnswer(t *testing.T) {
+	recordsMap := mapStaticRecordsByVlan([]staticService{createMockStaticService()})
+	if len(recordsMap[101]) != 6 || len(recordsMap[103]) != 0 {
+		t.Fatalf("Error in mapStaticRecordsByVlan(): expected 6 records on VLAN 101 and none on 103, got %v", recordsMap)
+	}
+	names := func(records []dnsRecord) (names []string) {
+		for _, rr := range records {
+			names = append(names, rr.name+"/"+rr.target())
+		}
+		return names
+	}
+
+	browse := &dnsMessage{questions: []dnsQuestion{{name: "_ipp._tcp.local", qtype: dnsTypePTR, qclass: dnsClassIN}}}
+	response := staticAnswer(recordsMap[101], browse)
+	if response == nil {
+		t.Fatal("Error in staticAnswer(): the browse query for _ipp._tcp was not answered")
+	}
+	if expectedResult := []string{"_ipp._tcp.local/Office Printer._ipp._tcp.local"}; !reflect.DeepEqual(expectedResult, names(response.answers)) {
+		t.Errorf("Error in staticAnswer(): got answers %q", names(response.answers))
+	}
+	expectedAdditionals := []string{
+		"Office Printer._ipp._tcp.local/printer.local",
+		"Office Printer._ipp._tcp.local/",
+		"printer.local/",
+		"printer.local/",
+	}
+	if computedResult := names(response.additionals); !reflect.DeepEqual(expectedAdditionals, computedResult) {
+		t.Errorf("Error in staticAnswer(): got additionals %q", computedResult)
+	}
+	if txt := string(response.additionals[1].rdata); txt != "\x0crp=ipp/print\x09ty=Office" {
+		t.Errorf("Error in records(): got TXT data %q", txt)
+	}
+
+	// A querier which knows the answer gets no response, and names of other devices are not answered
+	browse.answers = response.answers
+	if response := staticAnswer(recordsMap[101], browse); response != nil {
+		t.Errorf("Error in staticAnswer(): answered a known answer with %q", names(response.answers))
+	}
+	other := &dnsMessage{questions: []dnsQuestion{{name: "_googlecast._tcp.local", qtype: dnsTypePTR, qclass: dnsClassIN}}}
+	if response := staticAnswer(recordsMap[101], other); response != nil {
+		t.Errorf("Error in staticAnswer(): answered a query for another service with %q", names(response.answers))
+	}
+}
+
+func TestStaticAnnouncer(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	announcer := newStaticAnnouncer()
+	recordsMap := mapStaticRecordsByVlan([]staticService{createMockStaticService()})
+
+	// New records are announced twice, one second apart, and then every staticAnnounceInterval
+	if due := announcer.due(recordsMap, now); len(due[101]) != 6 || len(due[102]) != 6 {
+		t.Fatalf("Error in due(): expected the records to be announced on VLAN 101 and 102, got %v", due)
+	}
+	if due := announcer.due(recordsMap, now.Add(500*time.Millisecond)); len(due) != 0 {
+		t.Errorf("Error in due(): expected no announcement within a second, got %v", due)
+	}
+	if due := announcer.due(recordsMap, now.Add(time.Second)); len(due[101]) != 6 {
+		t.Errorf("Error in due(): expected the second announcement after a second, got %v", due)
+	}
+	if due := announcer.due(recordsMap, now.Add(2*time.Second)); len(due) != 0 {
+		t.Errorf("Error in due(): expected no third announcement, got %v", due)
+	}
+	if due := announcer.due(recordsMap, now.Add(time.Second+staticAnnounceInterval)); len(due[101]) != 6 {
+		t.Errorf("Error in due(): expected an announcement after the interval, got %v", due)
+	}
+
+	// A VLAN which is removed gets goodbyes, the other VLAN the records again
+	service := createMockStaticService()
+	service.SharedPools = []uint16{101}
+	due := announcer.due(mapStaticRecordsByVlan([]staticService{service}), now.Add(2*staticAnnounceInterval))
+	if len(due[101]) != 6 || len(due[102]) != 6 || due[102][0].ttl != 0 || due[101][0].ttl == 0 {
+		t.Errorf("Error in due(): expected goodbyes on VLAN 102 and the records on VLAN 101, got %v", due)
+	}
+
+	goodbyes := announcer.goodbyes()
+	if len(goodbyes) != 1 || len(goodbyes[101]) != 6 || goodbyes[101][0].ttl != 0 {
+		t.Errorf("Error in goodbyes(): expected the goodbyes of VLAN 101, got %v", goodbyes)
+	}
+	if goodbyes := announcer.goodbyes(); len(goodbyes) != 0 {
+		t.Errorf("Error in goodbyes(): expected nothing after the goodbyes were sent, got %v", goodbyes)
+	}
+}
+
+func TestSplitResponse(t *testing.T) {
+	records := createMockServiceResponse().additionals
+	messages := splitResponse(records, 150)
+	count := 0
+	for _, msg := range messages {
+		if len(msg.pack()) > 150 {
+			t.Errorf("Error in splitResponse(): got a message of %d bytes", len(msg.pack()))
+		}
+		count += len(msg.answers)
+	}
+	if len(messages) < 2 || count != len(records) {
+		t.Errorf("Error in splitResponse(): expected the %d records in several messages, got %d records in %d messages", len(records), count, len(messages))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/pcap"
+	"github.com/sirupsen/logrus"
+)
+
+// trunk is a network interface which carries tagged VLANs. Every trunk has its own
+// MAC address, so the reflector owns its ip_source and link-local addresses per trunk.
+type trunk struct {
+	name         string
+	hardwareAddr net.HardwareAddr
+	ipv6Address  net.IP
+}
+
+func newTrunk(name string) (*trunk, error) {
+	intf, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	removeVlanFilter(intf.Name)
+	return &trunk{
+		name:         intf.Name,
+		hardwareAddr: intf.HardwareAddr,
+		ipv6Address:  generateIPv6FromMac(intf.HardwareAddr),
+	}, nil
+}
+
+// trunkHandle is the pcap handle of a packet processor on one trunk.
+type trunkHandle struct {
+	*trunk
+	handle packetWriter
+}
+
+type trunkHandles map[string]*trunkHandle
+
+// isUnicastTo reports whether the packet was sent to the MAC address of the trunk instead of a multicast MAC address.
+func (t *trunk) isUnicastTo(packet *multicastPacket) bool {
+	return packet.dstMAC != nil && bytes.Equal(*packet.dstMAC, t.hardwareAddr)
+}
+
+// sourceIP returns the address to send packets to the VLAN from: the ip_source for IPv4,
+// and the ip6_source or else the link-local address of the trunk for IPv6.
+func (t *trunk) sourceIP(active *policy, vlan uint16, isIPv6 bool) net.IP {
+	if !isIPv6 {
+		return active.vlanIPMap[vlan]
+	}
+	if ip6 := active.vlanIP6Map[vlan]; ip6 != nil {
+		return ip6
+	}
+	return t.ipv6Address
+}
+
+// forVlan returns the handle of the trunk which carries the VLAN in the active policy.
+func (handles trunkHandles) forVlan(active *policy, vlan uint16) (*trunkHandle, bool) {
+	name := active.interfaceOf(vlan)
+	if name == "" {
+		logrus.Warningf("VLAN %d is not on any of the interfaces, its packets are not sent", vlan)
+		return nil, false
+	}
+	out, ok := handles[name]
+	if !ok {
+		logrus.Warningf("Interface %s of VLAN %d is not opened, restart the reflector to use it", active.interfaceOf(vlan), vlan)
+	}
+	return out, ok
+}
+
+// vlanFilter returns a BPF filter for the frames matching 'filter', both untagged and 802.1Q tagged,
+// which are not sent by the trunk itself. The vlan keyword shifts the offsets of everything after it,
+// so the untagged part has to come first.
+func vlanFilter(t *trunk, filter string) string {
+	return fmt.Sprintf("not (ether src %s) and ((not vlan and %s) or (vlan and %s))", t.hardwareAddr, filter, filter)
+}
+
+// captureTrunks opens a pcap handle with the BPF filter returned by 'filter' on every trunk,
+// and returns the handles and one channel with the packets of all trunks.
+func captureTrunks(trunks []*trunk, filter func(*trunk) string) (trunkHandles, chan multicastPacket) {
+	handles := make(trunkHandles)
+	packets := make(chan multicastPacket, 100)
+
+	for _, t := range trunks {
+		rawTraffic, err := pcap.OpenLive(t.name, 65536, true, time.Second)
+		if err != nil {
+			logrus.Fatalf("Could not find network interface: %v", t.name)
+		}
+		err = rawTraffic.SetBPFFilter(filter(t))
+		if err != nil {
+			logrus.Fatalf("Could not apply filter on network interface: %v", err)
+		}
+		handles[t.name] = &trunkHandle{trunk: t, handle: rawTraffic}
+
+		decoder := gopacket.DecodersByLayerName["Ethernet"]
+		source := gopacket.NewPacketSource(rawTraffic, decoder)
+		go func(name string, trunkPackets chan multicastPacket) {
+			for packet := range trunkPackets {
+				packet.netInterface = name
+				packets <- packet
+			}
+		}(t.name, parsePacketsLazily(source))
+	}
+	return handles, packets
+}
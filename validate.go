@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// answerValidator checks that the address records in the mDNS responses of a device describe the device
+// itself, when validate_answers is set. The addresses of a device are its configured 'addresses' and the
+// source addresses of its packets, the host names are its configured 'hostnames' and the names it announced
+// first. Learned addresses and names are forgotten after learnedAnswerTTL.
+type answerValidator struct {
+	addresses map[macAddress]map[string]time.Time
+	hosts     map[string]hostOwner
+	lastSweep time.Time
+}
+
+type hostOwner struct {
+	device  macAddress
+	expires time.Time
+}
+
+// answerViolation is an address record which does not belong to the device which sent it.
+type answerViolation struct {
+	rr dnsRecord
+	// owner is the other device the host name belongs to, empty when the address is not one of the device
+	owner string
+}
+
+// learnedAnswerTTL is how long a source address or host name stays with a device after it was last seen.
+var learnedAnswerTTL = time.Hour
+
+func newAnswerValidator() *answerValidator {
+	return &answerValidator{
+		addresses: make(map[macAddress]map[string]time.Time),
+		hosts:     make(map[string]hostOwner),
+	}
+}
+
+// validate returns the address records of the response which do not belong to the device, and learns
+// the source address of the packet and the host names of the other address records.
+func (validator *answerValidator) validate(active *policy, device macAddress, srcIP net.IP, msg *dnsMessage, now time.Time) (violations []answerViolation) {
+	if now.Sub(validator.lastSweep) >= time.Minute {
+		validator.sweep(now)
+	}
+	learned, ok := validator.addresses[device]
+	if !ok {
+		learned = make(map[string]time.Time)
+		validator.addresses[device] = learned
+	}
+	if srcIP != nil {
+		learned[srcIP.String()] = now.Add(learnedAnswerTTL)
+	}
+
+	staticHosts := make(map[string]bool)
+	for _, service := range active.cfg.StaticServices {
+		staticHosts[normalizeHostname(service.hostName())] = true
+	}
+
+	var announced []string
+	for _, section := range [][]dnsRecord{msg.answers, msg.authorities, msg.additionals} {
+		for _, rr := range section {
+			if rr.rtype != dnsTypeA && rr.rtype != dnsTypeAAAA {
+				continue
+			}
+			host := normalizeHostname(rr.name)
+			switch {
+			case staticHosts[host]:
+				violations = append(violations, answerViolation{rr: rr, owner: "the static services"})
+			case active.allowedDevices.hostnames[host] != "" && active.allowedDevices.hostnames[host] != device:
+				violations = append(violations, answerViolation{rr: rr, owner: "device " + string(active.allowedDevices.hostnames[host])})
+			case validator.hosts[host].device != "" && validator.hosts[host].device != device && now.Before(validator.hosts[host].expires):
+				violations = append(violations, answerViolation{rr: rr, owner: "device " + string(validator.hosts[host].device)})
+			case !validator.ownsAddress(active, device, learned, rr.ip(), now):
+				violations = append(violations, answerViolation{rr: rr})
+			default:
+				announced = append(announced, host)
+			}
+		}
+	}
+	for _, host := range announced {
+		validator.hosts[host] = hostOwner{device: device, expires: now.Add(learnedAnswerTTL)}
+	}
+	return violations
+}
+
+// ownsAddress reports whether the address is a configured or learned address of the device. An IPv6 address
+// with the interface identifier of a learned IPv6 address is one of the device too, like the global address
+// which goes with a link-local source address.
+func (validator *answerValidator) ownsAddress(active *policy, device macAddress, learned map[string]time.Time, ip net.IP, now time.Time) bool {
+	if ip == nil {
+		return false
+	}
+	for _, rule := range active.allowedDevices.networks {
+		if rule.device == device && rule.match.Contains(ip) {
+			return true
+		}
+	}
+	for address, expires := range learned {
+		if now.After(expires) {
+			continue
+		}
+		other := net.ParseIP(address)
+		if other.Equal(ip) {
+			return true
+		}
+		if ip.To4() == nil && other.To4() == nil && string(other.To16()[8:]) == string(ip.To16()[8:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (validator *answerValidator) sweep(now time.Time) {
+	validator.lastSweep = now
+	for device, learned := range validator.addresses {
+		for address, expires := range learned {
+			if now.After(expires) {
+				delete(learned, address)
+			}
+		}
+		if len(learned) == 0 {
+			delete(validator.addresses, device)
+		}
+	}
+	for host, owner := range validator.hosts {
+		if now.After(owner.expires) {
+			delete(validator.hosts, host)
+		}
+	}
+}
+
+// validateResponse applies validate_answers to an mDNS response of the device. With "reject" a response with
+// a violation is dropped, with "strip" the violating records are removed and the rest is kept in validPayload.
+// It returns false when the packet should be dropped.
+func validateResponse(active *policy, validator *answerValidator, device macAddress, packet *multicastPacket) bool {
+	packet.validPayload = nil
+	mode := active.cfg.ValidateAnswers
+	if mode == "" {
+		return true
+	}
+	msg, err := parseDNSMessage(packet.payload)
+	if err != nil {
+		return mode != "reject"
+	}
+	var srcIP net.IP
+	if packet.srcIP != nil {
+		srcIP = *packet.srcIP
+	}
+	violations := validator.validate(active, device, srcIP, msg, time.Now())
+	if len(violations) == 0 {
+		return true
+	}
+	for _, violation := range violations {
+		if violation.owner == "" {
+			logrus.Warningf("spoofing/invalid answer detected from %s. Config expected the addresses of device %s, got %s for %s.", packet.srcMAC.String(), device, violation.rr.ip(), violation.rr.name)
+		} else {
+			logrus.Warningf("spoofing/invalid answer detected from %s. Config expected host %s to belong to %s, got it from device %s.", packet.srcMAC.String(), violation.rr.name, violation.owner, device)
+		}
+	}
+	if mode == "reject" {
+		return false
+	}
+
+	valid := func(rr dnsRecord) bool {
+		for _, violation := range violations {
+			if sameRecord(rr, violation.rr) {
+				return false
+			}
+		}
+		return true
+	}
+	stripped := msg.copyMessage()
+	stripped.answers = filterRecords(msg.answers, valid)
+	stripped.authorities = filterRecords(msg.authorities, valid)
+	stripped.additionals = filterRecords(msg.additionals, valid)
+	if len(stripped.answers) == 0 {
+		return false
+	}
+	packet.validPayload = stripped.pack()
+	return true
+}
+
+// responsePayload returns the payload of an mDNS response after validate_answers.
+func (packet *multicastPacket) responsePayload() []byte {
+	if packet.validPayload != nil {
+		return packet.validPayload
+	}
+	return packet.payload
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAnswerValidator(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	active := newPolicy(config{
+		ValidateAnswers: "strip",
+		Devices: map[macAddress]multicastDevice{
+			"aa:bb:cc:dd:ee:ff": {OriginPool: 100, SharedPools: []uint16{101}, Addresses: []string{"192.168.1.10"}, Hostnames: []string{"tv"}},
+			"11:22:33:44:55:66": {OriginPool: 100, SharedPools: []uint16{101}},
+		},
+	})
+	validator := newAnswerValidator()
+	address := func(name string, ip string) *dnsMessage {
+		rtype := uint16(dnsTypeA)
+		if net.ParseIP(ip).To4() == nil {
+			rtype = dnsTypeAAAA
+		}
+		rdata := net.ParseIP(ip).To16()
+		if rtype == dnsTypeA {
+			rdata = net.ParseIP(ip).To4()
+		}
+		return &dnsMessage{flags: dnsFlagResponse, answers: []dnsRecord{{name: name, rtype: rtype, class: dnsClassIN, ttl: 120, rdata: rdata}}}
+	}
+
+	testCases := []struct {
+		description string
+		device      macAddress
+		srcIP       string
+		msg         *dnsMessage
+		owner       string
+		valid       bool
+	}{
+		{"configured address", "aa:bb:cc:dd:ee:ff", "192.168.1.10", address("tv.local", "192.168.1.10"), "", true},
+		{"address of another host", "aa:bb:cc:dd:ee:ff", "192.168.1.10", address("tv.local", "192.168.1.1"), "", false},
+		{"configured host name of another device", "11:22:33:44:55:66", "192.168.1.20", address("TV.local", "192.168.1.20"), "device aa:bb:cc:dd:ee:ff", false},
+		{"learned source address", "11:22:33:44:55:66", "192.168.1.20", address("speaker.local", "192.168.1.20"), "", true},
+		{"learned host name of another device", "aa:bb:cc:dd:ee:ff", "192.168.1.10", address("speaker.local", "192.168.1.10"), "device 11:22:33:44:55:66", false},
+		{"interface identifier of the link-local source", "11:22:33:44:55:66", "fe80::1234:5678:9abc:def0", address("speaker.local", "fd00::1234:5678:9abc:def0"), "", true},
+		{"other IPv6 address", "11:22:33:44:55:66", "fe80::1234:5678:9abc:def0", address("speaker.local", "fd00::1"), "", false},
+	}
+	for _, testCase := range testCases {
+		violations := validator.validate(active, testCase.device, net.ParseIP(testCase.srcIP), testCase.msg, now)
+		if testCase.valid && len(violations) != 0 {
+			t.Errorf("Error in validate(): %s: expected no violations, got %+v", testCase.description, violations)
+		}
+		if !testCase.valid && (len(violations) != 1 || violations[0].owner != testCase.owner) {
+			t.Errorf("Error in validate(): %s: expected a violation with owner %q, got %+v", testCase.description, testCase.owner, violations)
+		}
+	}
+
+	// Learned addresses and host names are forgotten
+	later := now.Add(learnedAnswerTTL + time.Minute)
+	if violations := validator.validate(active, "aa:bb:cc:dd:ee:ff", nil, address("speaker.local", "192.168.1.10"), later); len(violations) != 0 {
+		t.Errorf("Error in validate(): expected the learned host name to be forgotten, got %+v", violations)
+	}
+	if violations := validator.validate(active, "11:22:33:44:55:66", nil, address("other.local", "192.168.1.20"), later); len(violations) != 1 {
+		t.Errorf("Error in validate(): expected the learned address to be forgotten, got %+v", violations)
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	cfg := config{
+		ValidateAnswers: "strip",
+		Devices: map[macAddress]multicastDevice{
+			"aa:bb:cc:dd:ee:ff": {OriginPool: 100, SharedPools: []uint16{101}},
+		},
+	}
+	srcMAC, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	srcIP := net.IPv4(192, 168, 1, 10)
+	packet := &multicastPacket{srcMAC: &srcMAC, srcIP: &srcIP, payload: createMockServiceResponse().pack()}
+
+	// The address of other.local is stripped, the rest of the response is kept
+	if !validateResponse(newPolicy(cfg), newAnswerValidator(), "aa:bb:cc:dd:ee:ff", packet) {
+		t.Fatal("Error in validateResponse(): dropped the response in strip mode")
+	}
+	msg, err := parseDNSMessage(packet.responsePayload())
+	if err != nil {
+		t.Fatalf("Error in validateResponse(): cannot parse the stripped payload: %v", err)
+	}
+	if len(msg.answers) != 4 || len(msg.additionals) != 5 {
+		t.Errorf("Error in validateResponse(): expected 4 answers and 5 additionals, got %d and %d", len(msg.answers), len(msg.additionals))
+	}
+	for _, rr := range msg.additionals {
+		if rr.name == "other.local" {
+			t.Error("Error in validateResponse(): the address of other.local was not stripped")
+		}
+	}
+
+	cfg.ValidateAnswers = "reject"
+	if validateResponse(newPolicy(cfg), newAnswerValidator(), "aa:bb:cc:dd:ee:ff", packet) {
+		t.Error("Error in validateResponse(): expected the response to be rejected")
+	}
+	cfg.ValidateAnswers = ""
+	if !validateResponse(newPolicy(cfg), newAnswerValidator(), "aa:bb:cc:dd:ee:ff", packet) || packet.validPayload != nil {
+		t.Error("Error in validateResponse(): expected the response to pass without validate_answers")
+	}
+}
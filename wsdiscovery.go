@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// wsDiscoverySessionDuration is how long the ProbeMatches and ResolveMatches of a Probe or Resolve are relayed,
+// the MATCH_TIMEOUT of WS-Discovery 1.1.
+var wsDiscoverySessionDuration = 10 * time.Second
+
+// wsDiscoveryNamespaces are the action prefixes of WS-Discovery April 2005, used by Windows, and of WS-Discovery 1.1.
+var wsDiscoveryNamespaces = []string{
+	"http://schemas.xmlsoap.org/ws/2005/04/discovery/",
+	"http://docs.oasis-open.org/ws-dd/ns/discovery/2009/01/",
+}
+
+// wsDiscoveryMessage holds the WS-Addressing headers of a WS-Discovery message.
+type wsDiscoveryMessage struct {
+	// action is the action without its namespace, like Probe or ProbeMatches
+	action    string
+	messageID string
+	relatesTo string
+}
+
+type wsDiscoveryEnvelope struct {
+	Header struct {
+		Action    string `xml:"Action"`
+		MessageID string `xml:"MessageID"`
+		RelatesTo string `xml:"RelatesTo"`
+	} `xml:"Header"`
+}
+
+// WS-Discovery request = multicast Probe or Resolve
+// WS-Discovery response = unicast ProbeMatches or ResolveMatches to the request src, with the MessageID of the request in RelatesTo.
+// WS-Discovery announcement = multicast Hello or Bye.
+func processWSDiscoveryPackets(trunks []*trunk, policies *policyStore) {
+	// Get a channel of WS-Discovery packets to process from a handle on every trunk.
+	// Devices answer from the WS-Discovery port to the port of the request.
+	filterTemplate := "udp and ((dst net (239.255.255.250 or ff02::c) and dst port 3702) or (ether dst %s and src port 3702))"
+	handles, wsdPackets := captureTrunks(trunks, func(t *trunk) string {
+		return vlanFilter(t, fmt.Sprintf(filterTemplate, t.hardwareAddr))
+	})
+
+	wsdSessions := newSessionTable("wsd", maxSessions, wsdSessionPorts)
+	guard := newLoopGuard("WS-Discovery")
+
+	for wsdPacket := range wsdPackets {
+		reflectWSDiscovery(handles, policies.Load(), wsdSessions, guard, wsdPacket, time.Now())
+	}
+}
+
+// reflectWSDiscovery forwards a request to the VLANs of the devices shared with the client, an announcement
+// to the VLANs the device is shared with, and a match to the clients of the request it relates to.
+func reflectWSDiscovery(handles trunkHandles, active *policy, wsdSessions *sessionTable, guard *loopGuard, wsdPacket multicastPacket, now time.Time) {
+	var dstMacAddress net.HardwareAddr
+
+	message, ok := parseWSDiscovery(wsdPacket.payload)
+	if !ok || wsdPacket.srcPort == nil || wsdPacket.dstPort == nil {
+		logrus.Debugf("Got a packet that is not a WS-Discovery message:\n%s", wsdPacket.packet.String())
+		return
+	}
+	vlan, ok := active.vlanOf(wsdPacket.netInterface, wsdPacket.vlanTag)
+	if !ok {
+		logrus.Debugf("Ignored WS-Discovery packet on %s from a VLAN which is not configured on it", wsdPacket.netInterface)
+		return
+	}
+	wsdPacket.vlanTag = &vlan
+	if !guard.allow(vlan, wsdPacket.payload, active.rateLimit(vlan), now) {
+		return
+	}
+	isMulticast := wsdPacket.dstIP != nil && wsdPacket.dstIP.IsMulticast()
+
+	// Network devices may set dstMAC to the local MAC address
+	// Rewrite dstMAC to ensure that it is set to the appropriate multicast MAC address
+	if wsdPacket.isIPv6 {
+		dstMacAddress = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x0C}
+	} else {
+		dstMacAddress = net.HardwareAddr{0x01, 0x00, 0x5E, 0x7F, 0xFF, 0xFA}
+	}
+
+	switch message.action {
+	case "Probe", "Resolve":
+		// Forward the request to the VLANs of the devices shared with the VLAN of the client,
+		// and save the request for the matches
+		logrus.Debugf("WS-Discovery %s packet received:\n%s", message.action, wsdPacket.packet.String())
+		if !isMulticast {
+			logrus.Infof("Protocol violation from %s, got a WS-Discovery %s from an unicast packet.", wsdPacket.srcMAC.String(), message.action)
+			return
+		}
+		if message.messageID == "" {
+			logrus.Infof("Protocol violation from %s, got a WS-Discovery %s without a MessageID.", wsdPacket.srcMAC.String(), message.action)
+			return
+		}
+		tags, ok := active.poolsMap[vlan]
+		if !ok {
+			return
+		}
+		wsdPacket.setSrcPort(wsdSessions.addMessage(querier{
+			ip:           *wsdPacket.srcIP,
+			tag:          vlan,
+			macAddress:   *wsdPacket.srcMAC,
+			port:         *wsdPacket.srcPort,
+			allowedVlans: tags,
+		}, message.messageID, wsDiscoverySessionDuration, now))
+
+		for _, tag := range tags {
+			out, ok := handles.forVlan(active, tag)
+			if !ok {
+				continue
+			}
+			srcIP := out.sourceIP(active, tag, wsdPacket.isIPv6)
+			sendPacket(out.handle, &wsdPacket, active.wireTag(tag), out.hardwareAddr, dstMacAddress, srcIP, nil)
+			guard.sentTo(tag, wsdPacket.udpPayload(), now)
+		}
+	case "Hello", "Bye":
+		// Reflect the announcement of a device to the VLANs it is shared with
+		_, device, ok := active.allowedDevices.match(&wsdPacket)
+		if !ok {
+			return
+		}
+		logrus.Debugf("WS-Discovery %s packet received:\n%s", message.action, wsdPacket.packet.String())
+		if device.OriginPool != vlan {
+			logrus.Warningf("spoofing/vlan leak detected from %s. Config expected traffic from VLAN %d, got a packet from %d.", wsdPacket.srcMAC.String(), device.OriginPool, vlan)
+			return
+		}
+		if !isMulticast {
+			logrus.Infof("Protocol violation from %s, got a WS-Discovery %s from an unicast packet.", wsdPacket.srcMAC.String(), message.action)
+			return
+		}
+
+		for _, tag := range device.SharedPools {
+			if !device.sharedAt(tag, now) {
+				continue
+			}
+			out, ok := handles.forVlan(active, tag)
+			if !ok {
+				continue
+			}
+			srcIP := out.sourceIP(active, tag, wsdPacket.isIPv6)
+			sendPacket(out.handle, &wsdPacket, active.wireTag(tag), out.hardwareAddr, dstMacAddress, srcIP, nil)
+			guard.sentTo(tag, wsdPacket.udpPayload(), now)
+		}
+	case "ProbeMatches", "ResolveMatches":
+		// Relay the matches of a device to the clients of the request
+		_, device, ok := active.allowedDevices.match(&wsdPacket)
+		if !ok {
+			return
+		}
+		logrus.Debugf("WS-Discovery %s packet received:\n%s", message.action, wsdPacket.packet.String())
+		if device.OriginPool != vlan {
+			logrus.Warningf("spoofing/vlan leak detected from %s. Config expected traffic from VLAN %d, got a packet from VLAN %d.", wsdPacket.srcMAC.String(), device.OriginPool, vlan)
+			return
+		}
+		wsdSession, ok := wsdSessions.lookupMessage(*wsdPacket.dstPort, message.relatesTo, vlan, wsDiscoverySessionDuration, now)
+		if !ok {
+			logrus.Infof("No matching WS-Discovery session found for %s relating to %s.", message.action, message.relatesTo)
+			return
+		}
+
+		tag := wsdSession.tag
+		if !slices.Contains(device.SharedPools, tag) || !device.sharedAt(tag, now) {
+			logrus.Debugf("Dropped WS-Discovery %s from %s, the device is not shared with VLAN %d", message.action, wsdPacket.srcMAC.String(), tag)
+			return
+		}
+		out, ok := handles.forVlan(active, tag)
+		if !ok {
+			return
+		}
+		srcIP := out.sourceIP(active, tag, wsdPacket.isIPv6)
+		wsdPacket.setDstPort(wsdSession.port)
+		sendPacket(out.handle, &wsdPacket, active.wireTag(tag), out.hardwareAddr, wsdSession.macAddress, srcIP, wsdSession.ip)
+	default:
+		logrus.Debugf("Ignored WS-Discovery %s from %s", message.action, wsdPacket.srcMAC.String())
+	}
+}
+
+// parseWSDiscovery returns the WS-Addressing headers of a SOAP envelope with a WS-Discovery action.
+func parseWSDiscovery(payload []byte) (wsDiscoveryMessage, bool) {
+	var envelope wsDiscoveryEnvelope
+	if err := xml.Unmarshal(payload, &envelope); err != nil {
+		return wsDiscoveryMessage{}, false
+	}
+	action := strings.TrimSpace(envelope.Header.Action)
+	for _, namespace := range wsDiscoveryNamespaces {
+		if name, ok := strings.CutPrefix(action, namespace); ok && name != "" {
+			return wsDiscoveryMessage{
+				action:    name,
+				messageID: strings.TrimSpace(envelope.Header.MessageID),
+				relatesTo: strings.TrimSpace(envelope.Header.RelatesTo),
+			}, true
+		}
+	}
+	return wsDiscoveryMessage{}, false
+}
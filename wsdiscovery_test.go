@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+func TestParseWSDiscovery(t *testing.T) {
+	probe := `<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:wsd="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:wsdp="http://schemas.xmlsoap.org/ws/2006/02/devprof">
+<soap:Header>
+<wsa:To>urn:schemas-xmlsoap-org:ws:2005:04:discovery</wsa:To>
+<wsa:Action>http://schemas.xmlsoap.org/ws/2005/04/discovery/Probe</wsa:Action>
+<wsa:MessageID>urn:uuid:0a6dc791-2be6-4991-9af1-454778a1917a</wsa:MessageID>
+</soap:Header>
+<soap:Body><wsd:Probe><wsd:Types>wsdp:Device</wsd:Types></wsd:Probe></soap:Body>
+</soap:Envelope>`
+	probeMatches := `<?xml version="1.0" encoding="UTF-8"?>
+<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://www.w3.org/2005/08/addressing" xmlns:d="http://docs.oasis-open.org/ws-dd/ns/discovery/2009/01">
+<s:Header>
+<a:Action>http://docs.oasis-open.org/ws-dd/ns/discovery/2009/01/ProbeMatches</a:Action>
+<a:MessageID>urn:uuid:4f9cbe5c-8d71-4d8e-9a4f-b5dd5e2a6c01</a:MessageID>
+<a:RelatesTo> urn:uuid:0a6dc791-2be6-4991-9af1-454778a1917a </a:RelatesTo>
+</s:Header>
+<s:Body><d:ProbeMatches><d:ProbeMatch><d:XAddrs>http://192.168.1.20:5357/</d:XAddrs></d:ProbeMatch></d:ProbeMatches></s:Body>
+</s:Envelope>`
+
+	testCases := []struct {
+		payload  string
+		expected wsDiscoveryMessage
+		ok       bool
+	}{
+		{probe, wsDiscoveryMessage{action: "Probe", messageID: "urn:uuid:0a6dc791-2be6-4991-9af1-454778a1917a"}, true},
+		{probeMatches, wsDiscoveryMessage{action: "ProbeMatches", messageID: "urn:uuid:4f9cbe5c-8d71-4d8e-9a4f-b5dd5e2a6c01", relatesTo: "urn:uuid:0a6dc791-2be6-4991-9af1-454778a1917a"}, true},
+		{"M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\n\r\n", wsDiscoveryMessage{}, false},
+		{`<Envelope><Header><Action>http://example.com/Probe</Action></Header></Envelope>`, wsDiscoveryMessage{}, false},
+	}
+	for _, testCase := range testCases {
+		computedResult, ok := parseWSDiscovery([]byte(testCase.payload))
+		if ok != testCase.ok || computedResult != testCase.expected {
+			t.Errorf("Error in parseWSDiscovery(): expected %+v %t, got %+v %t", testCase.expected, testCase.ok, computedResult, ok)
+		}
+	}
+}
+
+// createWSDiscoveryPacket returns a WS-Discovery message with the action and WS-Addressing headers
+// as received on the trunk test0.
+func createWSDiscoveryPacket(srcMAC, dstMAC string, vlan uint16, srcIP, dstIP string, srcPort, dstPort layers.UDPPort, action, messageID, relatesTo string) multicastPacket {
+	payload := fmt.Sprintf(`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing">
+<s:Header><a:Action>http://schemas.xmlsoap.org/ws/2005/04/discovery/%s</a:Action><a:MessageID>%s</a:MessageID><a:RelatesTo>%s</a:RelatesTo></s:Header>
+<s:Body/></s:Envelope>`, action, messageID, relatesTo)
+	return createUDPPacket(srcMAC, dstMAC, vlan, srcIP, dstIP, srcPort, dstPort, []byte(payload))
+}
+
+func TestReflectWSDiscovery(t *testing.T) {
+	active := newPolicy(config{
+		NetInterface: "test0",
+		Devices: map[macAddress]multicastDevice{
+			"00:14:22:01:23:45": {OriginPool: 100, SharedPools: []uint16{101}},
+		},
+		VlanIPSource: map[vlanID]vlanIpSource{
+			"100": {IpSource: net.ParseIP("192.168.100.2")},
+			"101": {IpSource: net.ParseIP("192.168.101.2")},
+			"102": {IpSource: net.ParseIP("192.168.102.2")},
+		},
+	})
+	reflectorMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	pw := &mockPacketWriter{}
+	handles := trunkHandles{"test0": &trunkHandle{trunk: &trunk{name: "test0", hardwareAddr: reflectorMAC}, handle: pw}}
+	sessions := newSessionTable("test_wsd", 16, wsdSessionPorts)
+	guard := newLoopGuard("WS-Discovery")
+	now := time.Now()
+
+	const client = "00:14:22:01:23:99"
+	const device = "00:14:22:01:23:45"
+	const probeID = "urn:uuid:0a6dc791-2be6-4991-9af1-454778a1917a"
+	testCases := []struct {
+		description string
+		packet      multicastPacket
+		vlan        uint16
+		dstIP       string
+		dstPort     layers.UDPPort
+	}{
+		{"Probe of a client is relayed to the VLAN of the device",
+			createWSDiscoveryPacket(client, "01:00:5e:7f:ff:fa", 101, "192.168.101.20", "239.255.255.250", 50000, 3702, "Probe", probeID, ""), 100, "239.255.255.250", 3702},
+		{"ProbeMatches of the device is routed back to the client",
+			createWSDiscoveryPacket(device, "02:00:00:00:00:01", 100, "192.168.100.20", "192.168.100.2", 3702, wsdSessionPorts, "ProbeMatches", "urn:uuid:4f9cbe5c-8d71-4d8e-9a4f-b5dd5e2a6c01", probeID), 101, "192.168.101.20", 50000},
+		{"ProbeMatches relating to another Probe is dropped",
+			createWSDiscoveryPacket(device, "02:00:00:00:00:01", 100, "192.168.100.20", "192.168.100.2", 3702, wsdSessionPorts, "ProbeMatches", "urn:uuid:2a9c2f1e-0000-4000-8000-000000000001", "urn:uuid:0a6dc791-2be6-4991-9af1-454778a1917b"), 0, "", 0},
+		{"Hello of the device from its origin pool is reflected",
+			createWSDiscoveryPacket(device, "01:00:5e:7f:ff:fa", 100, "192.168.100.20", "239.255.255.250", 3702, 3702, "Hello", "urn:uuid:2a9c2f1e-0000-4000-8000-000000000002", ""), 101, "239.255.255.250", 3702},
+		{"Hello spoofing the device from another VLAN is dropped",
+			createWSDiscoveryPacket(device, "01:00:5e:7f:ff:fa", 102, "192.168.102.20", "239.255.255.250", 3702, 3702, "Hello", "urn:uuid:2a9c2f1e-0000-4000-8000-000000000003", ""), 0, "", 0},
+		{"Hello of an unknown device is dropped",
+			createWSDiscoveryPacket("00:14:22:01:23:46", "01:00:5e:7f:ff:fa", 100, "192.168.100.21", "239.255.255.250", 3702, 3702, "Hello", "urn:uuid:2a9c2f1e-0000-4000-8000-000000000004", ""), 0, "", 0},
+	}
+
+	for _, testCase := range testCases {
+		pw.packet = nil
+		reflectWSDiscovery(handles, active, sessions, guard, testCase.packet, now)
+		if testCase.vlan == 0 {
+			if pw.packet != nil {
+				t.Errorf("Error in reflectWSDiscovery(): %s, but it was sent", testCase.description)
+			}
+			continue
+		}
+		if pw.packet == nil {
+			t.Errorf("Error in reflectWSDiscovery(): %s, but nothing was sent", testCase.description)
+			continue
+		}
+		sent := parseMulticastPacket(pw.packet)
+		if testCase.packet.dstIP.IsMulticast() && testCase.packet.srcPort != nil && *testCase.packet.srcPort == 50000 && *sent.srcPort != wsdSessionPorts {
+			t.Errorf("Error in reflectWSDiscovery(): %s, expected the Probe from reply port %d, got %d", testCase.description, wsdSessionPorts, *sent.srcPort)
+		}
+		if sent.vlanTag == nil || *sent.vlanTag != testCase.vlan || !sent.dstIP.Equal(net.ParseIP(testCase.dstIP)) || *sent.dstPort != testCase.dstPort {
+			t.Errorf("Error in reflectWSDiscovery(): %s, expected VLAN %d and destination %s port %d, got %v", testCase.description, testCase.vlan, testCase.dstIP, testCase.dstPort, pw.packet)
+		}
+	}
+}